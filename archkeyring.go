@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This is where the archlinux-keyring package installs Arch's keys, along with the lists of its master keys and of the
+// keys that have been revoked.
+var pacmanKeyrings = "/usr/share/pacman/keyrings"
+
+// This is where pacman-key keeps the keyring that pacman checks packages against.
+var pacmanGnupg = "/etc/pacman.d/gnupg"
+
+// pacman-key gives Arch's master keys marginal trust, so a key is only valid if at least this many of them have
+// certified it.
+const masterCertsNeeded = 3
+
+// haveArchKeyring reports whether or not archlinux-keyring is installed, and gpg with it to check certifications.
+func haveArchKeyring() bool {
+	if _, err := os.Stat(filepath.Join(pacmanKeyrings, "archlinux.gpg")); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("gpg")
+
+	return err == nil
+}
+
+// systemKeyring returns the keyring of an Arch system to check signatures against with gpgv, and where it comes from,
+// or "" if there isn't one. archlinux-keyring's own copy is preferred, since it's exactly what Arch shipped, and then
+// the keyring that pacman-key built from it.
+func systemKeyring() (string, string) {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		return "", ""
+	}
+
+	if keyring := filepath.Join(pacmanKeyrings, "archlinux.gpg"); isReadable(keyring) {
+		return keyring, "archlinux-keyring (" + keyring + ")"
+	}
+	for _, name := range []string{"pubring.gpg", "pubring.kbx"} {
+		if keyring := filepath.Join(pacmanGnupg, name); isReadable(keyring) {
+			return keyring, "pacman's keyring (" + keyring + ")"
+		}
+	}
+
+	return "", ""
+}
+
+// isReadable reports whether or not the file can be opened for reading.
+func isReadable(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	file.Close()
+
+	return true
+}
+
+// checkCertified makes sure that the key is certified by enough of Arch's master keys in archlinux-keyring, the same
+// way that pacman decides whether or not to trust a packager's key, and returns the master keys that certified it. The
+// keyring is imported into a throwaway gpg home directory so that the user's own trust settings don't come into it.
+func checkCertified(fingerprint string) ([]string, error) {
+	masters, err := readKeyList("archlinux-trusted")
+	if err != nil {
+		return nil, fmt.Errorf("error reading archlinux-keyring: %v", err)
+	}
+	revoked, err := readKeyList("archlinux-revoked")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading archlinux-keyring: %v", err)
+	}
+	fingerprint = strings.ToUpper(fingerprint)
+	if revoked[fingerprint] {
+		return nil, badSig("signing key %v has been revoked in archlinux-keyring", fingerprint)
+	}
+
+	home, err := ioutil.TempDir("", "flasharch-gnupg-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(home)
+	gpg := func(args ...string) ([]byte, error) {
+		args = append([]string{"--homedir", home, "--batch", "--quiet"}, args...)
+		return exec.Command("gpg", args...).Output()
+	}
+	if _, err := gpg("--import", filepath.Join(pacmanKeyrings, "archlinux.gpg")); err != nil {
+		return nil, fmt.Errorf("error importing archlinux-keyring: %v", err)
+	}
+	out, err := gpg("--with-colons", "--check-signatures", fingerprint)
+	if err != nil {
+		return nil, noSigKey("signing key %v is not in archlinux-keyring; update archlinux-keyring and try again",
+			fingerprint)
+	}
+
+	// The certifications we want look like this, where "!" means that gpg checked it and it's good, and the class is
+	// 10x to 13x for a certification of a user ID:
+	// "sig:!::<algo>:<key ID>:<created>::::<signer's user ID>:<class>::<signer's fingerprint>:..."
+	var chain []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 11 || fields[0] != "sig" || fields[1] != "!" || !isCertification(fields[10]) {
+			continue
+		}
+		if strings.HasSuffix(fingerprint, strings.ToUpper(fields[4])) {
+			// This is the key's own self-signature.
+			continue
+		}
+		for master := range masters {
+			if !strings.HasSuffix(master, strings.ToUpper(fields[4])) || seen[master] || revoked[master] {
+				continue
+			}
+			seen[master] = true
+			chain = append(chain, fmt.Sprintf("%v %v", master, unescapeColons(fields[9])))
+		}
+	}
+	if len(chain) < masterCertsNeeded {
+		return nil, badSig("signing key %v is certified by %v of Arch's master keys in archlinux-keyring, "+
+			"and %v are needed", fingerprint, len(chain), masterCertsNeeded)
+	}
+
+	sort.Strings(chain)
+
+	return chain, nil
+}
+
+// readKeyList reads one of archlinux-keyring's lists of fingerprints. Each line starts with a fingerprint, which
+// archlinux-trusted follows with the key's trust level, e.g. "<fingerprint>:4:".
+func readKeyList(name string) (map[string]bool, error) {
+	file, err := os.Open(filepath.Join(pacmanKeyrings, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys[strings.ToUpper(strings.Split(line, ":")[0])] = true
+	}
+
+	return keys, scanner.Err()
+}
+
+// isCertification reports whether or not the signature class from gpg's colon output is an exportable certification of
+// a user ID. The class is two hex digits followed by "x" for an exportable signature or "l" for a local one.
+func isCertification(class string) bool {
+	return len(class) == 3 && class[0] == '1' && class[1] >= '0' && class[1] <= '3' && class[2] == 'x'
+}
+
+// unescapeColons undoes the escaping of colons in a user ID from gpg's colon output.
+func unescapeColons(s string) string {
+	return strings.ReplaceAll(s, `\x3a`, ":")
+}
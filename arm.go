@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// This is the Arch Linux ARM mirror. It redirects each download to a mirror near the caller.
+var alarmMirror = "http://os.archlinuxarm.org/os/"
+
+// These are the architectures that we can flash. Everything other than x86_64 comes from Arch Linux ARM.
+var arches = []string{"x86_64", "aarch64", "armv7"}
+
+// isARM reports whether or not we're flashing an Arch Linux ARM image instead of the regular ISO.
+func isARM() bool {
+	return *archFlag != "x86_64"
+}
+
+// checkArch makes sure that the architecture is one we know about and that the other options make sense for it.
+func checkArch() error {
+	found := false
+	for _, arch := range arches {
+		if *archFlag == arch {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("invalid architecture: %v (must be one of %v)", *archFlag, strings.Join(arches, ", "))
+	}
+
+	if !isARM() {
+		if *boardFlag != "" {
+			return fmt.Errorf("--board only works with Arch Linux ARM")
+		}
+		return nil
+	}
+
+	// Arch Linux ARM only ever has the latest build of each image, and it doesn't publish torrents.
+	if *releaseFlag != "" {
+		return fmt.Errorf("--release does not work with Arch Linux ARM")
+	}
+	if *torrentFlag {
+		return fmt.Errorf("--torrent does not work with Arch Linux ARM")
+	}
+
+	return nil
+}
+
+// armMirrors returns the mirrors to search for the Arch Linux ARM image. The mirrors for the regular ISO don't carry
+// it, so only the --mirror flag can change this.
+func armMirrors() ([]string, error) {
+	mirrors := []string{alarmMirror}
+	if len(mirrorFlag) > 0 {
+		fmt.Println("Using mirrors from --mirror")
+		mirrors = mirrorFlag
+	}
+
+	if *httpsOnlyFlag {
+		if mirrors = filterHTTPS(mirrors); len(mirrors) == 0 {
+			return nil, fmt.Errorf("no https mirrors")
+		}
+	}
+
+	return mirrors, nil
+}
+
+// armPattern returns the pattern that the name of the image has to match. Every architecture has a generic tarball,
+// and some boards have their own tarball or image.
+func armPattern() *regexp.Regexp {
+	name := *archFlag
+	if *boardFlag != "" {
+		name = *boardFlag + "-" + name
+	}
+
+	return regexp.MustCompile(`^ArchLinuxARM-` + regexp.QuoteMeta(name) + `-latest\.(tar\.gz|img\.xz|img)$`)
+}
+
+// armFilename parses the mirror's directory and pulls out the name of the image for our architecture, along with its
+// MD5 checksum, which Arch Linux ARM publishes next to each image.
+func armFilename(ctx context.Context, mirror string) (string, string, error) {
+	if !isHTTP(mirror) {
+		return "", "", fmt.Errorf("mirrors for Arch Linux ARM must be http or https")
+	}
+
+	doc, err := getPage(ctx, mirror)
+	if err != nil {
+		return "", "", fmt.Errorf("error accessing mirror: %v", err)
+	}
+
+	pattern := armPattern()
+	links := parseLinks(doc, func(href string) bool {
+		return pattern.MatchString(path.Base(href))
+	})
+	if len(links) == 0 {
+		return "", "", fmt.Errorf("mirror does not have an image for %v", *archFlag)
+	}
+	filename := links[0]
+
+	url, err := joinURL(mirror, filename+".md5")
+	if err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("error getting checksum: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", "", fmt.Errorf("error getting checksum: %v", resp.Status)
+	}
+
+	// The file looks like this: "<checksum>  ArchLinuxARM-aarch64-latest.tar.gz"
+	line, err := bufio.NewReader(io.LimitReader(resp.Body, 1024)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", "", fmt.Errorf("error getting checksum: %v", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields[0]) != 32 {
+		return "", "", fmt.Errorf("invalid checksum file")
+	}
+
+	return filename, fields[0], nil
+}
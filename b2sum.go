@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// b2sum prints BLAKE2b-512 checksums, which are 64 bytes long.
+const b2Size = 64
+
+// These are the BLAKE2b checksums of the files that were hashed while they were downloaded, like digests.
+var b2Digests = make(map[string]string)
+
+// checkChecksum makes sure that --checksum is something we know. checkTools makes sure that we can compute it.
+func checkChecksum() error {
+	switch *checksumFlag {
+	case "sha256", "b2", "both":
+		return nil
+	}
+
+	return fmt.Errorf("invalid --checksum: %v (must be b2, sha256, or both)", *checksumFlag)
+}
+
+// wantSHA256 reports whether or not --checksum asks for the SHA-256 checksum to be verified.
+func wantSHA256() bool {
+	return *checksumFlag != "b2"
+}
+
+// wantB2 reports whether or not --checksum asks for the BLAKE2b checksum to be verified.
+func wantB2() bool {
+	return *checksumFlag != "sha256"
+}
+
+// checksumName returns the name of the algorithm that the checksum was computed with, going by its length.
+func checksumName(sum string) string {
+	switch len(sum) {
+	case md5.Size * 2:
+		return "MD5"
+	case sha256.Size * 2:
+		return "SHA-256"
+	case b2Size * 2:
+		return "BLAKE2b"
+	}
+
+	return "unknown"
+}
+
+// checksums returns the checksums that the ISO from the mirror should be verified against. sum is the checksum that
+// came with the filename, if any. Arch Linux ARM only publishes MD5 checksums, so --checksum doesn't apply to it.
+func checksums(ctx context.Context, mirror, filename, sum string) []string {
+	if isARM() {
+		if sum == "" {
+			return nil
+		}
+		return []string{sum}
+	}
+
+	var b2Sum string
+	if wantB2() || sum == "" {
+		b2Sum = getB2Sum(ctx, mirror, filename)
+	}
+
+	return selectSums(filename, sum, b2Sum)
+}
+
+// selectSums picks the checksums to verify the ISO against, as chosen with --checksum. If the one that was asked for
+// isn't published, the other one is used instead.
+func selectSums(filename, sha256Sum, b2Sum string) []string {
+	filename = path.Base(filename)
+	switch {
+	case wantSHA256() && sha256Sum == "" && b2Sum != "":
+		fmt.Println("No SHA-256 checksum published for", filename+", using BLAKE2b")
+	case wantB2() && b2Sum == "" && sha256Sum != "":
+		fmt.Println("No BLAKE2b checksum published for", filename+", using SHA-256")
+	}
+
+	var sums []string
+	if sha256Sum != "" && (wantSHA256() || b2Sum == "") {
+		sums = append(sums, sha256Sum)
+	}
+	if b2Sum != "" && (wantB2() || sha256Sum == "") {
+		sums = append(sums, b2Sum)
+	}
+
+	return sums
+}
+
+// getB2Sum returns the BLAKE2b checksum of the ISO, or "" if we can't find one. Like with SHA-256 checksums, the releng
+// API is asked first, and then the mirror's b2sums.txt.
+func getB2Sum(ctx context.Context, mirror, filename string) string {
+	if *releaseFlag == "" && !isFile(mirror) {
+		if r, err := getLatestRelease(ctx); err == nil && r.filename() == path.Base(filename) && r.B2Sum != "" {
+			return r.B2Sum
+		}
+	}
+
+	name, sum, err := readSums(ctx, mirror, "b2sums.txt", b2Size*2)
+	if err != nil || path.Base(name) != path.Base(filename) {
+		return ""
+	}
+
+	return sum
+}
+
+// b2Hash computes the BLAKE2b checksum of whatever is written to it by feeding it to b2sum.
+type b2Hash struct {
+	*commandWriter
+	out bytes.Buffer
+}
+
+// startB2 starts a new b2Hash. It must be closed, even if sum is never called.
+func startB2(ctx context.Context) (*b2Hash, error) {
+	b := &b2Hash{}
+	c, err := startCommand(ctx, &b.out, "b2sum")
+	if err != nil {
+		return nil, err
+	}
+	b.commandWriter = c
+
+	return b, nil
+}
+
+// sum waits for b2sum to finish and returns the checksum of everything that was written.
+func (b *b2Hash) sum() (string, error) {
+	if err := b.Close(); err != nil {
+		return "", fmt.Errorf("error computing BLAKE2b checksum: %v", err)
+	}
+
+	// The output looks like this: "<checksum>  -"
+	fields := strings.Fields(b.out.String())
+	if len(fields) == 0 || len(fields[0]) != b2Size*2 {
+		return "", fmt.Errorf("unexpected output from b2sum: %q", b.out.String())
+	}
+
+	return fields[0], nil
+}
+
+// startB2Digest starts hashing a download with BLAKE2b if --checksum asks for it, so that the checksum is ready as soon
+// as the download is. It returns nil if --checksum doesn't ask for it.
+func startB2Digest(ctx context.Context) (*b2Hash, error) {
+	if !wantB2() {
+		return nil, nil
+	}
+
+	return startB2(ctx)
+}
+
+// finishB2Digest remembers the BLAKE2b checksum of the file if b2 hashed it while it was downloaded.
+func finishB2Digest(b2 *b2Hash, filename string) error {
+	if b2 == nil {
+		return nil
+	}
+
+	sum, err := b2.sum()
+	if err != nil {
+		return err
+	}
+	setB2Digest(filename, sum)
+
+	return nil
+}
+
+// setB2Digest remembers the BLAKE2b checksum of the file. An empty checksum forgets it, for when the file changes.
+func setB2Digest(filename, sum string) {
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+
+	if sum == "" {
+		delete(b2Digests, filename)
+	} else {
+		b2Digests[filename] = sum
+	}
+}
+
+// getB2Digest returns the BLAKE2b checksum of the file if it was hashed while it was downloaded, or "" if it wasn't.
+func getB2Digest(filename string) string {
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+
+	return b2Digests[filename]
+}
+
+// fileB2Digest returns the BLAKE2b checksum of the file, hashing it if it wasn't hashed while it was downloaded.
+func fileB2Digest(ctx context.Context, filename string) (string, error) {
+	if sum := getB2Digest(filename); sum != "" {
+		return sum, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	b, err := startB2(ctx)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(b, file); err != nil {
+		b.Close()
+		return "", err
+	}
+	sum, err := b.sum()
+	if err != nil {
+		return "", err
+	}
+	setB2Digest(filename, sum)
+
+	return sum, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// These are the ways of writing to the drive, for --backend. udisks asks UDisks2 to open the drive for us, so that
+// polkit can let a user who isn't root flash a drive that they plugged in. direct opens the drive ourselves, which
+// usually takes root. dd has dd do the writing.
+const (
+	backendUDisks = "udisks"
+	backendDirect = "direct"
+	backendDD     = "dd"
+)
+
+// backend is how we'll write to the drive.
+var backend string
+
+// checkBackend works out how we'll write to the drive. Without --backend, UDisks2 is used unless we're root (who can
+// open the drive ourselves), --persistence or restore needs to partition and format the drive itself, or --image is
+// flashing a file, as long as UDisks2 is running. If it isn't, we write to the drive directly, like we do when
+// --backend udisks is given and it isn't running. --use-dd is the same as --backend dd.
+func checkBackend() error {
+	switch *backendFlag {
+	case "", backendUDisks, backendDirect, backendDD:
+	default:
+		return fmt.Errorf("invalid --backend: must be udisks, direct, or dd")
+	}
+	if *useDDFlag {
+		if *backendFlag != "" && *backendFlag != backendDD {
+			return fmt.Errorf("--use-dd can't be used with --backend %v", *backendFlag)
+		}
+		*backendFlag = backendDD
+	}
+	if *backendFlag == backendUDisks && *persistenceFlag != "" {
+		return fmt.Errorf("--persistence does not work with --backend udisks, because it formats the drive itself")
+	}
+
+	backend = *backendFlag
+	if backend == "" {
+		backend = backendDirect
+		if os.Geteuid() != 0 && *persistenceFlag == "" && !*downloadOnlyFlag && !restoring && !*imageFlag &&
+			udisksAvailable() {
+			backend = backendUDisks
+		}
+	} else if backend == backendUDisks && !udisksAvailable() {
+		fmt.Println("UDisks2 isn't available, so the drive will be written directly instead")
+		backend = backendDirect
+	}
+
+	return nil
+}
+
+// openDrive opens the USB drive for reading or for writing. With the udisks backend, a block device is opened by
+// UDisks2.
+func openDrive(usb string, write bool) (*os.File, error) {
+	switch {
+	case backend == backendUDisks && checkBlockDevice(usb) == nil:
+		return udisksOpen(usb, write)
+	case write:
+		return os.OpenFile(usb, os.O_WRONLY, 0)
+	}
+
+	return os.Open(usb)
+}
+
+// setDirect makes the file's reads and writes bypass the page cache, if the drive (or the file system it's on) allows
+// that.
+func setDirect(file *os.File) error {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_SETFL, flags|syscall.O_DIRECT)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
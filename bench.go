@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// benchFile is where the write speed of each benchmarked drive is kept, in the cache, so that flashing it later can
+// say how long it'll take.
+const benchFile = "benchmarks.json"
+
+// benchmarking is whether or not we're measuring the drives' speed instead of flashing them.
+var benchmarking bool
+
+// benchSize is how much of each drive the benchmark writes or reads, from --bench-size.
+var benchSize int64
+
+// These options are about getting and flashing an image, so bench doesn't take them. --iso is still taken, to estimate
+// how long that ISO will take to flash.
+var notForBench = map[string]bool{"download-only": true, "stream": true, "copy-to": true, "ventoy": true,
+	"persistence": true, "wipe": true, "no-wipe": true, "quick-verify": true, "no-discard": true}
+
+// benchRecord is the result of a drive's write benchmark.
+type benchRecord struct {
+	Rate float64   `json:"rate"` // bytes per second
+	Date time.Time `json:"date"`
+}
+
+// checkBench handles the bench subcommand, which measures how fast the drives really are: "bench /dev/sdb". Options
+// can come after bench too, so the arguments are parsed again from there, which leaves the drives as the arguments.
+// --bench-size and --read-only only mean anything to bench.
+func checkBench() error {
+	if flag.Arg(0) != "bench" {
+		var err error
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "bench-size" || f.Name == "read-only" {
+				err = fmt.Errorf("--%v only works with bench", f.Name)
+			}
+		})
+		return err
+	}
+	flag.CommandLine.Parse(flag.Args()[1:])
+	benchmarking = true
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if notForBench[f.Name] && err == nil {
+			err = fmt.Errorf("bench does not take --%v", f.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	size, err := parseSize(*benchSizeFlag)
+	if err != nil || size < flashBlockSize {
+		return fmt.Errorf("invalid --bench-size: must be at least %v, like 256M", reduce(flashBlockSize))
+	}
+	benchSize = int64(size) / flashBlockSize * flashBlockSize
+
+	return nil
+}
+
+// benchTargets benchmarks every drive that's still good, one after another so that they don't slow each other down,
+// and reports whether or not all of them were benchmarked.
+func benchTargets(targets []*target) bool {
+	done := 0
+	for _, t := range targets {
+		if t.err != nil {
+			continue
+		}
+		if err := benchDrive(t.usb); err != nil {
+			t.fail("Error benchmarking drive", err, terminal)
+			continue
+		}
+		done++
+	}
+	if len(targets) > 1 {
+		fmt.Printf("Benchmarked %v of %v drives (flasharch %v)\n", done, len(targets), getVersion())
+		for _, t := range targets {
+			if t.err != nil {
+				fmt.Printf("\t%v: FAILED: %v: %v\n", t.usb, t.stage, t.err)
+			}
+		}
+	}
+	printOverridden()
+
+	return done == len(targets)
+}
+
+// benchDrive measures how fast the drive really is, by writing --bench-size bytes of random data to the start of it
+// (or just reading them with --read-only) in the same blocks that flashing writes, around the page cache if the drive
+// allows it. How fast each block went is collected, so that a drive that slows down as it fills its cache shows up in
+// the slower percentiles. The write speed is kept for the next time that the drive is flashed, and used to estimate
+// how long the ISO will take.
+func benchDrive(usb string) error {
+	write := !*readOnlyFlag
+	size := benchSize
+	if capacity, err := deviceSize(usb); err == nil && capacity > 0 && capacity < size {
+		size = capacity / flashBlockSize * flashBlockSize
+	}
+	if size < flashBlockSize {
+		return fmt.Errorf("%v is too small to benchmark", usb)
+	}
+
+	device, err := openDrive(usb, write)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	direct := setDirect(device) == nil
+	buf := alignedBuffer(flashBlockSize, flashAlign)
+	kind, label, doing := "Write", "Wrote", "Writing"
+	if write {
+		// Random data, because some drives compress what they're given.
+		rand.Read(buf)
+	} else {
+		kind, label, doing = "Read", "Read", "Reading"
+	}
+	how := "around the page cache"
+	if !direct {
+		how = "through the page cache, syncing each block"
+		if !write {
+			how = "through the page cache, which can make it look faster than it is"
+		}
+	}
+	fmt.Println(doing, reduce(int(size)), "of", usb, "in", reduce(flashBlockSize), "blocks", how)
+
+	p := progress{label: label, total: int(size), r: terminal}
+	var rates []float64
+	start := time.Now()
+	for offset := int64(0); offset < size; offset += flashBlockSize {
+		blockStart := time.Now()
+		if write {
+			err = writeBlock(device, usb, buf, offset)
+			if err == nil && !direct {
+				err = device.Sync()
+			}
+		} else if _, err = device.ReadAt(buf, offset); err != nil {
+			err = fmt.Errorf("error reading %v at byte %v: %v", usb, offset, err)
+		}
+		if err != nil {
+			terminal.flush() // Flush last progress line.
+			return err
+		}
+		rates = append(rates, float64(len(buf))/time.Since(blockStart).Seconds())
+		p.have += len(buf)
+		p.print()
+	}
+	terminal.flush() // Flush last progress line.
+	average := float64(size) / time.Since(start).Seconds()
+
+	sort.Float64s(rates)
+	speed := func(rate float64) string {
+		return reduce(int(rate)) + "/s"
+	}
+	fmt.Printf("%v speed of %v over %v blocks:\n", kind, usb, len(rates))
+	fmt.Println("\tAverage:         ", speed(average))
+	fmt.Println("\tSlowest:         ", speed(rates[0]))
+	fmt.Println("\t10th percentile: ", speed(percentile(rates, 0.1)))
+	fmt.Println("\tMedian:          ", speed(percentile(rates, 0.5)))
+	fmt.Println("\t90th percentile: ", speed(percentile(rates, 0.9)))
+	fmt.Println("\tFastest:         ", speed(rates[len(rates)-1]))
+	if !write {
+		return nil
+	}
+
+	if err := saveBench(usb, average); err != nil {
+		fmt.Println("Error saving the benchmark for the next flash:", err)
+	}
+	iso, isoSize := benchISO()
+	if isoSize <= 0 {
+		fmt.Println("At that speed, flashing takes about", benchDuration(1<<30, average), "for each 1G of the ISO")
+		return nil
+	}
+	fmt.Printf("At that speed, flashing %v (%v) should take about %v\n", filepath.Base(iso), reduce(int(isoSize)),
+		benchDuration(isoSize, average))
+
+	return nil
+}
+
+// percentile returns the value that the fraction p of the sorted values are at or below.
+func percentile(sorted []float64, p float64) float64 {
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
+
+// benchDuration returns how long writing size bytes at rate bytes per second takes.
+func benchDuration(size int64, rate float64) time.Duration {
+	return time.Duration(float64(size) / rate * float64(time.Second)).Round(time.Second)
+}
+
+// benchISO returns the ISO whose flashing time the benchmark estimates, and its size: the one given with --iso, or
+// else the newest one in the cache. If there isn't one, the size is 0.
+func benchISO() (string, int64) {
+	if *isoFlag != "" {
+		if size, err := imageSize(*isoFlag); err == nil {
+			return *isoFlag, size
+		}
+		return "", 0
+	}
+
+	root, err := cacheRoot()
+	if err != nil {
+		return "", 0
+	}
+	entries, _ := ioutil.ReadDir(root)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].IsDir() || !releasePattern.MatchString(entries[i].Name()) {
+			continue
+		}
+		iso := filepath.Join(root, entries[i].Name(), release{Version: entries[i].Name()}.filename())
+		if info, err := os.Stat(iso); err == nil {
+			return iso, info.Size()
+		}
+	}
+
+	return "", 0
+}
+
+// benchKey identifies the drive among the benchmarks by what the kernel and udev know about it, since its path can
+// change every time it's plugged in.
+func benchKey(usb string) string {
+	d := deviceInfo(usb)
+
+	return strings.Join([]string{d.Vendor, d.Model, d.Serial, fmt.Sprint(d.Size)}, "/")
+}
+
+// loadBenches returns every drive's benchmark, by benchKey.
+func loadBenches() (map[string]benchRecord, error) {
+	root, err := cacheRoot()
+	if err != nil {
+		return nil, err
+	}
+	benches := make(map[string]benchRecord)
+	data, err := ioutil.ReadFile(filepath.Join(root, benchFile))
+	if os.IsNotExist(err) {
+		return benches, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &benches); err != nil {
+		return nil, err
+	}
+
+	return benches, nil
+}
+
+// saveBench keeps the drive's write speed for the next time that it's flashed.
+func saveBench(usb string, rate float64) error {
+	benches, err := loadBenches()
+	if err != nil {
+		benches = make(map[string]benchRecord)
+	}
+	benches[benchKey(usb)] = benchRecord{Rate: rate, Date: time.Now()}
+	data, err := json.MarshalIndent(benches, "", "\t")
+	if err != nil {
+		return err
+	}
+	root, err := cacheRoot()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(root, benchFile), append(data, '\n'), 0644)
+}
+
+// benchEstimate returns how long flashing the image to the drive should take, going by the drive's benchmark, or ""
+// if the drive hasn't been benchmarked or the image's size isn't known.
+func benchEstimate(image, usb string) string {
+	benches, err := loadBenches()
+	if err != nil {
+		return ""
+	}
+	b, ok := benches[benchKey(usb)]
+	size, err := imageSize(image)
+	if !ok || b.Rate <= 0 || err != nil || size <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%v wrote at %v/s when it was benchmarked on %v, so this should take about %v", usb,
+		reduce(int(b.Rate)), b.Date.Format("2006-01-02"), benchDuration(size, b.Rate))
+}
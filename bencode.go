@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// bdecode decodes one bencoded value, which is how BitTorrent encodes everything from .torrent files to tracker and DHT
+// messages. Integers are returned as int64, strings as string (they might hold binary data), lists as []interface{},
+// and dictionaries as map[string]interface{}. Anything after the value is an error.
+func bdecode(data []byte) (interface{}, error) {
+	d := bdecoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("bencode: trailing data at offset %v", d.pos)
+	}
+
+	return v, nil
+}
+
+// bdecodeDict decodes a bencoded dictionary and also returns the raw encoding of each of its values, so that something
+// like the info dictionary of a .torrent file can be hashed exactly as it was encoded.
+func bdecodeDict(data []byte) (map[string]interface{}, map[string][]byte, error) {
+	d := bdecoder{data: data, raw: make(map[string][]byte)}
+	v, err := d.value()
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("bencode: not a dictionary")
+	}
+
+	return dict, d.raw, nil
+}
+
+// bdecoder decodes bencoded values one after another.
+type bdecoder struct {
+	data  []byte
+	pos   int
+	depth int
+	raw   map[string][]byte // the raw values of the outermost dictionary, if they're wanted
+}
+
+// value decodes the value at the current position.
+func (d *bdecoder) value() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("bencode: unexpected end of data")
+	}
+
+	// Nothing that we read is nested this deeply, and a limit keeps a malicious peer from blowing up the stack.
+	if d.depth > 64 {
+		return nil, fmt.Errorf("bencode: nested too deeply")
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, fmt.Errorf("bencode: unterminated integer at offset %v", d.pos)
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bencode: invalid integer at offset %v", d.pos)
+		}
+		d.pos += end + 1
+		return n, nil
+	case c >= '0' && c <= '9':
+		return d.str()
+	case c == 'l':
+		d.pos++
+		d.depth++
+		list := []interface{}{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		d.depth--
+		return list, d.end()
+	case c == 'd':
+		d.pos++
+		d.depth++
+		dict := make(map[string]interface{})
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			key, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			start := d.pos
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+			if d.raw != nil && d.depth == 1 {
+				d.raw[key] = d.data[start:d.pos]
+			}
+		}
+		d.depth--
+		return dict, d.end()
+	default:
+		return nil, fmt.Errorf("bencode: unexpected %q at offset %v", c, d.pos)
+	}
+}
+
+// str decodes the string at the current position, which looks like "4:spam".
+func (d *bdecoder) str() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", fmt.Errorf("bencode: invalid string at offset %v", d.pos)
+	}
+	n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	start := d.pos + colon + 1
+	if err != nil || n < 0 || n > len(d.data)-start {
+		return "", fmt.Errorf("bencode: invalid string length at offset %v", d.pos)
+	}
+	d.pos = start + n
+
+	return string(d.data[start:d.pos]), nil
+}
+
+// end consumes the "e" that ends a list or dictionary.
+func (d *bdecoder) end() error {
+	if d.pos >= len(d.data) {
+		return fmt.Errorf("bencode: unexpected end of data")
+	}
+	d.pos++
+
+	return nil
+}
+
+// bencode encodes the value. It takes the same types that bdecode returns, as well as int and []byte.
+func bencode(v interface{}) []byte {
+	var buf bytes.Buffer
+	bencodeTo(&buf, v)
+
+	return buf.Bytes()
+}
+
+// bencodeTo writes the encoded value to buf. Dictionary keys are sorted, as the encoding requires.
+func bencodeTo(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			bencodeTo(buf, item)
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			bencodeTo(buf, key)
+			bencodeTo(buf, v[key])
+		}
+		buf.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// bstring returns the string in the dictionary under the key, or "" if there isn't one.
+func bstring(dict map[string]interface{}, key string) string {
+	s, _ := dict[key].(string)
+
+	return s
+}
+
+// bint returns the integer in the dictionary under the key, or -1 if there isn't one.
+func bint(dict map[string]interface{}, key string) int64 {
+	if n, ok := dict[key].(int64); ok {
+		return n
+	}
+
+	return -1
+}
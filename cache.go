@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// This is how many releases we'll keep in the cache. Older ones are removed after a new one is downloaded.
+var cacheKeep = 3
+
+// This is where the ISO and its signature are downloaded to. It's the cache directory of the release if we're caching
+// it.
+var downloadDir = os.TempDir()
+
+// cacheRoot returns the directory that holds every cached release, e.g. ~/.cache/flasharch.
+func cacheRoot() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "flasharch"), nil
+}
+
+// cacheDir returns the cache directory of the release, creating it if it doesn't exist yet.
+func cacheDir(version string) (string, error) {
+	root, err := cacheRoot()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// cacheRelease returns the version of the release that we want to cache, or "" if we can't or shouldn't cache it.
+// Arch Linux ARM only has a rolling "latest" image, so it isn't cached. Neither is anything downloaded to a directory
+// given with --download-dir.
+func cacheRelease(ctx context.Context) string {
+	if *noCacheFlag || *downloadDirFlag != "" || isARM() {
+		return ""
+	}
+	if *releaseFlag != "" {
+		return *releaseFlag
+	}
+
+	r, err := getLatestRelease(ctx)
+	if err != nil {
+		return ""
+	}
+
+	return r.Version
+}
+
+// getCached returns the paths to the cached ISO and signature of the release, as long as they're both there and the
+// signature still verifies, or the manifest of an earlier run says that it did and the ISO hasn't changed since. If
+// they aren't there, or the check shows that they're bad, it returns empty paths so that the release is downloaded
+// again. If the check couldn't be done at all, like when the signing key can't be fetched, the files are kept and the
+// error is returned, since a new download wouldn't fare any better.
+func getCached(ctx context.Context, version string) (string, string, error) {
+	if version == "" {
+		return "", "", nil
+	}
+	root, err := cacheRoot()
+	if err != nil {
+		return "", "", nil
+	}
+
+	isoFile := filepath.Join(root, version, release{Version: version}.filename())
+	sigFile := isoFile + ".sig"
+	if _, err := os.Stat(isoFile); err != nil {
+		return "", "", nil
+	}
+	if _, err := os.Stat(sigFile); err != nil {
+		return "", "", nil
+	}
+
+	// A partial download isn't worth verifying. It will be resumed instead.
+	if validator, _ := readResume(isoFile); validator != "" {
+		return "", "", nil
+	}
+
+	fmt.Println("Found cached ISO", isoFile)
+	if started := time.Now(); !*skipVerifyFlag && checkManifest(isoFile) {
+		// The ISO is exactly what an earlier run verified, so there's no need to check its signature again.
+		fmt.Println("Cached ISO still matches the checksum in its manifest, skipping verification")
+		err = checkPinnedSum(ctx, isoFile)
+		recordPhase("verify", started)
+	} else {
+		err = verifyISO(ctx, isoFile, sigFile)
+	}
+	var mismatch checksumError
+	switch {
+	case err == nil:
+		return isoFile, sigFile, nil
+	case exitCode(err) != exitBadSig && !errors.As(err, &mismatch):
+		exitIfInterrupted()
+		return "", "", fmt.Errorf("couldn't verify cached ISO %v, which is kept as it is: %w", isoFile, err)
+	}
+
+	exitIfInterrupted()
+	fmt.Println("Error verifying cached ISO, downloading it again:", err)
+	os.Remove(isoFile)
+	os.Remove(sigFile)
+	removeManifest(isoFile)
+	removeValidators(isoFile)
+	removeValidators(sigFile)
+
+	return "", "", nil
+}
+
+// pruneCache removes every cached release except for the newest ones and current, which is the release being flashed.
+// current counts toward the number kept even when it's older than the others, as it is with --release.
+func pruneCache(keep int, current string) {
+	root, err := cacheRoot()
+	if err != nil {
+		return
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	// Releases are named after their date, so they sort oldest first.
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() && releasePattern.MatchString(entry.Name()) && entry.Name() != current {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Strings(versions)
+
+	for len(versions) > keep-1 {
+		if err := os.RemoveAll(filepath.Join(root, versions[0])); err != nil {
+			fmt.Println("Error removing cached release:", err)
+		} else {
+			fmt.Println("Removed cached release", versions[0])
+		}
+		versions = versions[1:]
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// getSums reads the mirror's sha256sums.txt and pulls out the name of the ISO file and its checksum. Only http and
+// local mirrors are checked.
+func getSums(ctx context.Context, mirror string) (string, string, error) {
+	return readSums(ctx, mirror, "sha256sums.txt", sha256.Size*2)
+}
+
+// readSums reads the mirror's list of checksums with the given name, whose checksums are length hex digits long, and
+// pulls out the name of the ISO file and its checksum. The list is checked against its signature before it's used.
+func readSums(ctx context.Context, mirror, name string, length int) (string, string, error) {
+	url, err := joinURL(mirror, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	data, err := readSmallFile(ctx, url, "downloading checksums")
+	if err != nil {
+		return "", "", err
+	}
+	filename, sum, err := parseSums(bytes.NewReader(data), length)
+	if err != nil {
+		return "", "", err
+	}
+	if err := authenticateSums(ctx, url, data, sum); err != nil {
+		return "", "", err
+	}
+
+	return filename, sum, nil
+}
+
+// readSmallFile reads the small file at the url, which must be http or local. what describes the download for the
+// messages printed between attempts.
+func readSmallFile(ctx context.Context, url, what string) ([]byte, error) {
+	switch {
+	case isFile(url):
+		filename, err := localPath(url)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(filename)
+	case isHTTP(url):
+		var data []byte
+		err := retry(ctx, what, func() error {
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return responseError(resp)
+			}
+			data, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			return err
+		})
+		return data, err
+	}
+
+	return nil, fmt.Errorf("checksums are only available over http or from a local directory")
+}
+
+// parseSums parses a list of checksums that are length hex digits long and returns the name and checksum of the first
+// ISO in it. The bootstrap tarball is listed in the same file, but we don't want it.
+func parseSums(r io.Reader, length int) (string, string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Each line looks like this: "<checksum>  archlinux-2021.01.01-x86_64.iso"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sum := strings.ToLower(fields[0])
+		name := strings.TrimPrefix(fields[1], "*") // binary mode marker
+
+		if strings.Contains(name, "bootstrap") || !strings.HasSuffix(name, ".iso") {
+			continue
+		}
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != length {
+			continue
+		}
+
+		return name, sum, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	return "", "", fmt.Errorf("no ISO listed")
+}
+
+// These are the SHA-256 checksums of the files that were hashed while they were downloaded, so that we don't have to
+// read them back from disk.
+var (
+	digests   = make(map[string]string)
+	digestsMu sync.Mutex
+)
+
+// These are the checksums of compressed images as they were served, before they were decompressed on disk, keyed by
+// the file they were decompressed to. Published checksums are of the compressed image.
+var servedSums = make(map[string][]string)
+
+// setServedSums remembers the checksums of the compressed image that was decompressed to the file. There can be one
+// for each algorithm.
+func setServedSums(filename string, sums ...string) {
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+
+	servedSums[filename] = sums
+}
+
+// setDigest remembers the SHA-256 checksum of the file. An empty checksum forgets it, for when the file changes.
+func setDigest(filename, sum string) {
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+
+	if sum == "" {
+		delete(digests, filename)
+	} else {
+		digests[filename] = sum
+	}
+}
+
+// getDigest returns the SHA-256 checksum of the file if it was hashed while it was downloaded, or "" if it wasn't.
+func getDigest(filename string) string {
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+
+	return digests[filename]
+}
+
+// fileDigest returns the SHA-256 checksum of the file, hashing it if it wasn't hashed while it was downloaded.
+func fileDigest(filename string) (string, error) {
+	if sum := getDigest(filename); sum != "" {
+		return sum, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	setDigest(filename, sum)
+
+	return sum, nil
+}
+
+// hashFile feeds the first n bytes of the file into h.
+func hashFile(h io.Writer, file *os.File, n int64) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(h, file, n); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checksumError is returned when a file doesn't match its checksum, which means that the file itself is bad.
+type checksumError struct {
+	name     string
+	expected string
+	got      string
+}
+
+func (e checksumError) Error() string {
+	return fmt.Sprintf("%v checksum mismatch: expected %v, got %v", e.name, e.expected, e.got)
+}
+
+// verifyChecksums makes sure that the file matches every one of the checksums, and says which algorithm disagreed if
+// it doesn't. Nothing is checked with --skip-verify.
+func verifyChecksums(ctx context.Context, filename string, sums []string) error {
+	if *skipVerifyFlag {
+		return nil
+	}
+
+	for _, sum := range sums {
+		if err := verifyChecksum(ctx, filename, sum); err != nil {
+			return err
+		}
+		fmt.Println(sumOK(sum))
+	}
+
+	return nil
+}
+
+// verifyChecksum makes sure that the file's checksum matches the expected one. The hash is picked by the length of the
+// checksum: Arch publishes SHA-256 and BLAKE2b checksums, and Arch Linux ARM publishes MD5 checksums. If the file's
+// checksum was already computed during the download, it isn't read again. If the file was decompressed while it was
+// downloaded, the compressed image is what's checked.
+func verifyChecksum(ctx context.Context, filename, expected string) error {
+	expected = strings.ToLower(expected)
+	mismatch := func(sum string) error {
+		return checksumError{name: checksumName(expected), expected: expected, got: sum}
+	}
+
+	digestsMu.Lock()
+	served, ok := servedSums[filename]
+	digestsMu.Unlock()
+	if ok {
+		for _, sum := range served {
+			if len(sum) == len(expected) {
+				if sum != expected {
+					return mismatch(sum)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("no %v checksum of the compressed image", checksumName(expected))
+	}
+
+	var h hash.Hash
+	switch len(expected) {
+	case md5.Size * 2:
+		h = md5.New()
+	case sha256.Size * 2:
+		if sum := getDigest(filename); sum != "" {
+			if sum != expected {
+				return mismatch(sum)
+			}
+			return nil
+		}
+		h = sha256.New()
+	case b2Size * 2:
+		sum, err := fileB2Digest(ctx, filename)
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			return mismatch(sum)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown checksum: %v", expected)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+		return mismatch(sum)
+	}
+
+	return nil
+}
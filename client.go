@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// This is the transport that every request goes through. Our timeouts and proxy are applied to it when we start.
+var transport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	TLSClientConfig:       &tls.Config{},
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// client sends every request. Its redirects are checked by checkRedirect.
+var client = &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+
+// setupClient applies the flags that change how we connect to the client. It has to be called after the flags are
+// parsed and before anything is requested.
+func setupClient() error {
+	if err := checkFamily(); err != nil {
+		return err
+	}
+	setTimeouts()
+	if err := setCA(); err != nil {
+		return err
+	}
+	if err := setProxy(); err != nil {
+		return err
+	}
+	client.Transport = userAgentTransport{client.Transport}
+	if *offlineFlag {
+		client.Transport = offlineTransport{}
+	}
+	if *insecureFlag {
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		client.Transport = &insecureTransport{RoundTripper: client.Transport}
+	}
+
+	return nil
+}
+
+// setCA makes the client trust the certificates in the file given with --ca-cert, on top of the system's. This is what
+// TLS-intercepting proxies need.
+func setCA() error {
+	if *caCertFlag == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(*caCertFlag)
+	if err != nil {
+		return fmt.Errorf("error reading --ca-cert: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	// Every certificate in the file has to be good, so that a broken one doesn't go unnoticed until a mirror fails.
+	count := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("error parsing certificate %v in %v: %v", count+1, *caCertFlag, err)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if count == 0 {
+		return fmt.Errorf("no PEM certificates found in %v", *caCertFlag)
+	}
+
+	transport.TLSClientConfig.RootCAs = pool
+
+	return nil
+}
+
+// insecureTransport warns loudly about every host whose certificate isn't checked because of --insecure.
+type insecureTransport struct {
+	http.RoundTripper
+	warned sync.Map
+}
+
+// RoundTrip sends the request through the underlying transport.
+func (t *insecureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		if _, warned := t.warned.LoadOrStore(req.URL.Host, true); !warned {
+			fmt.Println()
+			fmt.Println("!!! WARNING: NOT CHECKING THE TLS CERTIFICATE OF", req.URL.Hostname(), "(--insecure) !!!")
+			fmt.Println("Anyone between you and", req.URL.Hostname(), "can see and change what's downloaded from it.")
+			fmt.Println("Only the checksum and signature stand between you and a tampered ISO.")
+		}
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// timeoutClient returns a client that shares everything with ours but gives up on each request after the timeout,
+// including reading the body.
+func timeoutClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: client.Transport, CheckRedirect: client.CheckRedirect, Timeout: timeout}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ventoyLabel is the label of the data partition that Ventoy puts its ISOs on.
+const ventoyLabel = "Ventoy"
+
+// byLabel is where udev links each partition by its label.
+var byLabel = "/dev/disk/by-label"
+
+// accessWrite is access(2)'s W_OK, which asks whether we can write to a file.
+const accessWrite = 2
+
+// copyDir is where --copy-to or --ventoy will copy the ISO, or "" if we're flashing a drive like usual.
+var copyDir string
+
+// checkCopyTo makes sure that --copy-to is a directory that we can write to, or finds where the Ventoy partition is
+// mounted for --ventoy. Copying the ISO onto a drive doesn't touch the drive itself, so none of the options about
+// flashing one make sense with it.
+func checkCopyTo() error {
+	if *copyToFlag == "" && !*ventoyFlag {
+		if *removeOldFlag {
+			return fmt.Errorf("--remove-old only works with --copy-to or --ventoy")
+		}
+		return nil
+	}
+	switch {
+	case *copyToFlag != "" && *ventoyFlag:
+		return fmt.Errorf("--copy-to and --ventoy can't be used together")
+	case *streamFlag || *downloadOnlyFlag || *backendFlag != "" || *ejectFlag || *persistenceFlag != "":
+		return fmt.Errorf("--copy-to and --ventoy do not work with " +
+			"--stream, --download-only, --backend, --eject, or --persistence")
+	case isARM():
+		return fmt.Errorf("--copy-to and --ventoy do not work with Arch Linux ARM")
+	case flag.NArg() > 0:
+		return fmt.Errorf("--copy-to and --ventoy don't flash a USB drive, so don't give one")
+	}
+
+	dir := *copyToFlag
+	if *ventoyFlag {
+		var err error
+		if dir, err = findVentoy(); err != nil {
+			return err
+		}
+		fmt.Println("Found the Ventoy partition mounted on", dir)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("invalid --copy-to: %v", err)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("invalid --copy-to: %v", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("invalid --copy-to: %v is not a directory", dir)
+	}
+	if err := syscall.Access(dir, accessWrite); err != nil {
+		return fmt.Errorf("invalid --copy-to: can't write to %v: %v", dir, err)
+	}
+	copyDir = dir
+
+	return nil
+}
+
+// findVentoy returns where the partition labelled Ventoy is mounted.
+func findVentoy() (string, error) {
+	dev, err := filepath.EvalSymlinks(filepath.Join(byLabel, ventoyLabel))
+	if err != nil {
+		return "", fmt.Errorf("no partition is labelled %v (is the Ventoy drive plugged in?)", ventoyLabel)
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		return "", fmt.Errorf("error checking where %v is mounted: %v", dev, err)
+	}
+	for _, m := range mounts {
+		if m.device == "/dev/"+filepath.Base(dev) {
+			return m.target, nil
+		}
+	}
+
+	return "", fmt.Errorf("the Ventoy partition %v is not mounted "+
+		"(mount it, or pass --copy-to with where it's mounted)", dev)
+}
+
+// copyISO copies the ISO into copyDir, for --copy-to and --ventoy, with the same checks that flashing a drive gets:
+// what was copied is hashed on its way there and compared with the ISO, and the copy is read back unless
+// --no-verify-flash says not to. The ISO is copied under a temporary name and only renamed into place once it's all
+// on the drive, so that a copy that was cut short never looks like an ISO. Any copy of it that's already there is
+// replaced, and so are the older Arch ISOs with --remove-old. Those are removed after the copy, unless they have to go
+// first to make room for it.
+func copyISO(isoFile string) error {
+	src, err := os.Open(isoFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	dest := filepath.Join(copyDir, filepath.Base(isoFile))
+	var replaced []string
+	var freed int64
+	if destInfo, err := os.Stat(dest); err == nil {
+		if os.SameFile(info, destInfo) {
+			return fmt.Errorf("%v is already in %v", filepath.Base(isoFile), copyDir)
+		}
+		replaced = append(replaced, dest)
+		freed += destInfo.Size()
+	}
+	old := oldISOs(dest)
+	if *removeOldFlag {
+		for _, name := range old {
+			if info, err := os.Stat(name); err == nil {
+				replaced = append(replaced, name)
+				freed += info.Size()
+			}
+		}
+	}
+
+	// There has to be room for the ISO before we start, either as things are or once what it replaces is gone.
+	avail, _, err := freeSpace(copyDir)
+	if err != nil {
+		return fmt.Errorf("error checking the free space in %v: %v", copyDir, err)
+	}
+	if avail < size {
+		if avail+freed < size {
+			msg := fmt.Sprintf("not enough space in %v: need %v, have %v", copyDir, reduce(int(size)),
+				reduce(int(avail)))
+			if !*removeOldFlag && len(old) > 0 {
+				msg += " (pass --remove-old to remove the older Arch ISOs there)"
+			}
+			return fmt.Errorf("%v", msg)
+		}
+		if err := removeISOs(replaced); err != nil {
+			return err
+		}
+		replaced = nil
+	}
+
+	fmt.Println("Copying ISO to", dest)
+	part := filepath.Join(copyDir, "."+filepath.Base(isoFile)+".part")
+	file, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	started := time.Now()
+	if err := copyFile(file, src, size, h); err != nil {
+		file.Close()
+		os.Remove(part)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if err := os.Rename(part, dest); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if dir, err := os.Open(copyDir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	recordPhase("copy", started)
+
+	written, err := checkWritten(isoFile, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	fmt.Println(written)
+	if !*noVerifyFlashFlag {
+		started := time.Now()
+		if err := verifyFlash(isoFile, dest, terminal); err != nil {
+			return err
+		}
+		recordPhase("verify-copy", started)
+	}
+
+	var left []string
+	for _, name := range replaced {
+		if name != dest {
+			left = append(left, name)
+		}
+	}
+
+	return removeISOs(left)
+}
+
+// copyFile copies size bytes from src to file with a progress bar, and makes sure that they're all on the drive before
+// returning. Everything that's copied is also written to h.
+func copyFile(file *os.File, src io.Reader, size int64, h io.Writer) error {
+	p := progress{label: "Copied", total: int(size)}
+	n, err := io.CopyBuffer(io.MultiWriter(file, h, &p), src, make([]byte, flashBlockSize))
+	p.print()
+	terminal.flush() // Flush last progress line.
+	if err != nil {
+		return fmt.Errorf("error copying the ISO at byte %v: %v", n, err)
+	}
+	if n != size {
+		return fmt.Errorf("copied %v bytes, but the ISO is %v bytes", n, size)
+	}
+
+	return syncDevice(file, file.Name(), terminal)
+}
+
+// oldISOs returns the other Arch ISOs next to dest, which --remove-old removes.
+func oldISOs(dest string) []string {
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dest), "archlinux-*-x86_64.iso"))
+	var old []string
+	for _, name := range matches {
+		if name != dest {
+			old = append(old, name)
+		}
+	}
+
+	return old
+}
+
+// removeISOs removes the ISOs that the new one replaces.
+func removeISOs(names []string) error {
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return fmt.Errorf("error removing %v: %v", name, err)
+		}
+		fmt.Println("Removed", name)
+	}
+
+	return nil
+}
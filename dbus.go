@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// This is just enough of D-Bus to ask UDisks2 for a drive: a connection to the system bus, method calls whose arguments
+// are strings and empty dictionaries, and replies that carry file descriptors. Messages are always little-endian,
+// which is what every machine that we run on sends.
+
+// These are the D-Bus message types.
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+)
+
+// These are the fields of a D-Bus message header that we send or read.
+const (
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+	dbusFieldUnixFDs     = 9
+)
+
+// dbusInteractive is the message flag that lets the service ask polkit to prompt the user for permission.
+const dbusInteractive = 0x4
+
+// systemBus is where the system bus listens, unless $DBUS_SYSTEM_BUS_ADDRESS says otherwise.
+var systemBus = "/var/run/dbus/system_bus_socket"
+
+// dbusTimeout bounds each call, including however long the user takes to answer polkit's prompt.
+var dbusTimeout = 2 * time.Minute
+
+// dbusConn is a connection to the system bus.
+type dbusConn struct {
+	conn   *net.UnixConn
+	serial uint32
+	buf    []byte // what we've received that hasn't been parsed yet
+	fds    []int  // the file descriptors that came with it
+}
+
+// dbusReply is the reply to a method call: its body, the body's signature, and the file descriptors that came with it.
+type dbusReply struct {
+	body      []byte
+	signature string
+	fds       []int
+}
+
+// dbusErr is an error that a service replied with, like org.freedesktop.DBus.Error.UnknownMethod.
+type dbusErr struct {
+	name    string
+	message string
+}
+
+func (e dbusErr) Error() string {
+	if e.message == "" {
+		return e.name
+	}
+	return e.message
+}
+
+// dialSystemBus connects to the system bus, authenticates as our user, and makes sure that file descriptors can be
+// passed over the connection.
+func dialSystemBus() (*dbusConn, error) {
+	path := systemBus
+	if addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); strings.HasPrefix(addr, "unix:path=") {
+		path = strings.SplitN(strings.TrimPrefix(addr, "unix:path="), ",", 2)[0]
+	}
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	c := &dbusConn{conn: conn}
+	if err := c.auth(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, err = c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", 0, "", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// close closes the connection, along with any file descriptors that nobody claimed.
+func (c *dbusConn) close() {
+	closeFDs(c.fds)
+	c.conn.Close()
+}
+
+// auth authenticates with the bus as the user that we're running as, which the bus checks against our socket's
+// credentials.
+func (c *dbusConn) auth() error {
+	c.conn.SetDeadline(time.Now().Add(dbusTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if line, err := c.authLine("\x00AUTH EXTERNAL " + uid); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("the system bus rejected us: %v", line)
+	}
+	if line, err := c.authLine("NEGOTIATE_UNIX_FD"); err != nil {
+		return err
+	} else if line != "AGREE_UNIX_FD" {
+		return fmt.Errorf("the system bus can't pass file descriptors: %v", line)
+	}
+	_, err := c.conn.Write([]byte("BEGIN\r\n"))
+
+	return err
+}
+
+// authLine sends a line of the authentication conversation and returns the bus's answer. The answer is read a byte at
+// a time, so that nothing after it is read by mistake.
+func (c *dbusConn) authLine(line string) (string, error) {
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		return "", err
+	}
+	var answer []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(answer), "\r\n") {
+		if _, err := c.conn.Read(b); err != nil {
+			return "", err
+		}
+		answer = append(answer, b[0])
+	}
+
+	return strings.TrimSuffix(string(answer), "\r\n"), nil
+}
+
+// call calls the method and waits for its reply. body is the arguments, marshaled to match signature.
+func (c *dbusConn) call(dest, path, iface, member string, flags byte, signature string,
+	body []byte) (*dbusReply, error) {
+	c.conn.SetDeadline(time.Now().Add(dbusTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	c.serial++
+	var m dbusWriter
+	m.buf = []byte{'l', dbusMethodCall, flags, 1}
+	m.uint32(uint32(len(body)))
+	m.uint32(c.serial)
+	fields := len(m.buf)
+	m.uint32(0)
+	m.align(8)
+	start := len(m.buf)
+	field := func(code byte, typ, value string) {
+		m.align(8)
+		m.buf = append(m.buf, code)
+		m.signature(typ)
+		if typ == "g" {
+			m.signature(value)
+		} else {
+			m.string(value)
+		}
+	}
+	field(dbusFieldPath, "o", path)
+	field(dbusFieldDestination, "s", dest)
+	field(dbusFieldInterface, "s", iface)
+	field(dbusFieldMember, "s", member)
+	if signature != "" {
+		field(dbusFieldSignature, "g", signature)
+	}
+	binary.LittleEndian.PutUint32(m.buf[fields:], uint32(len(m.buf)-start))
+	m.align(8)
+	m.buf = append(m.buf, body...)
+	if _, err := c.conn.Write(m.buf); err != nil {
+		return nil, err
+	}
+
+	return c.reply(c.serial)
+}
+
+// reply reads messages until the reply to the call with the given serial number comes. Anything else, like the signals
+// that the bus sends us, is dropped.
+func (c *dbusConn) reply(serial uint32) (*dbusReply, error) {
+	for {
+		msg, ok, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if err := c.receive(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if msg.replySerial != serial || (msg.typ != dbusMethodReturn && msg.typ != dbusError) {
+			closeFDs(msg.fds)
+			continue
+		}
+		if msg.typ == dbusError {
+			closeFDs(msg.fds)
+			e := dbusErr{name: msg.errorName}
+			if strings.HasPrefix(msg.signature, "s") {
+				e.message, _ = dbusString(msg.body, 0)
+			}
+			return nil, e
+		}
+		return &dbusReply{msg.body, msg.signature, msg.fds}, nil
+	}
+}
+
+// dbusMessage is a message that we've received.
+type dbusMessage struct {
+	typ         byte
+	replySerial uint32
+	errorName   string
+	signature   string
+	body        []byte
+	fds         []int
+}
+
+// receive reads what the bus has sent us so far, along with any file descriptors that came with it.
+func (c *dbusConn) receive() error {
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(16*4))
+	n, oobn, _, _, err := c.conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("the system bus closed the connection")
+	}
+	c.buf = append(c.buf, buf[:n]...)
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return err
+		}
+		for i := range msgs {
+			fds, err := syscall.ParseUnixRights(&msgs[i])
+			if err == nil {
+				c.fds = append(c.fds, fds...)
+			}
+		}
+	}
+
+	return nil
+}
+
+// next takes the next whole message from what we've received, if there is one.
+func (c *dbusConn) next() (dbusMessage, bool, error) {
+	var msg dbusMessage
+	if len(c.buf) < 16 {
+		return msg, false, nil
+	}
+	if c.buf[0] != 'l' {
+		return msg, false, fmt.Errorf("the system bus sent a big-endian message, which we can't read")
+	}
+	bodyLen := int(binary.LittleEndian.Uint32(c.buf[4:]))
+	fieldsLen := int(binary.LittleEndian.Uint32(c.buf[12:]))
+	headerLen := (16 + fieldsLen + 7) &^ 7
+	if len(c.buf) < headerLen+bodyLen {
+		return msg, false, nil
+	}
+	msg.typ = c.buf[1]
+
+	// Each field is a code and a variant, which is the signature of its value followed by the value.
+	var unixFDs int
+	for pos := 16; pos < 16+fieldsLen; {
+		pos = (pos + 7) &^ 7
+		if pos+2 > 16+fieldsLen {
+			break
+		}
+		code := c.buf[pos]
+		sigLen := int(c.buf[pos+1])
+		if pos+3+sigLen > 16+fieldsLen {
+			return msg, false, fmt.Errorf("the system bus sent a malformed message")
+		}
+		typ := string(c.buf[pos+2 : pos+2+sigLen])
+		pos += 3 + sigLen
+		switch typ {
+		case "u":
+			pos = (pos + 3) &^ 3
+			if pos+4 > 16+fieldsLen {
+				return msg, false, fmt.Errorf("the system bus sent a malformed message")
+			}
+			value := binary.LittleEndian.Uint32(c.buf[pos:])
+			pos += 4
+			switch code {
+			case dbusFieldReplySerial:
+				msg.replySerial = value
+			case dbusFieldUnixFDs:
+				unixFDs = int(value)
+			}
+		case "s", "o":
+			pos = (pos + 3) &^ 3
+			value, err := dbusString(c.buf[:16+fieldsLen], pos)
+			if err != nil {
+				return msg, false, err
+			}
+			pos += 4 + len(value) + 1
+			if code == dbusFieldErrorName {
+				msg.errorName = value
+			}
+		case "g":
+			if pos >= 16+fieldsLen {
+				return msg, false, fmt.Errorf("the system bus sent a malformed message")
+			}
+			n := int(c.buf[pos])
+			if pos+1+n > 16+fieldsLen {
+				return msg, false, fmt.Errorf("the system bus sent a malformed message")
+			}
+			if code == dbusFieldSignature {
+				msg.signature = string(c.buf[pos+1 : pos+1+n])
+			}
+			pos += 1 + n + 1
+		default:
+			return msg, false, fmt.Errorf("the system bus sent a header field of type %q, which we can't read", typ)
+		}
+	}
+
+	msg.body = append([]byte(nil), c.buf[headerLen:headerLen+bodyLen]...)
+	c.buf = c.buf[headerLen+bodyLen:]
+	if unixFDs > len(c.fds) {
+		unixFDs = len(c.fds)
+	}
+	msg.fds = c.fds[:unixFDs:unixFDs]
+	c.fds = c.fds[unixFDs:]
+
+	return msg, true, nil
+}
+
+// dbusString reads the string at pos in buf: its length, its bytes, and a terminating null.
+func dbusString(buf []byte, pos int) (string, error) {
+	if pos+4 > len(buf) {
+		return "", fmt.Errorf("the system bus sent a malformed message")
+	}
+	n := int(binary.LittleEndian.Uint32(buf[pos:]))
+	if n < 0 || pos+4+n+1 > len(buf) {
+		return "", fmt.Errorf("the system bus sent a malformed message")
+	}
+
+	return string(buf[pos+4 : pos+4+n]), nil
+}
+
+// dbusWriter marshals a message, or a message's body, which starts on an 8-byte boundary of the message.
+type dbusWriter struct {
+	buf []byte
+}
+
+// align pads the message to a multiple of n bytes.
+func (w *dbusWriter) align(n int) {
+	for len(w.buf)%n != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *dbusWriter) uint32(v uint32) {
+	w.align(4)
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(w.buf[len(w.buf)-4:], v)
+}
+
+func (w *dbusWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, 0)
+}
+
+func (w *dbusWriter) signature(s string) {
+	w.buf = append(w.buf, byte(len(s)))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, 0)
+}
+
+// emptyDict writes an empty a{sv}, which is how options are passed when there aren't any. An array's elements start
+// on their own boundary even when there aren't any, and dictionary entries start on an 8-byte one.
+func (w *dbusWriter) emptyDict() {
+	w.uint32(0)
+	w.align(8)
+}
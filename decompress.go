@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// These are the programs that decompress images, keyed by the extension of their format. Each one writes the
+// decompressed image to stdout.
+var decompressors = map[string][]string{
+	".xz":  {"xz", "--decompress", "--stdout"},
+	".zst": {"zstd", "--decompress", "--stdout"},
+}
+
+// These hold what the signature check had to say about the compressed images that were verified while they were
+// downloaded, keyed by the file they were decompressed to.
+var (
+	streamVerified   = make(map[string][]byte)
+	streamVerifiedMu sync.Mutex
+)
+
+// checkSigCovers makes sure that --sig-covers is something we know.
+func checkSigCovers() error {
+	switch *sigCoversFlag {
+	case "compressed", "raw":
+		return nil
+	}
+
+	return fmt.Errorf("invalid --sig-covers: %v (must be compressed or raw)", *sigCoversFlag)
+}
+
+// compression returns the extension of the format that the image is compressed with, or "" if it isn't compressed.
+// Tarballs are left alone, because they're extracted instead of flashed.
+func compression(filename string) string {
+	ext := path.Ext(filename)
+	if _, ok := decompressors[ext]; !ok || strings.HasSuffix(strings.TrimSuffix(filename, ext), ".tar") {
+		return ""
+	}
+
+	return ext
+}
+
+// rawName returns the name of the image once it's decompressed.
+func rawName(filename string) string {
+	return strings.TrimSuffix(filename, compression(filename))
+}
+
+// checkDecompressor makes sure that the program that decompresses the format is installed.
+func checkDecompressor(ext string) error {
+	program := decompressors[ext][0]
+	if _, err := exec.LookPath(program); err != nil {
+		return fmt.Errorf("%v is required to decompress %v images but is not installed", program, ext)
+	}
+
+	return nil
+}
+
+// commandWriter feeds whatever is written to it to a command's stdin.
+type commandWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+// startCommand starts the command with a commandWriter for its stdin. Its stdout goes to w.
+func startCommand(ctx context.Context, w io.Writer, name string, args ...string) (*commandWriter, error) {
+	c := &commandWriter{cmd: exec.CommandContext(ctx, name, args...)}
+	c.cmd.Stdout = w
+	c.cmd.Stderr = &c.stderr
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.WriteCloser = stdin
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes the command's stdin and waits for it to finish. If it fails, the error includes what it had to say.
+func (c *commandWriter) Close() error {
+	c.WriteCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %v", err, msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// startDecompressor starts decompressing the format into w. The compressed image has to be written to the returned
+// writer, which must be closed once it's all there.
+func startDecompressor(ctx context.Context, ext string, w io.Writer) (*commandWriter, error) {
+	args := decompressors[ext]
+	return startCommand(ctx, w, args[0], args[1:]...)
+}
+
+// downloadCompressed downloads the compressed image at the url and decompresses it into filename on the fly. If sigFile
+// isn't empty, the compressed image is checked against it on the way, because it won't be around to check afterwards.
+// Compressed downloads can't be resumed, so a failed attempt starts over from the beginning.
+func downloadCompressed(ctx context.Context, url, filename, sigFile string) error {
+	return retry(ctx, "downloading "+path.Base(url), func() error {
+		return decompressDownload(ctx, url, filename, sigFile)
+	})
+}
+
+// decompressDownload makes one attempt at downloadCompressed.
+func decompressDownload(ctx context.Context, url, filename, sigFile string) (err error) {
+	trackDownload(filename)
+	setDigest(filename, "")
+	setB2Digest(filename, "")
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+
+	// Give up on mirrors that are too slow.
+	stall := newStallWatcher(ctx)
+	ctx = stall.ctx
+	defer func() {
+		if serr := stall.stop(); serr != nil {
+			err = serr
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return responseError(resp)
+	}
+
+	// The compressed image is hashed, counted, and maybe checked against the signature on its way to the
+	// decompressor, because that's what the published checksums and signatures are for.
+	dec, err := startDecompressor(ctx, compression(url), file)
+	if err != nil {
+		return err
+	}
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	p := progress{}
+	if resp.ContentLength > 0 {
+		p.total = int(resp.ContentLength)
+	}
+	writers := []io.Writer{dec, &p, md5Hash, sha256Hash, stall}
+	b2, err := startB2Digest(ctx)
+	if err != nil {
+		dec.Close()
+		return err
+	}
+	if b2 != nil {
+		defer b2.Close()
+		writers = append(writers, b2)
+	}
+	var check sigCheck
+	if sigFile != "" {
+		if check, err = startSigCheck(ctx, sigFile); err != nil {
+			dec.Close()
+			return err
+		}
+		writers = append(writers, check)
+	}
+	stall.start()
+
+	n, err := io.Copy(io.MultiWriter(writers...), limitReader(resp.Body))
+	decErr := dec.Close()
+	var sigErr error
+	if check != nil {
+		sigErr = check.Close()
+	}
+	switch {
+	case err != nil:
+		return err
+	case resp.ContentLength > 0 && n < resp.ContentLength:
+		return truncatedError{n, resp.ContentLength, false}
+	case n == 0:
+		return fmt.Errorf("mirror sent an empty file")
+	case decErr != nil:
+		return fmt.Errorf("error decompressing image: %v", decErr)
+	case sigErr != nil:
+		return fmt.Errorf("error verifying image: %w", sigErr)
+	}
+
+	sums := []string{hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(sha256Hash.Sum(nil))}
+	if b2 != nil {
+		b2Sum, err := b2.sum()
+		if err != nil {
+			return err
+		}
+		sums = append(sums, b2Sum)
+	}
+	setServedSums(filename, sums...)
+	if check != nil {
+		streamVerifiedMu.Lock()
+		streamVerified[filename] = []byte(check.report())
+		streamVerifiedMu.Unlock()
+	}
+
+	return nil
+}
+
+// getStreamVerified returns what the signature check had to say about the file if its compressed image was verified
+// while it was downloaded.
+func getStreamVerified(filename string) ([]byte, bool) {
+	streamVerifiedMu.Lock()
+	defer streamVerifiedMu.Unlock()
+
+	output, ok := streamVerified[filename]
+	return output, ok
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// These DHT nodes are run to help clients find their way into the DHT, and every lookup starts from them. The DHT
+// finds peers of torrents that don't have a tracker.
+var dhtBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// These bound a lookup: how long a node has to answer, how many nodes we ask at once, and how many times we ask nodes
+// closer to the torrent than the last ones.
+const (
+	dhtTimeout = 5 * time.Second
+	dhtAlpha   = 8
+	dhtRounds  = 8
+)
+
+// These are how long we wait between lookups, depending on whether or not the last one found any peers.
+const (
+	dhtInterval      = 15 * time.Minute
+	dhtRetryInterval = time.Minute
+)
+
+// compactNodeLen is the length of a node's ID, IPv4 address, and port packed together.
+const compactNodeLen = sha1.Size + net.IPv4len + 2
+
+// dhtNode is a node in the DHT that we've heard about.
+type dhtNode struct {
+	id    string
+	addr  *net.UDPAddr
+	token string // what the node wants to see when we tell it that we have the torrent
+}
+
+// dht finds peers through the BitTorrent DHT (BEP 5). It's a read-only node (BEP 43), so it never has to answer
+// queries from other nodes, and they don't add it to their routing tables.
+type dht struct {
+	conn *net.UDPConn
+	id   string
+
+	mu      sync.Mutex
+	pending map[string]chan map[string]interface{} // the queries that haven't been answered, by transaction ID
+	next    uint16
+}
+
+// startDHT starts a DHT node on the same port as we accept peers on, if we do, or else on any port.
+func startDHT(port int) (*dht, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil && port != 0 {
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, sha1.Size)
+	if _, err := rand.Read(id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d := &dht{conn: conn, id: string(id), pending: make(map[string]chan map[string]interface{})}
+	go d.read()
+
+	return d, nil
+}
+
+// close stops the node.
+func (d *dht) close() error {
+	return d.conn.Close()
+}
+
+// read hands every answer that the node gets to the query that's waiting for it.
+func (d *dht) read() {
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		v, err := bdecode(buf[:n])
+		if err != nil {
+			continue
+		}
+		msg, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if y := bstring(msg, "y"); y != "r" && y != "e" {
+			continue
+		}
+
+		t := bstring(msg, "t")
+		d.mu.Lock()
+		ch := d.pending[t]
+		delete(d.pending, t)
+		d.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+// query sends the query to the node and waits for its answer.
+func (d *dht) query(ctx context.Context, addr *net.UDPAddr, method string,
+	args map[string]interface{}) (map[string]interface{}, error) {
+	d.mu.Lock()
+	d.next++
+	t := string([]byte{byte(d.next >> 8), byte(d.next)})
+	ch := make(chan map[string]interface{}, 1)
+	d.pending[t] = ch
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, t)
+		d.mu.Unlock()
+	}()
+
+	args["id"] = d.id
+	msg := bencode(map[string]interface{}{"t": t, "y": "q", "q": method, "a": args, "ro": 1})
+	if _, err := d.conn.WriteToUDP(msg, addr); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		if bstring(reply, "y") == "e" {
+			return nil, fmt.Errorf("DHT node %v refused %v", addr, method)
+		}
+		r, ok := reply["r"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid answer from DHT node %v", addr)
+		}
+		return r, nil
+	case <-time.After(dhtTimeout):
+		return nil, fmt.Errorf("DHT node %v did not answer", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// getPeers looks up the peers of the torrent. Starting from the bootstrap nodes, it asks the nodes closest to the
+// torrent for peers, and they answer with peers or nodes that are even closer. It returns the peers that it found and
+// the closest nodes that answered, which are the ones to tell that we have the torrent too.
+func (d *dht) getPeers(ctx context.Context, infoHash string) ([]string, []*dhtNode) {
+	var candidates []*dhtNode
+	seen := make(map[string]bool)
+	for _, node := range dhtBootstrap {
+		host, port, err := net.SplitHostPort(node)
+		if err != nil {
+			continue
+		}
+		ips, _ := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		for _, ip := range ips {
+			addr := &net.UDPAddr{IP: ip, Port: atoi(port)}
+			if !seen[addr.String()] {
+				seen[addr.String()] = true
+				candidates = append(candidates, &dhtNode{addr: addr})
+			}
+		}
+	}
+
+	// A node is closer to the torrent the smaller its ID is when XORed with the info hash. Nodes whose IDs we don't
+	// know yet, like the bootstrap nodes, are the farthest away.
+	closer := func(a, b *dhtNode) bool {
+		if len(a.id) != sha1.Size || len(b.id) != sha1.Size {
+			return len(a.id) == sha1.Size
+		}
+		for i := 0; i < sha1.Size; i++ {
+			if x, y := a.id[i]^infoHash[i], b.id[i]^infoHash[i]; x != y {
+				return x < y
+			}
+		}
+		return false
+	}
+
+	var mu sync.Mutex
+	var answered []*dhtNode
+	var peers []string
+	found := make(map[string]bool)
+	for round := 0; round < dhtRounds && len(candidates) > 0 && ctx.Err() == nil; round++ {
+		sort.Slice(candidates, func(i, j int) bool { return closer(candidates[i], candidates[j]) })
+		if len(candidates) > 4*dhtAlpha {
+			candidates = candidates[:4*dhtAlpha]
+		}
+		batch := candidates
+		if len(batch) > dhtAlpha {
+			batch = batch[:dhtAlpha]
+		}
+		candidates = candidates[len(batch):]
+
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			wg.Add(1)
+			go func(node *dhtNode) {
+				defer wg.Done()
+				r, err := d.query(ctx, node.addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				node.id = bstring(r, "id")
+				node.token = bstring(r, "token")
+				answered = append(answered, node)
+				values, _ := r["values"].([]interface{})
+				for _, value := range values {
+					if s, ok := value.(string); ok {
+						for _, peer := range compactPeers(s, net.IPv4len) {
+							if !found[peer] {
+								found[peer] = true
+								peers = append(peers, peer)
+							}
+						}
+					}
+				}
+				nodes := bstring(r, "nodes")
+				for ; len(nodes) >= compactNodeLen; nodes = nodes[compactNodeLen:] {
+					addr := &net.UDPAddr{
+						IP:   net.IP(nodes[sha1.Size : sha1.Size+net.IPv4len]),
+						Port: int(binary.BigEndian.Uint16([]byte(nodes[sha1.Size+net.IPv4len : compactNodeLen]))),
+					}
+					if addr.Port != 0 && !seen[addr.String()] {
+						seen[addr.String()] = true
+						candidates = append(candidates, &dhtNode{id: nodes[:sha1.Size], addr: addr})
+					}
+				}
+			}(node)
+		}
+		wg.Wait()
+	}
+
+	sort.Slice(answered, func(i, j int) bool { return closer(answered[i], answered[j]) })
+	if len(answered) > dhtAlpha {
+		answered = answered[:dhtAlpha]
+	}
+
+	return peers, answered
+}
+
+// announce tells the nodes that we have the torrent and that peers can connect to us on the port.
+func (d *dht) announce(ctx context.Context, infoHash string, port int, nodes []*dhtNode) {
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		if node.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(node *dhtNode) {
+			defer wg.Done()
+			d.query(ctx, node.addr, "announce_peer", map[string]interface{}{
+				"info_hash":    infoHash,
+				"port":         port,
+				"token":        node.token,
+				"implied_port": 0,
+			})
+		}(node)
+	}
+	wg.Wait()
+}
+
+// findDHTPeers looks up the torrent's peers in the DHT every so often and passes them on to connectPeers. If peers can
+// connect to us, the DHT is told about us as well.
+func (s *swarm) findDHTPeers(ctx context.Context, addrs chan<- string) {
+	d, err := startDHT(s.port)
+	if err != nil {
+		fmt.Println("Not looking for peers in the DHT:", err)
+		return
+	}
+	defer d.close()
+
+	infoHash := string(s.info.infoHash[:])
+	for {
+		peers, nodes := d.getPeers(ctx, infoHash)
+		for _, peer := range peers {
+			s.addPeer(addrs, peer)
+		}
+		if s.port != 0 {
+			d.announce(ctx, infoHash, s.port, nodes)
+		}
+
+		wait := dhtInterval
+		if len(peers) == 0 {
+			wait = dhtRetryInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// atoi converts the string to a number, or 0 if it isn't one.
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+
+	return n
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sysBlock is where the kernel lists every block device.
+var sysBlock = "/sys/block"
+
+// These match the names of partitions for when sysfs can't tell us: sdb1 is on sdb, and mmcblk0p1 is on mmcblk0, as
+// nvme0n1p1 is on nvme0n1.
+var (
+	partitionName  = regexp.MustCompile(`^((?:sd|hd|vd|xvd)[a-z]+)[0-9]+$`)
+	partitionPName = regexp.MustCompile(`^((?:mmcblk|nvme[0-9]+n|loop|nbd)[0-9]+)p[0-9]+$`)
+)
+
+// checkPartition makes sure that the USB drive is a whole disk. Passing /dev/sdb1 instead of /dev/sdb writes the ISO
+// inside the partition, and the drive won't boot. If it's a partition, we'll offer to flash its disk instead, which is
+// returned. --force flashes the partition anyway.
+func checkPartition(usb string) (string, error) {
+	parent := partitionDisk(usb)
+	if parent == "" {
+		return usb, nil
+	}
+
+	msg := fmt.Sprintf("%v is a partition of %v, and a drive with the ISO written inside a partition won't boot", usb,
+		parent)
+	if *forceFlag {
+		return usb, enforce("whole disk", checkForceable, errors.New(msg))
+	}
+
+	fmt.Println("WARNING:", msg)
+	ok, err := confirm("Flash the whole disk " + parent + " instead?")
+	switch {
+	case err != nil:
+		return "", fmt.Errorf("%v (pass %v to flash the whole disk, or --force to flash the partition anyway)", err,
+			parent)
+	case !ok:
+		return "", fmt.Errorf("not flashing a partition (pass --force to flash it anyway)")
+	}
+	fmt.Println("Flashing", parent, "instead of", usb)
+
+	return parent, nil
+}
+
+// partitionDisk returns the path of the disk that the device is a partition of, or "" if it isn't a partition. sysfs
+// knows for sure, and the device's name is a good guess when sysfs doesn't know the device.
+func partitionDisk(usb string) string {
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		dev = usb
+	}
+	name := filepath.Base(dev)
+	if _, err := os.Stat(filepath.Join("/sys/class/block", name)); err == nil {
+		if parent := partitionParent(name); parent != "" {
+			return "/dev/" + parent
+		}
+		return ""
+	}
+	if !strings.HasPrefix(dev, "/dev/") {
+		return ""
+	}
+	for _, re := range []*regexp.Regexp{partitionName, partitionPName} {
+		if m := re.FindStringSubmatch(name); m != nil {
+			return "/dev/" + m[1]
+		}
+	}
+
+	return ""
+}
+
+// removableDrives returns the paths of the drives that are removable or attached over USB, which is where an ISO
+// belongs. Empty card readers and the like, which have no size, are left out.
+func removableDrives() []string {
+	entries, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		return nil
+	}
+
+	var drives []string
+	for _, entry := range entries {
+		name := entry.Name()
+		dir := filepath.Join(sysBlock, name)
+		if !isRemovable(dir) {
+			continue
+		}
+		if size, _ := ioutil.ReadFile(filepath.Join(dir, "size")); strings.TrimSpace(string(size)) == "0" {
+			continue
+		}
+		drives = append(drives, "/dev/"+name)
+	}
+	sort.Strings(drives)
+
+	return drives
+}
+
+// isRemovable reports whether or not the drive with the sysfs directory is removable or attached over USB.
+func isRemovable(dir string) bool {
+	removable, _ := ioutil.ReadFile(filepath.Join(dir, "removable"))
+	link, _ := os.Readlink(dir)
+
+	return strings.TrimSpace(string(removable)) == "1" || strings.Contains(link, "/usb")
+}
+
+// describeDrive returns a line about the drive for the user to recognize it by: its size, vendor and model, and its
+// partitions with their labels and file systems.
+func describeDrive(drive string) string {
+	d := deviceInfo(drive)
+	desc := fmt.Sprintf("%-14v %6v  %v", drive, reduce(int(d.Size)), strings.TrimSpace(d.Vendor+" "+d.Model))
+	if parts := describePartitions(drive); len(parts) > 0 {
+		desc += "  (" + strings.Join(parts, ", ") + ")"
+	}
+
+	return desc
+}
+
+// describePartitions returns the names of the drive's partitions, each with its label and file system if udev knows
+// them.
+func describePartitions(drive string) []string {
+	names, numbers := drivePartitions(drive)
+	var parts []string
+	for number, name := range numbers {
+		if name == filepath.Base(drive) || !names[name] {
+			continue
+		}
+		part := name
+		for _, key := range []string{"ID_FS_LABEL", "ID_FS_TYPE"} {
+			if value := udevProperty(number, key); value != "" {
+				part += " " + value
+			}
+		}
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+
+	return parts
+}
+
+// confirmErase shows exactly which drive is about to be erased and asks the user to confirm it, unless --yes is given.
+// Anything that the kernel and udev don't know about the drive is shown as unknown.
+func confirmErase(usb string) error {
+	d := deviceInfo(usb)
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	size := "unknown"
+	if d.Size > 0 {
+		size = fmt.Sprintf("%v (%v bytes)", reduce(int(d.Size)), d.Size)
+	}
+	parts := "none"
+	if list := describePartitions(usb); len(list) > 0 {
+		parts = strings.Join(list, "\n\t            ")
+	}
+
+	fmt.Println("Everything on this drive will be ERASED:")
+	fmt.Println("\tDevice:    ", usb)
+	fmt.Println("\tModel:     ", orUnknown(strings.TrimSpace(d.Vendor+" "+d.Model)))
+	fmt.Println("\tSize:      ", size)
+	fmt.Println("\tSerial:    ", orUnknown(d.Serial))
+	fmt.Println("\tPartitions:", parts)
+	if *yesFlag {
+		return nil
+	}
+
+	question := "Erase " + usb + " and flash Arch Linux to it?"
+	switch {
+	case restoring:
+		question = "Erase " + usb + " and make it a data drive again?"
+	case benchmarking:
+		question = "Erase " + usb + " to benchmark it?"
+	}
+	ok, err := confirm(question)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%v (pass --yes to %v without asking)", err, action())
+	case !ok:
+		return fmt.Errorf("not %v %v", acting(), usb)
+	}
+
+	return nil
+}
+
+// pickDrive lists the removable drives and asks the user which one to flash, so that nobody has to type the path of
+// the drive from memory. It returns "" if there's nothing to pick from or the user didn't pick anything.
+func pickDrive() string {
+	drives := removableDrives()
+	if len(drives) == 0 {
+		fmt.Println("No removable drives found; plug one in or give the path to the USB drive")
+		return ""
+	}
+
+	fmt.Println("Removable drives:")
+	for i, drive := range drives {
+		fmt.Printf("\t%v) %v\n", i+1, describeDrive(drive))
+	}
+	for {
+		question := "Flash to which drive?"
+		switch {
+		case restoring:
+			question = "Restore which drive?"
+		case benchmarking:
+			question = "Benchmark which drive?"
+		}
+		answer, err := ask(fmt.Sprintf("%v [1-%v, or q to quit]", question, len(drives)))
+		if err != nil || answer == "q" {
+			return ""
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(drives) {
+			fmt.Println("Using", drives[n-1])
+			return drives[n-1]
+		}
+		fmt.Println("Invalid choice:", answer)
+	}
+}
+
+// udevProperty returns the property that udev recorded for the block device with the given device number (like
+// "8:16"), or "" if udev didn't record it.
+func udevProperty(number, key string) string {
+	if number == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile("/run/udev/data/b" + number)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "E:"+key+"=") {
+			return strings.TrimPrefix(line, "E:"+key+"=")
+		}
+	}
+
+	return ""
+}
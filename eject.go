@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// checkEject makes sure that there will be a drive to eject with --eject.
+func checkEject() error {
+	if *ejectFlag && *downloadOnlyFlag {
+		return fmt.Errorf("--eject does not work with --download-only")
+	}
+
+	return nil
+}
+
+// ejectDrive powers off the USB drive after flashing, for --eject, so that it's safe to unplug. udisksctl does this the
+// way the desktop's "Eject" does and works for users, and eject (which sends the drive SCSI eject commands) is tried if
+// that doesn't. Everything is already on the drive by now, so failing to eject it is only a warning.
+func ejectDrive(usb string) {
+	if err := checkBlockDevice(usb); err != nil {
+		fmt.Println("WARNING: Not ejecting", usb+", which isn't a block device")
+		return
+	}
+
+	var errs []string
+	if _, err := exec.LookPath("udisksctl"); err == nil {
+		output, err := exec.Command("udisksctl", "power-off", "--no-user-interaction", "-b", usb).CombinedOutput()
+		if err == nil {
+			fmt.Println(usb, "is powered off and safe to remove")
+			return
+		}
+		errs = append(errs, "udisksctl: "+commandError(output, err))
+	}
+	if _, err := exec.LookPath("eject"); err == nil {
+		output, err := exec.Command("eject", usb).CombinedOutput()
+		if err == nil {
+			fmt.Println(usb, "is ejected and safe to remove")
+			return
+		}
+		errs = append(errs, "eject: "+commandError(output, err))
+	}
+	if len(errs) == 0 {
+		errs = append(errs, "neither udisksctl nor eject is installed")
+	}
+
+	fmt.Printf("WARNING: Couldn't eject %v (%v), but everything has been written to it\n", usb,
+		strings.Join(errs, "; "))
+}
+
+// commandError returns what a failed command said about why it failed, or how it exited if it didn't say anything.
+func commandError(output []byte, err error) string {
+	if msg := strings.TrimSpace(string(output)); msg != "" {
+		return strings.Join(strings.Fields(msg), " ")
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// checkFamily makes sure that we weren't asked to use only IPv4 and only IPv6 at the same time.
+func checkFamily() error {
+	if *ipv4Flag && *ipv6Flag {
+		return fmt.Errorf("-4 and -6 cannot be used together")
+	}
+
+	return nil
+}
+
+// dialContext connects to the address like net.Dialer does, but only over IPv4 with -4 or only over IPv6 with -6. If
+// the host doesn't have an address of that kind, it fails right away with an error naming the host.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+
+	var ip, name, flag string
+	switch {
+	case *ipv4Flag:
+		ip, name, flag = "ip4", "IPv4", "-4"
+	case *ipv6Flag:
+		ip, name, flag = "ip6", "IPv6", "-6"
+	default:
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if network == "tcp" {
+		network = "tcp" + ip[2:]
+	}
+
+	// Look up the host ourselves, so that we can say why it didn't work.
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if parsed := net.ParseIP(host); parsed != nil {
+		if (parsed.To4() != nil) != (ip == "ip4") {
+			return nil, fmt.Errorf("%v is not an %v address (%v is set)", host, name, flag)
+		}
+	} else if ips, err := net.DefaultResolver.LookupIP(ctx, ip, host); err != nil || len(ips) == 0 {
+		return nil, fmt.Errorf("%v has no %v address (%v is set)", host, name, flag)
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// familyArgs returns the arguments that make rsync use the same kind of address as we do.
+func familyArgs() []string {
+	switch {
+	case *ipv4Flag:
+		return []string{"--ipv4"}
+	case *ipv6Flag:
+		return []string{"--ipv6"}
+	}
+
+	return nil
+}
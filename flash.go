@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The image is written in blocks of this many bytes. Writes that bypass the page cache have to be aligned to the
+// drive's block size, which this is a multiple of. Without O_DIRECT, the drive is synced every flashSyncSize bytes, so
+// that the progress shows what has really reached the drive rather than what's waiting in the page cache.
+const (
+	flashBlockSize = 4 << 20
+	flashAlign     = 4096
+	flashSyncSize  = 64 << 20
+)
+
+// While waiting for the drive to sync, how much is left to write is shown this often.
+const syncInterval = time.Second / 2
+
+// blkGetSize64 is the ioctl that returns the size of a block device in bytes.
+const blkGetSize64 = 0x80081272
+
+// flashImage writes the image to the USB drive and returns the SHA-256 checksum of what was written, so that it can be
+// compared with the image's. Compressed images are decompressed on the fly. Tarballs can't be written directly,
+// because they have to be extracted onto a partitioned and formatted drive. With --backend dd, dd does the writing like
+// it used to.
+func flashImage(image, usb string, r *reporter) (string, error) {
+	if strings.HasSuffix(image, ".tar.gz") {
+		return "", fmt.Errorf("%v is a tarball that must be extracted onto the drive by hand "+
+			"(see https://archlinuxarm.org/platforms for your board's instructions)", image)
+	}
+	h := sha256.New()
+	if backend == backendDD {
+		err := ddImage(image, usb, h, r)
+		return hex.EncodeToString(h.Sum(nil)), err
+	}
+
+	if strings.HasSuffix(image, ".xz") {
+		xz := exec.Command("xz", "--decompress", "--stdout", image)
+		xz.Stderr = os.Stderr
+		stdout, err := xz.StdoutPipe()
+		if err != nil {
+			return "", err
+		}
+		if err := xz.Start(); err != nil {
+			return "", err
+		}
+		err = writeImage(stdout, -1, usb, h, r)
+		stdout.Close() // In case we stopped early, so that xz doesn't wait for us forever.
+		if xzErr := xz.Wait(); err == nil && xzErr != nil {
+			err = fmt.Errorf("error decompressing image: %v", xzErr)
+		}
+		return hex.EncodeToString(h.Sum(nil)), err
+	}
+
+	file, err := os.Open(image)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	err = writeImage(file, info.Size(), usb, h, r)
+
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// checkWritten makes sure that what we wrote to the drive, as hashed on its way there, is exactly the image, so that
+// nothing in our own pipeline dropped, repeated, or reordered anything. This doesn't say anything about what the drive
+// did with it; that's what the read-back is for. Images that were decompressed on their way to the drive don't have a
+// checksum to compare with, so an empty result means that nothing was compared.
+func checkWritten(image, written string) (string, error) {
+	if compression(image) != "" {
+		return "", nil
+	}
+	want, err := fileDigest(image)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(written, want) {
+		return "", fmt.Errorf("the data written to the drive has SHA-256 %v, but the image's is %v", written, want)
+	}
+
+	return "SHA-256 of the data written matches the image", nil
+}
+
+// writeImage writes everything that src has to offer to the drive, bypassing the page cache if the drive allows it, and
+// makes sure that it's all on the drive before returning. Everything that's written is also written to h. size is how
+// much src will offer, or -1 if that isn't known. A block that the drive fails to take is tried again, and if it still
+// fails, the error says how far into the image that happened and what it probably means.
+func writeImage(src io.Reader, size int64, usb string, h io.Writer, r *reporter) error {
+	device, direct, err := openDirect(usb)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	if !direct {
+		r.println("Can't bypass the page cache for", usb+", writing through the cache and syncing as we go")
+	}
+
+	p := progress{label: "Wrote", r: r}
+	if size > 0 {
+		p.total = int(size)
+	}
+	buf := alignedBuffer(flashBlockSize, flashAlign)
+	start := time.Now()
+	var offset, synced int64
+	for {
+		n, rerr := io.ReadFull(src, buf)
+		if rerr != nil && rerr != io.ErrUnexpectedEOF && rerr != io.EOF {
+			r.flush() // Flush last progress line.
+			return fmt.Errorf("error reading image at byte %v: %v", offset, rerr)
+		}
+		if n == 0 {
+			break
+		}
+
+		// The last block is usually short, which O_DIRECT can't write, so it goes through the page cache instead.
+		if direct && n%flashAlign != 0 {
+			if err := clearDirect(device); err != nil {
+				r.flush() // Flush last progress line.
+				return fmt.Errorf("error writing the end of the image to %v: %v", usb, err)
+			}
+			direct = false
+		}
+		if err := writeBlock(device, usb, buf[:n], offset); err != nil {
+			r.flush() // Flush last progress line.
+			return err
+		}
+		offset += int64(n)
+		h.Write(buf[:n])
+		p.Write(buf[:n])
+
+		if !direct && offset-synced >= flashSyncSize {
+			if err := device.Sync(); err != nil {
+				r.flush() // Flush last progress line.
+				return fmt.Errorf("error syncing %v after byte %v: %v", usb, offset, explainWriteError(err))
+			}
+			synced = offset
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	p.print()
+	r.flush() // Flush last progress line.
+
+	if size >= 0 && offset != size {
+		return fmt.Errorf("wrote %v bytes to %v, but the image is %v bytes", offset, usb, size)
+	}
+	if err := syncDevice(device, usb, r); err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Round(time.Second / 10)
+	r.println(fmt.Sprintf("Wrote %v bytes (%v) to %v in %v", offset, reduce(int(offset)), usb, elapsed))
+
+	return nil
+}
+
+// checkCapacity makes sure that the image fits on the USB drive, so that we don't write until the drive runs out of
+// space and leave it unbootable. Images whose size can't be known up front, like compressed ones that xz can't size,
+// aren't checked.
+func checkCapacity(image, usb string) error {
+	size, err := imageSize(image)
+	if err != nil || size < 0 {
+		return nil
+	}
+
+	return checkFits(size, usb)
+}
+
+// checkFits makes sure that size bytes fit on the USB drive.
+func checkFits(size int64, usb string) error {
+	capacity, err := deviceSize(usb)
+	if err != nil {
+		return fmt.Errorf("error reading the size of %v: %v", usb, err)
+	}
+	if capacity < 0 || size <= capacity {
+		return nil
+	}
+
+	return fmt.Errorf("the image is %v bytes (%v), but %v only holds %v bytes (%v)", size, reduce(int(size)), usb,
+		capacity, reduce(int(capacity)))
+}
+
+// imageSize returns how many bytes the image will take up on the drive, or -1 if that can't be known. For images
+// compressed with xz, xz knows how big they are uncompressed.
+func imageSize(image string) (int64, error) {
+	if !strings.HasSuffix(image, ".xz") {
+		info, err := os.Stat(image)
+		if err != nil {
+			return -1, err
+		}
+		return info.Size(), nil
+	}
+
+	// The totals line looks like "totals\t1\t1\t12345\t67890\t...", where the fifth field is the uncompressed size.
+	output, err := exec.Command("xz", "--robot", "--list", image).Output()
+	if err != nil {
+		return -1, nil
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) > 4 && fields[0] == "totals" {
+			if size, err := strconv.ParseInt(fields[4], 10, 64); err == nil {
+				return size, nil
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+// deviceSize returns how many bytes the USB drive holds. Block devices are asked for their size. A file (like a disk
+// image that's standing in for a drive) holds as much as it's already been sized to, or anything at all if it's empty,
+// since it'll grow to fit. Anything else is -1, for unknown. Users who flash through UDisks2 usually can't open the
+// drive themselves, so its size comes from sysfs for them.
+func deviceSize(usb string) (int64, error) {
+	info, err := os.Stat(usb)
+	if err != nil {
+		return -1, err
+	}
+	switch {
+	case info.Mode().IsRegular() && info.Size() > 0:
+		return info.Size(), nil
+	case info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0:
+		return -1, nil
+	}
+
+	device, err := os.Open(usb)
+	if errors.Is(err, os.ErrPermission) {
+		return sysfsSize(usb)
+	}
+	if err != nil {
+		return -1, err
+	}
+	defer device.Close()
+	var size uint64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int64(size), nil
+}
+
+// sysfsSize returns the size of the block device from sysfs, which counts it in 512-byte sectors whatever the drive's
+// own sector size is.
+func sysfsSize(usb string) (int64, error) {
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return -1, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/block", filepath.Base(dev), "size"))
+	if err != nil {
+		return -1, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return -1, err
+	}
+
+	return sectors * 512, nil
+}
+
+// syncDevice waits until everything written to the drive has reached it, so that nobody pulls it out while the page
+// cache is still writing to it. That can take a while for slow drives, so how much is left is shown while we wait.
+func syncDevice(device *os.File, usb string, r *reporter) error {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- device.Sync()
+	}()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	printed := false
+	for {
+		select {
+		case err := <-done:
+			if printed {
+				r.flush() // Flush last progress line.
+			}
+			if err != nil {
+				return fmt.Errorf("error syncing %v: %v", usb, explainWriteError(err))
+			}
+			if printed {
+				r.println("Synced", usb, "in", time.Since(start).Round(time.Second/10))
+			}
+			return nil
+		case <-ticker.C:
+			if left := unwrittenBytes(); left >= 0 {
+				r.progress(fmt.Sprintf("Syncing %v... %v remaining", usb, reduce(int(left))))
+			} else {
+				r.progress(fmt.Sprintf("Syncing %v...", usb))
+			}
+			printed = true
+		}
+	}
+}
+
+// unwrittenBytes returns how much the kernel has yet to write out of the page cache, across every device, or -1 if it
+// can't be found. This is the Dirty and Writeback lines of /proc/meminfo, which are in kB.
+func unwrittenBytes() int64 {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return -1
+	}
+
+	var total int64 = -1
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || (fields[0] != "Dirty:" && fields[0] != "Writeback:") {
+			continue
+		}
+		if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			if total < 0 {
+				total = 0
+			}
+			total += kb << 10
+		}
+	}
+
+	return total
+}
+
+// openDirect opens the drive for writing around the page cache, so that a write doesn't return until the data is on
+// the drive. If the drive (or the file system it's on) doesn't allow that, it's opened normally instead. It reports
+// whether or not the page cache is bypassed.
+func openDirect(usb string) (*os.File, bool, error) {
+	device, err := openDrive(usb, true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return device, setDirect(device) == nil, nil
+}
+
+// clearDirect stops the file's writes from bypassing the page cache.
+func clearDirect(file *os.File) error {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_SETFL, flags&^syscall.O_DIRECT)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// ddImage writes the image to the USB drive with dd, for --backend dd, and waits for it to reach the drive. The image
+// is fed to dd through h, and compressed images are piped through xz first. dd's progress is shown as it goes, the same
+// way that downloads are.
+func ddImage(image, usb string, h io.Writer, r *reporter) error {
+	// dd reads from a pipe, which can return less than a block at a time, so it has to be told to fill each block.
+	dd := exec.Command("dd", "of="+usb, "bs=1M", "iflag=fullblock", "status=progress")
+	var xz *exec.Cmd
+	if strings.HasSuffix(image, ".xz") {
+		xz = exec.Command("xz", "--decompress", "--stdout", image)
+		xz.Stderr = os.Stderr
+		stdout, err := xz.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		dd.Stdin = io.TeeReader(stdout, h)
+		if err := xz.Start(); err != nil {
+			return err
+		}
+	} else {
+		file, err := os.Open(image)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dd.Stdin = io.TeeReader(file, h)
+	}
+	stderr, err := dd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := dd.Start(); err != nil {
+		if xz != nil {
+			xz.Process.Kill()
+			xz.Wait()
+		}
+		return err
+	}
+
+	size, _ := imageSize(image)
+	written, messages := watchDD(stderr, size, r)
+	err = dd.Wait()
+	if xz != nil {
+		if xzErr := xz.Wait(); err == nil && xzErr != nil {
+			err = fmt.Errorf("error decompressing image: %v", xzErr)
+		}
+	}
+	if err != nil {
+		if messages != "" {
+			err = fmt.Errorf("%v: %v", err, messages)
+		}
+		msg := fmt.Sprintf("dd stopped after writing %v (%v bytes): %v", reduce(int(written)), written, err)
+		if hint := writeHint(ddErrno(messages)); hint != "" {
+			msg += "; " + hint
+		}
+		return errors.New(msg)
+	}
+
+	// dd returns as soon as everything is in the page cache, so we have to wait for it to reach the drive ourselves.
+	device, err := os.OpenFile(usb, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	if err := syncDevice(device, usb, r); err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Round(time.Second / 10)
+	r.println(fmt.Sprintf("Wrote %v bytes (%v) to %v in %v", written, reduce(int(written)), usb, elapsed))
+
+	return nil
+}
+
+// watchDD reads what dd prints to stderr while it runs and shows its progress, size being how much it will write or -1
+// if that isn't known. It returns how many bytes dd said that it wrote, and anything else that dd said other than its
+// record counts, which is usually why it failed.
+func watchDD(stderr io.Reader, size int64, r *reporter) (int64, string) {
+	p := progress{label: "Wrote", r: r}
+	if size > 0 {
+		p.total = int(size)
+	}
+
+	// Each progress update looks like "123456789 bytes (123 MB, 118 MiB) copied, 5 s, 24.7 MB/s", and ends in a
+	// carriage return so that the next one overwrites it. The last one ends in a newline.
+	var written int64
+	var messages []string
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanRecords)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		switch {
+		case line == "":
+		case len(fields) > 1 && fields[1] == "bytes" && strings.Contains(line, "copied"):
+			if n, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+				written = n
+				p.have = int(n)
+				p.print()
+			}
+		case strings.HasSuffix(line, "records in") || strings.HasSuffix(line, "records out"):
+		default:
+			messages = append(messages, line)
+		}
+	}
+	if written > 0 {
+		r.flush() // Flush last progress line.
+	}
+
+	return written, strings.Join(messages, "; ")
+}
+
+// scanRecords is a bufio.SplitFunc that splits at carriage returns as well as newlines, for programs that redraw their
+// progress on one line.
+func scanRecords(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ftpConn is the control connection to an FTP server.
+type ftpConn struct {
+	*textproto.Conn
+	host string
+}
+
+// isFTP reports whether or not the URL points to an FTP mirror.
+func isFTP(url string) bool {
+	return strings.HasPrefix(url, "ftp://")
+}
+
+// dialFTP connects to the FTP server in the URL and logs in. If the URL doesn't have any credentials, we'll log in
+// anonymously.
+func dialFTP(ctx context.Context, u *url.URL) (*ftpConn, error) {
+	conn, err := dialMirror(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{textproto.NewConn(conn), u.Hostname()}
+
+	// Wait for the server to greet us.
+	if _, _, err := c.ReadResponse(220); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	user, pass := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+
+	// The server might not need a password, in which case it will log us in right after the username.
+	code, _, err := c.cmd("USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd("PASS %s", pass)
+	}
+	if err == nil && code != 230 {
+		err = fmt.Errorf("login failed with code %v", code)
+	}
+	if err == nil {
+		// We only want raw bytes.
+		_, _, err = c.expect(200, "TYPE I")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// cmd sends the command to the server and returns its response.
+func (c *ftpConn) cmd(format string, args ...interface{}) (int, string, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+
+	return c.ReadResponse(0)
+}
+
+// expect sends the command to the server and makes sure that the response has the expected code.
+func (c *ftpConn) expect(code int, format string, args ...interface{}) (int, string, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+
+	return c.ReadResponse(code)
+}
+
+// passive opens a data connection in passive mode. Extended passive mode is tried first because it works over IPv6 and
+// through NAT, and regular passive mode is the fallback. The connection is closed if the context is done before the
+// returned function is called.
+func (c *ftpConn) passive(ctx context.Context) (net.Conn, func(), error) {
+	// The response looks like this: "229 Entering Extended Passive Mode (|||6446|)"
+	if _, msg, err := c.expect(229, "EPSV"); err == nil {
+		start := strings.Index(msg, "(")
+		end := strings.LastIndex(msg, ")")
+		if start >= 0 && end > start {
+			fields := strings.Split(msg[start+1:end], "|")
+			if len(fields) == 5 {
+				return dialData(ctx, net.JoinHostPort(c.host, fields[3]))
+			}
+		}
+	}
+
+	// The response looks like this: "227 Entering Passive Mode (192,168,1,2,25,46)"
+	_, msg, err := c.expect(227, "PASV")
+	if err != nil {
+		return nil, nil, err
+	}
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return nil, nil, fmt.Errorf("invalid passive mode response: %v", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("invalid passive mode response: %v", msg)
+	}
+	p1, err1 := strconv.Atoi(fields[4])
+	p2, err2 := strconv.Atoi(fields[5])
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("invalid passive mode response: %v", msg)
+	}
+
+	// Some servers send a private address here, so we'll always connect to the host we already know.
+	return dialData(ctx, net.JoinHostPort(c.host, strconv.Itoa(p1<<8|p2)))
+}
+
+// dialData connects to the data port that the server told us about and closes the connection if the context is done
+// before the returned function is called.
+func dialData(ctx context.Context, address string) (net.Conn, func(), error) {
+	data, err := dialMirror(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, closeOnCancel(ctx, data), nil
+}
+
+// ftpFilename lists the FTP mirror's directory and pulls out the name of the ISO file that we will download.
+func ftpFilename(ctx context.Context, mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := dialFTP(ctx, u)
+	if err != nil {
+		return "", fmt.Errorf("error accessing mirror: %v", err)
+	}
+	defer c.Close()
+	defer closeOnCancel(ctx, c)()
+
+	data, stop, err := c.passive(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error opening data connection: %v", err)
+	}
+	defer data.Close()
+	defer stop()
+
+	if _, _, err := c.expect(1, "NLST %s", u.Path); err != nil {
+		return "", fmt.Errorf("error listing mirror's directory: %v", err)
+	}
+
+	// Some servers list the full paths, so we'll only look at the last element.
+	listing := textproto.NewReader(bufio.NewReader(data))
+	for {
+		line, err := listing.ReadLine()
+		if err != nil {
+			break
+		}
+		if name := path.Base(line); strings.HasSuffix(name, ".iso") {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("mirror does not have the latest ISO")
+}
+
+// ftpDownload retrieves the file at the FTP url and writes it to w. Before any data is written, the size of the file as
+// reported by the server (or -1 if unknown) is passed to the callback, so that progress can be shown.
+func ftpDownload(ctx context.Context, fileURL string, w io.Writer, size func(int64)) error {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return err
+	}
+
+	c, err := dialFTP(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	defer closeOnCancel(ctx, c)()
+
+	// The response looks like this: "213 868366336"
+	length := int64(-1)
+	if _, msg, err := c.expect(213, "SIZE %s", u.Path); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			length = n
+		}
+	}
+	size(length)
+
+	data, stop, err := c.passive(ctx)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	defer stop()
+
+	if _, _, err := c.expect(1, "RETR %s", u.Path); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, limitReader(ctxReader{ctx, data})); err != nil {
+		return err
+	}
+	data.Close()
+
+	// Make sure the server thinks the transfer completed too.
+	_, _, err = c.ReadResponse(2)
+
+	return err
+}
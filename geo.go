@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// This service returns the two-letter country code of the caller's IP address as plain text.
+var geoIPService = "https://ipapi.co/country/"
+
+// This is how long we'll wait for the GeoIP service before falling back to the locale.
+var geoIPTimeout = 3 * time.Second
+
+// Country codes are two capital letters.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// detectCountry figures out which country we're in, first by looking up our IP address and then by checking the
+// system's locale. It returns the country code along with a description of how it was found.
+func detectCountry(ctx context.Context) (string, string, error) {
+	country, err := geoIPCountry(ctx)
+	if err == nil {
+		return country, "GeoIP lookup", nil
+	}
+	fmt.Println("Error looking up country by IP address:", err)
+
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if country := localeCountry(os.Getenv(env)); country != "" {
+			return country, "locale in $" + env, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("could not determine country")
+}
+
+// geoIPCountry asks the GeoIP service which country our IP address is in.
+func geoIPCountry(ctx context.Context) (string, error) {
+	client := timeoutClient(geoIPTimeout)
+	req, err := http.NewRequestWithContext(ctx, "GET", geoIPService, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%v", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+
+	country := strings.TrimSpace(string(body))
+	if !countryPattern.MatchString(country) {
+		return "", fmt.Errorf("invalid response: %q", country)
+	}
+
+	return country, nil
+}
+
+// localeCountry pulls the country out of a locale like "de_DE.UTF-8". Locales without a country (like "C") return "".
+func localeCountry(locale string) string {
+	// Strip the encoding and modifier, e.g. "sr_RS.UTF-8@latin".
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+
+	fields := strings.Split(locale, "_")
+	if len(fields) != 2 || !countryPattern.MatchString(fields[1]) {
+		return ""
+	}
+
+	return fields[1]
+}
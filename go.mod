@@ -2,4 +2,7 @@ module github.com/snhilde/flasharch
 
 go 1.15
 
-require golang.org/x/net v0.0.0-20201224014010-6772e930b67b
+require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	golang.org/x/net v0.17.0
+)
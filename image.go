@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkImage makes sure that --image is only used to flash an ISO. Everything that needs a real drive, like
+// partitioning it, zeroing it, or ejecting it, doesn't work on a file.
+func checkImage() error {
+	switch {
+	case !*imageFlag:
+		return nil
+	case restoring || benchmarking:
+		return fmt.Errorf("--image does not work with restore or bench")
+	case *downloadOnlyFlag || *copyToFlag != "" || *ventoyFlag:
+		return fmt.Errorf("--image does not work with --download-only, --copy-to, or --ventoy")
+	case *persistenceFlag != "" || *wipeFlag || *ejectFlag:
+		return fmt.Errorf("--image does not work with --persistence, --wipe, or --eject, which need a real drive")
+	case *backendFlag == backendUDisks:
+		return fmt.Errorf("--image does not work with --backend udisks, which only opens drives")
+	}
+
+	return nil
+}
+
+// checkImageFile checks the path to a file to flash the ISO into, for --image. It must be a regular file or not exist
+// yet, in a directory that we can create it in.
+func checkImageFile(image string) error {
+	info, err := os.Stat(image)
+	switch {
+	case err == nil && !info.Mode().IsRegular():
+		return fmt.Errorf("%v is not a regular file (leave out --image to flash a drive)", image)
+	case err == nil:
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	dir := filepath.Dir(image)
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	if err := syscall.Access(dir, accessWrite); err != nil {
+		return fmt.Errorf("can't create %v: %v", image, err)
+	}
+
+	return nil
+}
+
+// imageTarget runs the safety checks on a file to flash the ISO into, for --image. None of the checks for drives
+// apply, but a file that already has something in it is only overwritten if the user says so.
+func imageTarget(image string, seen map[string]bool) *target {
+	err := checkDuplicate(image, seen)
+	if err == nil {
+		err = confirmOverwrite(image)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return &target{usb: image, stage: "Not flashed", err: err}
+}
+
+// confirmOverwrite asks the user before replacing the contents of a file that isn't empty with the ISO.
+func confirmOverwrite(image string) error {
+	info, err := os.Stat(image)
+	if err != nil || info.Size() == 0 || *yesFlag {
+		return nil
+	}
+
+	fmt.Printf("%v already holds %v (%v bytes), which will be replaced\n", image, reduce(int(info.Size())), info.Size())
+	ok, err := confirm("Overwrite " + image + " with Arch Linux?")
+	switch {
+	case err != nil:
+		return fmt.Errorf("%v (pass --yes to flash without asking)", err)
+	case !ok:
+		return fmt.Errorf("not flashing %v", image)
+	}
+
+	return nil
+}
+
+// createImage creates the file to flash the ISO into, for --image, or empties it if it's already there, so that the
+// file ends up holding the ISO and nothing else. The ISO is then written into it the same way that it's written to a
+// drive, and the file is synced once it's all there.
+func createImage(image string) error {
+	file, err := os.OpenFile(image, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlashImage(t *testing.T) {
+	*imageFlag = true
+	defer func() { *imageFlag = false }()
+	backend = backendDirect
+
+	// The image isn't a whole number of blocks, like a real ISO.
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "archlinux-x86_64.iso")
+	data := make([]byte, 3<<20+2048)
+	rand.Read(data)
+	if err := ioutil.WriteFile(iso, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// One file doesn't exist yet, and the other is bigger than the image, so that whatever is left past the image
+	// would show.
+	leftover := filepath.Join(dir, "leftover.img")
+	if err := ioutil.WriteFile(leftover, bytes.Repeat([]byte{0xff}, 5<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range []string{filepath.Join(dir, "new.img"), leftover} {
+		if err := checkImageFile(image); err != nil {
+			t.Fatalf("checkImageFile(%v) returned error: %v", image, err)
+		}
+		tg := &target{usb: image}
+		flashTarget(iso, tg, terminal, "")
+		if tg.err != nil {
+			t.Fatalf("flashing %v failed: %v: %v", image, tg.stage, tg.err)
+		}
+		if tg.readBack != "the drive matches the image" {
+			t.Errorf("%v read-back: %v", image, tg.readBack)
+		}
+
+		got, err := ioutil.ReadFile(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%v holds %v bytes that don't match the %v-byte image", image, len(got), len(data))
+		}
+	}
+}
+
+func TestCheckImageFile(t *testing.T) {
+	dir := t.TempDir()
+	bad := []string{dir, filepath.Join(dir, "missing", "test.img"), "/dev/null"}
+	for _, image := range bad {
+		if err := checkImageFile(image); err == nil {
+			t.Errorf("checkImageFile(%v) accepted it", image)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// An Arch ISO has been around 1 GiB for years, so anything far from that isn't one.
+const (
+	minISOSize = 256 << 20
+	maxISOSize = 8 << 30
+)
+
+// The ISO9660 primary volume descriptor starts at sector 16 with its type, followed by "CD001". Arch's ISOs are hybrid
+// images, so they also start with an MBR, whose boot signature is at the end of the first sector, and a GPT header,
+// whose signature is in the second sector.
+const (
+	cd001Offset   = 16*2048 + 1
+	mbrSigOffset  = 510
+	gptSigOffset  = 512
+	isoHeaderSize = cd001Offset + 5
+)
+
+// checkISO makes sure that the image looks like a bootable Arch ISO, in case a mirror served something else (like a
+// truncated file or an error page) and neither a checksum nor a signature was there to catch it. The error names the
+// check that failed.
+func checkISO(image string) error {
+	file, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if size := info.Size(); size < minISOSize || size > maxISOSize {
+		return fmt.Errorf("size check failed: the image is %v, but an Arch ISO is between %v and %v",
+			reduce(int(size)), reduce(minISOSize), reduce(maxISOSize))
+	}
+
+	header := make([]byte, isoHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return fmt.Errorf("error reading image: %v", err)
+	}
+	if !bytes.Equal(header[cd001Offset:], []byte("CD001")) {
+		return fmt.Errorf("ISO9660 check failed: no CD001 descriptor at offset %v", cd001Offset)
+	}
+	mbr := header[mbrSigOffset] == 0x55 && header[mbrSigOffset+1] == 0xaa
+	gpt := bytes.Equal(header[gptSigOffset:gptSigOffset+8], []byte("EFI PART"))
+	if !mbr && !gpt {
+		return fmt.Errorf("boot record check failed: no MBR or GPT signature, so the image can't boot from a USB drive")
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// keptPattern returns the pattern that the name of an ISO kept by an earlier run has to match.
+func keptPattern() *regexp.Regexp {
+	if isARM() {
+		return armPattern()
+	}
+
+	version := `\d{4}\.\d{2}\.\d{2}`
+	if *releaseFlag != "" {
+		version = regexp.QuoteMeta(*releaseFlag)
+	}
+
+	return regexp.MustCompile(`^archlinux-` + version + `-x86_64\.iso$`)
+}
+
+// getKept looks in the download directory for an ISO and signature that an earlier run kept with --keep. If there is
+// one, the user wants to use it, and its signature still verifies, it returns the paths to them. Otherwise, it returns
+// empty paths.
+func getKept(ctx context.Context) (string, string) {
+	if !isTerminal() {
+		return "", ""
+	}
+	entries, err := ioutil.ReadDir(downloadDir)
+	if err != nil {
+		return "", ""
+	}
+
+	// Releases are named after their date, so the newest one sorts last.
+	pattern := keptPattern()
+	var names []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && pattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i := len(names) - 1; i >= 0; i-- {
+		isoFile := filepath.Join(downloadDir, names[i])
+		sigFile := isoFile + ".sig"
+		if _, err := os.Stat(sigFile); err != nil {
+			continue
+		}
+		// A partial download isn't worth offering. It will be resumed instead.
+		if validator, _ := readResume(isoFile); validator != "" {
+			continue
+		}
+
+		if ok, err := confirm("Found " + isoFile + " from an earlier run. Use it?"); err != nil || !ok {
+			return "", ""
+		}
+		if err := verifyISO(ctx, isoFile, sigFile); err != nil {
+			exitIfInterrupted()
+			fmt.Println("Error verifying kept ISO, downloading a new one:", err)
+			return "", ""
+		}
+		return isoFile, sigFile
+	}
+
+	return "", ""
+}
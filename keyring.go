@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checkKeyring makes sure that the --keyring file can be read, so that we don't find out after downloading the ISO.
+// gpgv reads --keyring paths relative to its home directory, so the path is made absolute here.
+func checkKeyring() error {
+	if *keyringFlag == "" {
+		return nil
+	}
+	if *skipVerifyFlag {
+		return fmt.Errorf("--keyring does not work with --skip-verify")
+	}
+
+	path, err := filepath.Abs(*keyringFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --keyring: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("invalid --keyring: %v", err)
+	}
+	if _, err := dearmorKeys(data); err != nil {
+		return fmt.Errorf("invalid --keyring: %v", err)
+	}
+	*keyringFlag = path
+
+	return nil
+}
+
+// dearmorKeys returns the keys in data in binary form, which is the only form gpgv accepts. data can hold any number of
+// armored blocks, like a file that several keys were exported to one by one, or it can already be binary.
+func dearmorKeys(data []byte) ([]byte, error) {
+	marker := []byte("-----BEGIN PGP")
+	if !bytes.Contains(data, marker) {
+		return data, nil
+	}
+
+	var keys []byte
+	for {
+		i := bytes.Index(data, marker)
+		if i < 0 {
+			break
+		}
+		block, err := dearmor(data[i:])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, block...)
+		data = data[i+len(marker):]
+	}
+
+	return keys, nil
+}
+
+// startGPGVCheck starts checking whatever is written to the returned sigCheck against the signature with gpgv and the
+// keyring file, which needs neither a keyserver nor a gpg home directory. An armored keyring is dearmored into a
+// temporary file first. source says where the keyring came from, for the report.
+func startGPGVCheck(ctx context.Context, sigFile, keyring, source string) (sigCheck, error) {
+	data, err := ioutil.ReadFile(keyring)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := dearmorKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", keyring, err)
+	}
+
+	g := &gpgCheck{keyring: keyring, source: source}
+	if !bytes.Equal(keys, data) {
+		tmp, err := ioutil.TempFile("", "flasharch-keyring-*.gpg")
+		if err != nil {
+			return nil, err
+		}
+		g.tmpKeyring = tmp.Name()
+		_, err = tmp.Write(keys)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(g.tmpKeyring)
+			return nil, err
+		}
+		keyring = g.tmpKeyring
+	}
+
+	c, err := startCommand(ctx, &g.status, "gpgv", "--status-fd", "1", "--keyring", keyring, sigFile, "-")
+	if err != nil {
+		if g.tmpKeyring != "" {
+			os.Remove(g.tmpKeyring)
+		}
+		return nil, err
+	}
+	g.commandWriter = c
+
+	return g, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// listCmd prints every release that the first working mirror has, newest first, along with the size and date of each
+// release's ISO.
+func listCmd(ctx context.Context) error {
+	mirrors, err := getMirrors(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, mirror := range mirrors {
+		// Only http mirrors have a directory listing that we can parse.
+		if !isHTTP(mirror) {
+			continue
+		}
+
+		// The mirror points to a release directory. We want the directory that holds all of them.
+		parent, err := joinURL(mirror, "..")
+		if err != nil {
+			continue
+		}
+
+		fmt.Println("Looking for releases in", parent)
+		versions, err := listReleases(ctx, parent)
+		if err != nil {
+			fmt.Println("Error using mirror", mirror+":", err)
+			continue
+		}
+		if len(versions) == 0 {
+			fmt.Println("Mirror does not have any releases")
+			continue
+		}
+
+		printReleases(ctx, parent, versions)
+		return nil
+	}
+
+	return fmt.Errorf("no mirror could list its releases")
+}
+
+// printReleases looks up the size and date of each release's ISO and prints them, newest first.
+func printReleases(ctx context.Context, dir string, versions []string) {
+	type info struct {
+		size string
+		date string
+	}
+
+	// Ask for all of the ISOs at once. We only need the headers.
+	infos := make([]info, len(versions))
+	var wg sync.WaitGroup
+	for i, version := range versions {
+		wg.Add(1)
+		go func(i int, version string) {
+			defer wg.Done()
+			infos[i] = info{"?", "?"}
+
+			url, err := joinURL(dir, version+"/"+release{Version: version}.filename())
+			if err != nil {
+				return
+			}
+			req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return
+			}
+
+			if resp.ContentLength > 0 {
+				infos[i].size = reduce(int(resp.ContentLength))
+			}
+			if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+				infos[i].date = t.Format("2006-01-02")
+			}
+		}(i, version)
+	}
+	wg.Wait()
+
+	fmt.Printf("%-12s %6s  %s\n", "RELEASE", "SIZE", "DATE")
+	for i := len(versions) - 1; i >= 0; i-- {
+		fmt.Printf("%-12s %6s  %s\n", versions[i], infos[i].size, infos[i].date)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// isFile reports whether or not the URL points to a local directory.
+func isFile(url string) bool {
+	return strings.HasPrefix(url, "file://")
+}
+
+// localPath returns the path on the filesystem that the file URL points to.
+func localPath(fileURL string) (string, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", err
+	}
+
+	return u.Path, nil
+}
+
+// localFilename reads the local directory and pulls out the name of the ISO file that we will copy.
+func localFilename(mirror string) (string, error) {
+	dir, err := localPath(mirror)
+	if err != nil {
+		return "", err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("error reading mirror's directory: %v", err)
+	}
+
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasSuffix(file.Name(), ".iso") {
+			return file.Name(), nil
+		}
+	}
+
+	return "", fmt.Errorf("mirror does not have an ISO")
+}
+
+// localCopy copies the file at the local URL to w, showing progress along the way.
+func localCopy(ctx context.Context, fileURL string, w io.Writer) error {
+	filename, err := localPath(fileURL)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	p := progress{total: int(info.Size())}
+	_, err = io.Copy(w, io.TeeReader(ctxReader{ctx, src}, &p))
+
+	return err
+}
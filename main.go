@@ -1,109 +1,581 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"golang.org/x/net/html"
 	"io"
 	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 )
 
-// This is the mirror where we'll get the ISO. The full list of mirrors can be found on the main site here:
-// https://www.archlinux.org/download/
+// This is the default mirror where we'll get the ISO. It can be overridden with the --mirror flag. The full list of
+// mirrors can be found on the main site here: https://www.archlinux.org/download/
 var mirror = "https://mirrors.ocf.berkeley.edu/archlinux/iso/latest/"
 
+// These are the command-line options.
+var (
+	mirrorFlag        mirrorList
+	keyserverFlag     keyserverList
+	useMirrorlistFlag = flag.Bool("use-mirrorlist", false, "try each server in /etc/pacman.d/mirrorlist in order")
+	rankFlag          = flag.String("rank", "latency", "how to rank mirrors: latency, throughput, or none")
+	noRankFlag        = flag.Bool("no-rank", false, "use mirrors in the given order (same as --rank=none)")
+	releaseFlag       = flag.String("release", "", "download this `version` (e.g. 2024.01.01) instead of the latest")
+	multiMirrorFlag   = flag.Int("multi-mirror", 1, "download parts of the ISO from this `many` mirrors at once")
+	torrentFlag       = flag.Bool("torrent", false, "download the ISO over BitTorrent instead of from a mirror")
+	seedFlag          = flag.Duration("seed", 0, "seed a --torrent download for this `duration` once it's flashed")
+	httpsOnlyFlag     = flag.Bool("https-only", false, "refuse to use mirrors (or follow redirects) that aren't https")
+	maxAgeFlag        = flag.Duration("max-age", 48*time.Hour, "skip mirrors that haven't synced in this `duration`")
+	allowStaleFlag    = flag.Bool("allow-stale", false, "use the last mirror even if it hasn't synced within --max-age")
+	autoMirrorFlag    = flag.Bool("auto-mirror", false, "pick mirrors in our country, based on GeoIP or the locale")
+	countryFlag       = flag.String("country", "", "only use mirrors in these country `codes` (e.g. DE,SE)")
+	connectionsFlag   = flag.Int("connections", 1, "download the ISO over this `many` connections to each mirror")
+	proxyFlag         = flag.String("proxy", "", "send requests through this proxy `URL` instead of $HTTPS_PROXY")
+	limitRateFlag     = flag.String("limit-rate", "", "limit downloads to this many bytes per `second` (e.g. 500K)")
+	streamFlag        = flag.Bool("stream", false, "write the ISO to the USB drive while downloading it (see README)")
+	downloadDirFlag   = flag.String("download-dir", "", "download the ISO to this `directory` instead of the cache")
+	noCacheFlag       = flag.Bool("no-cache", false, "don't use or fill the cache of downloaded ISOs")
+	timeoutFlag       = flag.Duration("timeout", 0, "give up on the download if it takes longer than this `duration`")
+	retriesFlag       = flag.Int("retries", 3, "retry downloads that hit a network or server error this `many` times")
+	archFlag          = flag.String("arch", "x86_64", "flash Arch Linux ARM for this `architecture` (aarch64 or armv7)")
+	boardFlag         = flag.String("board", "", "with --arch, use the image for this `board` (e.g. rpi)")
+	versionFlag       = flag.Bool("version", false, "print the version of flasharch and exit")
+	minSpeedFlag      = flag.String("min-speed", "50K", "drop mirrors slower than this `rate` per second (0 disables)")
+	stallTimeFlag     = flag.Duration("stall-time", 30*time.Second, "how long a download can stay below --min-speed")
+	caCertFlag        = flag.String("ca-cert", "", "also trust the PEM certificates in this `file` (e.g. a proxy's CA)")
+	insecureFlag      = flag.Bool("insecure", false, "don't check mirrors' TLS certificates (the ISO is still checked)")
+	noVerifyFlashFlag = flag.Bool("no-verify-flash", false, "don't check the drive against the ISO after flashing it")
+	quickVerifyFlag   = flag.Bool("quick-verify", false, "only read back samples after flashing (see README)")
+	sampleSizeFlag    = flag.String("sample-size", "1M", "with --quick-verify, read back random samples of this `size`")
+	samplesFlag       = flag.Int("samples", 64, "with --quick-verify, read back this many random samples")
+	verboseFlag       = flag.Bool("verbose", false, "also print gpg's own output when checking the signature")
+	isoFlag           = flag.String("iso", "", "verify and flash this local ISO `file` instead of downloading one")
+	offlineFlag       = flag.Bool("offline", false, "never use the network; needs --iso and its .sig (see README)")
+	unmountFlag       = flag.Bool("unmount", false, "unmount the USB drive's mounted partitions without asking")
+	destroySystemFlag = flag.Bool("i-know-this-destroys-my-system", false, "flash the system's own disk (DON'T)")
+	forceFlag         = flag.Bool("force", false, "flash even if a safety check fails (see README)")
+	copyToFlag        = flag.String("copy-to", "", "copy the ISO into this `directory` instead of flashing a drive")
+	ventoyFlag        = flag.Bool("ventoy", false, "copy the ISO onto the Ventoy partition instead of flashing a drive")
+	removeOldFlag     = flag.Bool("remove-old", false, "with --copy-to or --ventoy, remove the older Arch ISOs there")
+	benchSizeFlag     = flag.String("bench-size", "256M", "with bench, write (or read) this `size` of the drive")
+	readOnlyFlag      = flag.Bool("read-only", false, "with bench, only measure how fast the drive reads")
+	fsFlag            = flag.String("fs", "", "with restore, use `fat32` or exfat (default: exfat over 32G)")
+	labelFlag         = flag.String("label", "USB", "with restore, the `label` of the new file system")
+	persistenceFlag   = flag.String("persistence", "", "add a persistence partition of this `size` (see README)")
+	noWipeFlag        = flag.Bool("no-wipe", false, "don't wipe old file system and partition table signatures first")
+	noDiscardFlag     = flag.Bool("no-discard", false, "don't tell the drive that its old contents can be discarded")
+	wipeFlag          = flag.Bool("wipe", false, "zero the whole USB drive before flashing it (slow; see README)")
+	backendFlag       = flag.String("backend", "", "write with `udisks`, direct, or dd (default: udisks unless root)")
+	useDDFlag         = flag.Bool("use-dd", false, "same as --backend dd (going away in the next release)")
+	imageFlag         = flag.Bool("image", false, "flash into a regular file instead of a USB drive, for testing")
+	ejectFlag         = flag.Bool("eject", false, "power off the USB drive after flashing, so that it's safe to unplug")
+	keepFlag          = flag.Bool("keep", false, "keep the ISO and its signature after flashing")
+	manifestFlag      = flag.String("manifest", "", "also write a JSON record of what was flashed to this `file`")
+	useGPGFlag        = flag.Bool("use-gpg", false, "check the signature with gpg instead of the built-in keys")
+	keyringFlag       = flag.String("keyring", "", "check the signature with gpgv against the keys in this `file`")
+	trustAnyKeyFlag   = flag.Bool("trust-any-key", false, "accept a good signature from any key, not just Arch's")
+	skipVerifyFlag    = flag.Bool("skip-verify", false, "DON'T check the ISO's checksum or signature (see README)")
+	yesFlag           = flag.Bool("yes", false, "don't ask before erasing the USB drive or using --skip-verify")
+	checksumFlag      = flag.String("checksum", "sha256", "check the ISO's `sha256`, b2 (BLAKE2b), or both checksums")
+	sha256Flag        = flag.String("sha256", "", "require this SHA-256 `checksum`, from a source you trust")
+	sigCoversFlag     = flag.String("sig-covers", "compressed", "if the signature covers the `compressed` or raw image")
+	downloadOnlyFlag  = flag.Bool("download-only", false, "download and verify the ISO, but don't flash it")
+	ipv4Flag          = flag.Bool("4", false, "only connect to mirrors over IPv4")
+	ipv6Flag          = flag.Bool("6", false, "only connect to mirrors over IPv6")
+)
+
 var units = []string{"B", "K", "M", "G"}
 
+// Releases are named after the date they were made, e.g. 2024.01.01.
+var releasePattern = regexp.MustCompile(`^\d{4}\.\d{2}\.\d{2}$`)
+
+// This is where Arch serves the signatures of its releases, in a directory for each version.
+var sigHost = "https://archlinux.org/iso/"
+
+// This is how long we'll wait for each mirror to respond when ranking them.
+var rankTimeout = 2 * time.Second
+
+// When ranking by throughput, we'll download the first probeSize bytes of the ISO from each of the probeCount fastest
+// mirrors (by latency), waiting at most probeTimeout for each.
+var (
+	probeCount   = 5
+	probeSize    = 2 << 20
+	probeTimeout = 15 * time.Second
+)
+
 func main() {
 	if runtime.GOOS != "linux" {
 		fmt.Println(os.Args[0], "has only been tested on Linux")
 		os.Exit(1)
 	}
 
-	// Get the path to the USB drive, and perform some sanity checks.
-	usb := getUSB()
-	if usb == "" {
+	flag.Var(&mirrorFlag, "mirror", "URL of the mirror `directory` holding the ISO (can be repeated, tried in order)")
+	flag.Var(&keyserverFlag, "keyserver", "look for missing signing keys on this `keyserver` "+
+		"(can be repeated, tried in order)")
+	flag.Usage = usage
+	flag.Parse()
+	if *versionFlag {
+		printVersion()
+		return
+	}
+	rand.Seed(time.Now().UnixNano())
+	if flag.Arg(0) == "flash" {
+		if err := parseFlash(); err != nil {
+			fmt.Println(err)
+			usage()
+			os.Exit(1)
+		}
+	}
+	if err := checkRestore(); err != nil {
+		fmt.Println(err)
+		usage()
 		os.Exit(1)
 	}
-
-	// Verify that the provided mirror URL is valid.
-	u, err := url.Parse(mirror)
-	if err != nil {
-		fmt.Println("Error parsing mirror:", err)
+	if err := checkBench(); err != nil {
+		fmt.Println(err)
+		usage()
 		os.Exit(1)
 	}
-	url := u.String()
-	fmt.Println("Looking for ISO in", url)
-
-	// Get the filename of the ISO we want.
-	filename := getFilename(url)
-	if filename == "" {
+	if err := setupClient(); err != nil {
+		fmt.Println(err)
+		usage()
 		os.Exit(1)
 	}
 
-	// Use these paths to download and save the ISO.
-	url += "/" + filename
-	isoFile := os.TempDir() + "/" + filename
+	// Handle the subcommands that don't flash anything.
+	if flag.Arg(0) == "list-releases" {
+		if isARM() {
+			fmt.Println("Arch Linux ARM does not have releases")
+			os.Exit(1)
+		}
+		if err := listCmd(context.Background()); err != nil {
+			fmt.Println("Error listing releases:", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Download the ISO.
-	fmt.Println("Downloading", filename, "...")
-	if err := downloadFile(url, isoFile); err != nil {
-		fmt.Println("Error downloading ISO:", err)
+	if *releaseFlag != "" && !releasePattern.MatchString(*releaseFlag) {
+		fmt.Println("Invalid release:", *releaseFlag)
+		usage()
+		os.Exit(1)
+	}
+	if *connectionsFlag < 1 || *multiMirrorFlag < 1 {
+		fmt.Println("--connections and --multi-mirror must be at least 1")
+		usage()
+		os.Exit(1)
+	}
+	if *limitRateFlag != "" {
+		rate, err := parseSize(*limitRateFlag)
+		if err != nil || rate <= 0 {
+			fmt.Println("Invalid rate limit:", *limitRateFlag)
+			usage()
+			os.Exit(1)
+		}
+		limiter = newRateLimiter(rate)
+	}
+	if speed, err := parseSize(*minSpeedFlag); err != nil || speed < 0 {
+		fmt.Println("Invalid minimum speed:", *minSpeedFlag)
+		usage()
+		os.Exit(1)
+	} else {
+		minSpeed = speed
+	}
+	if limiter != nil && minSpeed > 0 && int(limiter.rate)/(*connectionsFlag**multiMirrorFlag) < minSpeed {
+		fmt.Println("--limit-rate would keep each connection below --min-speed; lower --min-speed or set it to 0")
+		usage()
+		os.Exit(1)
+	}
+	if err := checkArch(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkSigCovers(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkChecksum(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkStream(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkSHA256(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkKeyring(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkISOFlag(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkManifestFlag(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkEject(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkPersistence(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkImage(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkBackend(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkCopyTo(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkWipe(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkQuickVerify(); err != nil {
+		fmt.Println(err)
+		usage()
+		os.Exit(1)
+	}
+	if err := checkSigningKeys(); err != nil {
+		fmt.Println(err)
+		os.Exit(exitCode(err))
+	}
+	if err := checkOffline(context.Background()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := checkTools(); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	fmt.Printf("\n") // Flush last progress line.
-	fmt.Println("Download complete")
 
-	// Use these paths to download and save the ISO's signature.
-	filename += ".sig"
-	url += ".sig"
-	sigFile := isoFile + ".sig"
+	// Restoring drives to hold data again doesn't download or flash anything.
+	if restoring {
+		if !restoreTargets(getTargets()) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Download the ISO's signature.
-	fmt.Println("Downloading", filename, "...")
-	if err := downloadFile(url, sigFile); err != nil {
-		fmt.Println("Error downloading signature:", err)
-		os.Exit(1)
+	// So does measuring how fast they are.
+	if benchmarking {
+		if !benchTargets(getTargets()) {
+			os.Exit(1)
+		}
+		return
 	}
-	fmt.Printf("\n") // Flush last progress line.
-	fmt.Println("Download complete")
 
-	// Verify the ISO with the signature.
-	fmt.Println("Verifying ISO")
-	cmd := exec.Command("gpg", "--keyserver-options", "auto-key-retrieve", "--verify", sigFile, isoFile)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		fmt.Println("Error verifying ISO:", err)
+	// Verifying an ISO that's already on disk doesn't download or flash anything.
+	if flag.Arg(0) == "verify" {
+		if flag.NArg() != 2 {
+			fmt.Println("verify needs the path to one ISO")
+			usage()
+			os.Exit(1)
+		}
+		if isARM() || *skipVerifyFlag {
+			fmt.Println("verify does not work with --arch or --skip-verify")
+			os.Exit(1)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		handleSignals(cancel)
+		err := verifyCmd(ctx, flag.Arg(1))
+		cancel()
+		if err != nil {
+			exitIfInterrupted()
+			fmt.Println()
+			fmt.Println("NOT VERIFIED:", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if err := checkSkipVerify(); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
+	}
+
+	// Get the paths to the USB drives, and perform some sanity checks. We don't need any if we're only downloading or
+	// copying the ISO.
+	var targets []*target
+	if !*downloadOnlyFlag && copyDir == "" {
+		if targets = getTargets(); len(flashed(targets)) == 0 {
+			os.Exit(1)
+		}
+	} else if flag.NArg() > 0 {
+		cause := "--download-only"
+		switch {
+		case *copyToFlag != "":
+			cause = "--copy-to"
+		case *ventoyFlag:
+			cause = "--ventoy"
+		}
+		fmt.Println("Ignoring", strings.Join(flag.Args(), " "), "because of", cause)
+	}
+
+	// From here on, an interrupt stops the download and cleans up after it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+
+	// Download to the given directory instead of the cache, if asked to.
+	createdDir := false
+	if *downloadDirFlag != "" {
+		dir, err := filepath.Abs(*downloadDirFlag)
+		if err == nil {
+			createdDir, err = makeDownloadDir(dir)
+		}
+		if err != nil {
+			fmt.Println("Error creating download directory:", err)
+			os.Exit(1)
+		}
+		downloadDir = dir
+	}
+
+	// Skip the download directory entirely if asked to.
+	if *streamFlag {
+		usb := targets[0].usb
+		err := wipeDrive(usb, terminal)
+		if err == nil && *imageFlag {
+			err = createImage(usb)
+		}
+		if err == nil {
+			discardDrive(usb, terminal)
+			err = streamRelease(ctx, usb)
+		}
+		if createdDir {
+			os.Remove(downloadDir)
+		}
+		if err != nil {
+			if driveRemoved(usb, err) {
+				fmt.Println("Error streaming ISO:", &removedError{usb: usb, err: err})
+				fmt.Println("Plug it back in, and then run flasharch again (the drive's name might change)")
+				os.Exit(1)
+			}
+			fmt.Println("Error streaming ISO:", err)
+			os.Exit(exitCode(err))
+		}
+		fmt.Println("Flash complete (flasharch " + getVersion() + ")")
+		printOverridden()
+		if *ejectFlag {
+			ejectDrive(usb)
+		}
+		return
+	}
+
+	// Use the ISO given with --iso, or the one from the cache if we already have this release, or the one that an
+	// earlier run kept with --keep if we aren't caching. Otherwise, download it and verify it.
+	var isoFile, sigFile, version string
+	if *isoFlag != "" {
+		if err := verifyLocalISO(ctx); err != nil {
+			exitIfInterrupted()
+			fmt.Println()
+			fmt.Println("NOT VERIFIED:", err)
+			os.Exit(exitCode(err))
+		}
+		isoFile = *isoFlag
 	} else {
-		lines := strings.Split(string(output), "\n")
-		for _, v := range lines {
-			fmt.Println("\t", v)
+		version = cacheRelease(ctx)
+		var err error
+		if isoFile, sigFile, err = getCached(ctx, version); err != nil {
+			fmt.Println()
+			fmt.Println("NOT VERIFIED:", err)
+			os.Exit(exitCode(err))
+		}
+	}
+	reused := false
+	if isoFile == "" && version == "" {
+		isoFile, sigFile = getKept(ctx)
+		reused = isoFile != ""
+	}
+	if isoFile == "" {
+		if version != "" {
+			dir, err := cacheDir(version)
+			if err != nil {
+				fmt.Println("Error creating cache directory:", err)
+				os.Exit(1)
+			}
+			downloadDir = dir
+		}
+		started := time.Now()
+		isoFile, sigFile = fetchRelease(ctx)
+		if isoFile == "" {
+			os.Exit(1)
+		}
+		recordPhase("download", started)
+		if err := verifyISO(ctx, isoFile, sigFile); err != nil {
+			exitIfInterrupted()
+			fmt.Println("Error verifying ISO:", err)
+			removeDownload(isoFile)
+			removeDownload(sigFile)
+			os.Exit(exitCode(err))
+		}
+
+		// Now that we know the files are good, we can move them into place.
+		var err error
+		if isoFile, err = finishPart(isoFile); err == nil {
+			sigFile, err = finishPart(sigFile)
+		}
+		if err != nil {
+			fmt.Println("Error saving ISO:", err)
+			os.Exit(1)
+		}
+		if version != "" {
+			pruneCache(cacheKeep, version)
+		}
+	}
+
+	// If we're only downloading, we're done. The files are left where they are.
+	if *downloadOnlyFlag {
+		if err := writeManifests(ctx, isoFile, nil, version != ""); err != nil {
+			fmt.Println("Error writing manifest:", err)
+			os.Exit(1)
+		}
+		printDownload(isoFile, sigFile)
+		seedTorrent(ctx, isoFile)
+		return
+	}
+
+	// Make sure we aren't about to write garbage to the drive, in case nothing else caught it. An ISO given with --iso
+	// was already checked before anything else.
+	if !isARM() && compression(isoFile) == "" && *isoFlag == "" {
+		if err := enforce("ISO", checkForceable, checkISO(isoFile)); err != nil {
+			fmt.Println("Error checking ISO:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Copying the ISO onto a drive that already boots others is all we do with it. The drive itself isn't touched.
+	if copyDir != "" {
+		if err := copyISO(isoFile); err != nil {
+			fmt.Println("Error copying ISO:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Copy complete (flasharch " + getVersion() + ")" + unverified())
+		printOverridden()
+		if err := writeManifests(ctx, isoFile, nil, version != ""); err != nil {
+			fmt.Println("Error writing manifest:", err)
+			os.Exit(1)
+		}
+		seedTorrent(ctx, isoFile)
+		cleanUp(isoFile, sigFile, version, reused, createdDir)
+		return
+	}
+
+	// If we can't write to the drives ourselves, flasharch running as root takes it from here.
+	if escalateWith != "" {
+		if code := flashAsRoot(isoFile, flashed(targets)); code != 0 {
+			os.Exit(code)
+		}
+		seedTorrent(ctx, isoFile)
+		cleanUp(isoFile, sigFile, version, reused, createdDir)
+		return
+	}
+
+	// Check each drive against the image. Something might have mounted one while we were downloading, too.
+	if !checkTargets(isoFile, targets) && len(targets) == 1 {
+		os.Exit(1)
+	}
+
+	// With --wipe, zero the drives first. An interrupt stops that and the whole run, as nothing has been flashed yet.
+	if *wipeFlag {
+		if !startZero() {
+			exitIfInterrupted()
 		}
+		zeroTargets(targets)
+		exitIfZeroStopped()
 	}
 
-	// Flash the ISO to the specified USB.
-	fmt.Println("Flashing ISO to", usb)
-	cmd = exec.Command("dd", "if="+isoFile, "of="+usb, "bs=1M", "status=progress")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		fmt.Println("Error flashing ISO:", err)
+	// Flash the ISO to the specified USB drives. Past this point, an interrupt won't clean anything up.
+	if !startFlash() {
+		exitIfInterrupted()
+	}
+	flashTargets(isoFile, targets)
+	usbs := flashed(targets)
+	if len(targets) == 1 && len(usbs) == 0 {
+		adviseReplug(isoFile, version != "", targets)
 		os.Exit(1)
+	}
+	if len(targets) == 1 {
+		fmt.Println("Flash complete (flasharch " + getVersion() + ")" + unverified())
 	} else {
-		lines := strings.Split(string(output), "\n")
-		for _, v := range lines {
-			fmt.Println("\t", v)
+		fmt.Printf("Flashed %v of %v drives (flasharch %v)%v\n", len(usbs), len(targets), getVersion(), unverified())
+	}
+	printTargets(targets)
+	printOverridden()
+	if len(usbs) > 0 {
+		printPersistence()
+		if err := writeManifests(ctx, isoFile, usbs, version != ""); err != nil {
+			fmt.Println("Error writing manifest:", err)
+			os.Exit(1)
+		}
+	}
+	if *ejectFlag {
+		for _, usb := range usbs {
+			ejectDrive(usb)
 		}
 	}
-	fmt.Println("Flash complete")
 
-	// Clean up the temporary files we created.
+	// If any drive failed, everything is left in place for another try.
+	if len(usbs) < len(targets) {
+		adviseReplug(isoFile, version != "", targets)
+		os.Exit(1)
+	}
+	seedTorrent(ctx, isoFile)
+	cleanUp(isoFile, sigFile, version, reused, createdDir)
+}
+
+// cleanUp removes the temporary files we created. Cached files are kept for next time, and so is anything we were asked
+// to keep, that an earlier run kept, or that we were given with --iso.
+func cleanUp(isoFile, sigFile, version string, reused, createdDir bool) {
+	if version != "" || *isoFlag != "" {
+		return
+	}
+	if *keepFlag || reused {
+		fmt.Println("Kept ISO at", isoFile)
+		fmt.Println("Kept signature at", sigFile)
+		return
+	}
 	if err := os.Remove(isoFile); err != nil {
 		fmt.Println("Error removing ISO file:", err)
 		os.Exit(1)
@@ -112,156 +584,947 @@ func main() {
 		fmt.Println("Error removing signature file:", err)
 		os.Exit(1)
 	}
+	removeValidators(isoFile)
+	removeValidators(sigFile)
+	if createdDir {
+		// This only works if the directory is empty, so we won't remove anything that we didn't create.
+		os.Remove(downloadDir)
+	}
+}
+
+// fetchRelease finds the mirrors, ranks them, and downloads the ISO and its signature, either over BitTorrent, from
+// several mirrors at once, or from the first mirror that works. It returns the paths to the ISO and signature files. If
+// anything goes wrong, the error is printed and empty paths are returned.
+func fetchRelease(ctx context.Context) (string, string) {
+	mirrors, heads := findMirrors(ctx)
+	if mirrors == nil {
+		return "", ""
+	}
+
+	// Download the ISO and its signature, either over BitTorrent, from several mirrors at once, or from the first
+	// mirror that works.
+	downloadCtx := ctx
+	if *timeoutFlag > 0 {
+		var cancel context.CancelFunc
+		downloadCtx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+		defer cancel()
+	}
+	var isoFile, sigFile string
+	var err error
+	switch {
+	case *torrentFlag:
+		if isoFile, sigFile, err = fetchTorrent(downloadCtx, mirrors); err != nil {
+			exitIfInterrupted()
+			fmt.Println("Error using torrent:", err)
+			return "", ""
+		}
+	case *multiMirrorFlag > 1:
+		if isoFile, sigFile, err = fetchMulti(downloadCtx, mirrors, *multiMirrorFlag); err != nil {
+			exitIfInterrupted()
+			fmt.Println("Error using multiple mirrors:", err)
+			return "", ""
+		}
+	default:
+		if isoFile, sigFile, err = fetchFirst(downloadCtx, mirrors, heads); err != nil {
+			exitIfInterrupted()
+			fmt.Println(err)
+			return "", ""
+		}
+	}
+
+	return isoFile, sigFile
+}
+
+// findMirrors builds the list of mirrors to search and puts the fastest ones first. It also returns the beginning of
+// any ISO that was downloaded while ranking them, keyed by URL. If anything goes wrong, the error is printed and no
+// mirrors are returned.
+func findMirrors(ctx context.Context) ([]string, map[string][]byte) {
+	// Build the list of mirrors to search.
+	mirrors, err := getMirrors(ctx)
+	if err != nil {
+		fmt.Println("Error getting mirrors:", err)
+		return nil, nil
+	}
+	if err := checkRsync(mirrors); err != nil {
+		fmt.Println(err)
+		return nil, nil
+	}
+
+	// Put the fastest mirrors first.
+	var heads map[string][]byte
+	if *noRankFlag {
+		*rankFlag = "none"
+	}
+	switch *rankFlag {
+	case "none":
+	case "latency":
+		if len(mirrors) > 1 {
+			mirrors = rankMirrors(ctx, mirrors, rankTimeout)
+		}
+	case "throughput":
+		if len(mirrors) > 1 {
+			mirrors = rankMirrors(ctx, mirrors, rankTimeout)
+		}
+		// Probing isn't worth it if the ISO is coming over BitTorrent.
+		if len(mirrors) > 1 && !*torrentFlag {
+			mirrors, heads = probeMirrors(ctx, mirrors, probeCount, probeSize, probeTimeout)
+		}
+	default:
+		fmt.Println("Invalid ranking method:", *rankFlag)
+		usage()
+		return nil, nil
+	}
+
+	return mirrors, heads
+}
+
+// verifyISO checks the ISO against the checksum given with --sha256 and its signature, and prints what the checks have
+// to say about it. Compressed images that were already checked against the signature while they were downloaded aren't
+// checked again.
+func verifyISO(ctx context.Context, isoFile, sigFile string) error {
+	defer recordPhase("verify", time.Now())
+	if err := checkPinnedSum(ctx, isoFile); err != nil {
+		return err
+	}
+	if *skipVerifyFlag {
+		recordSkipped()
+		return skipVerification(isoFile)
+	}
+
+	fmt.Println("Verifying ISO")
+	output, ok := getStreamVerified(isoFile)
+	if ok {
+		fmt.Println("The compressed image was verified while it was downloaded")
+		recordSig(manifestSig{
+			Verified: true,
+			Result:   "good signature of the compressed image, checked while downloading",
+		})
+	} else {
+		file, err := os.Open(isoFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		check, err := verifySig(ctx, sigFile, file)
+		if err != nil {
+			return err
+		}
+		output = []byte(check.report())
+		recordCheck(check)
+	}
+
+	printSigReport(string(output))
+
+	return nil
+}
+
+// fetchFirst downloads the ISO and its signature from the first mirror that works. Stale mirrors are skipped as long as
+// there's another one to try. It returns the paths to the ISO and signature files.
+func fetchFirst(ctx context.Context, mirrors []string, heads map[string][]byte) (string, string, error) {
+	for i, mirror := range mirrors {
+		if ctx.Err() != nil {
+			return "", "", fmt.Errorf("download timed out after %v", *timeoutFlag)
+		}
+
+		if err := checkFreshness(ctx, mirror, i == len(mirrors)-1); err != nil {
+			fmt.Println("Error using mirror", mirror+":", err)
+			continue
+		}
+
+		isoFile, sigFile, err := fetchISO(ctx, mirror, heads)
+		if err == nil {
+			return isoFile, sigFile, nil
+		}
+		if _, ok := err.(spaceError); ok {
+			return "", "", err
+		}
+		fmt.Println("Error using mirror", mirror+":", err)
+	}
+
+	return "", "", fmt.Errorf("all mirrors failed")
+}
+
+// fetchISO finds the latest ISO on the mirror and downloads it and its signature. The signature is downloaded alongside
+// the ISO, so that a mirror without one is given up on right away. heads holds the beginning of any ISO that was
+// already partially downloaded while ranking the mirrors, keyed by URL. It returns the paths to the ISO and signature
+// files. If anything goes wrong, no files are left on disk.
+func fetchISO(ctx context.Context, mirror string, heads map[string][]byte) (string, string, error) {
+	fmt.Println("Looking for ISO in", mirror)
+
+	// Get the filename of the ISO we want.
+	filename, sum, err := getFilename(ctx, mirror)
+	if err != nil {
+		return "", "", timeoutError(ctx, err, "looking for the ISO", mirror)
+	}
+	fmt.Println("Using mirror", mirror)
+	recordMirror(mirror)
+
+	// Use these paths to download and save the ISO and its signature.
+	url, err := joinURL(mirror, filename)
+	if err != nil {
+		return "", "", err
+	}
+	// Compressed images are decompressed as they're downloaded.
+	filename = path.Base(filename)
+	ext := compression(filename)
+	if ext != "" {
+		if !isHTTP(url) {
+			return "", "", fmt.Errorf("compressed images can only be downloaded from http mirrors")
+		}
+		if err := checkDecompressor(ext); err != nil {
+			return "", "", err
+		}
+	}
+	isoFile := downloadDir + "/" + rawName(filename)
+	sigFile, err := partFile(isoFile + ".sig")
+	if err != nil {
+		return "", "", err
+	}
+
+	// Start on the signature. If it fails, there's no point in downloading the ISO.
+	isoCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	waitSig := fetchSig(ctx, cancel, sigURLs(filename, url), sigFile)
+
+	// Download the ISO, unless we already have it from an earlier run. It's downloaded next to where it will end up and
+	// only moved into place once it's verified.
+	if isCurrent(isoCtx, url, isoFile) {
+		fmt.Println("Already have the latest", filename+", skipping download")
+	} else {
+		if isoFile, err = partFile(isoFile); err == nil {
+			err = checkSpace(isoCtx, url, isoFile)
+		}
+		if err == nil {
+			fmt.Println("Downloading", filename, "and its signature ...")
+			switch {
+			case ext != "" && *sigCoversFlag == "compressed" && !*skipVerifyFlag:
+				// The compressed image is never saved, so it has to be checked against the signature on the way.
+				if err = waitSig(); err == nil {
+					err = downloadCompressed(isoCtx, url, isoFile, sigFile)
+				}
+			case ext != "":
+				err = downloadCompressed(isoCtx, url, isoFile, "")
+			case *connectionsFlag > 1 && isHTTP(url):
+				err = segmentedDownload(isoCtx, url, isoFile, *connectionsFlag, heads[url])
+			default:
+				err = downloadFile(isoCtx, url, isoFile, heads[url])
+			}
+			fmt.Printf("\n") // Flush last progress line.
+			if err != nil {
+				err = fmt.Errorf("error downloading ISO: %v", timeoutError(ctx, err, "downloading the ISO", mirror))
+			}
+		}
+		if err != nil {
+			// If the signature is why the ISO download stopped, that's the error that matters.
+			if isoCtx.Err() != nil && ctx.Err() == nil {
+				err = waitSig()
+			}
+			cancel()
+			waitSig()
+			removeDownload(sigFile)
+			if validator, _ := readResume(isoFile); validator == "" {
+				removeDownload(isoFile)
+			}
+			return "", "", err
+		}
+		if ext == "" {
+			err = sniffFile(isoFile)
+		}
+		if err != nil {
+			cancel()
+			waitSig()
+			removeDownload(isoFile)
+			removeDownload(sigFile)
+			return "", "", err
+		}
+		fmt.Println("Download complete")
+		if sum := getDigest(isoFile); sum != "" {
+			fmt.Println("SHA-256:", sum)
+		}
+	}
+
+	// Make sure we have the signature before going any further.
+	if err := waitSig(); err != nil {
+		removeDownload(isoFile)
+		return "", "", err
+	}
+
+	// If we know what the checksum should be, make sure the mirror sent us the right file.
+	if err := verifyChecksums(ctx, isoFile, checksums(ctx, mirror, filename, sum)); err != nil {
+		removeDownload(isoFile)
+		removeDownload(sigFile)
+		return "", "", err
+	}
+
+	return isoFile, sigFile, nil
 }
 
-// getUSB checks the provided path to the USB drive and returns it back to the caller.
-func getUSB() string {
-	// Make sure the user provided a path to the USB drive.
-	if len(os.Args) != 2 {
-		if len(os.Args) < 2 {
-			fmt.Println("Missing path to USB drive")
-		} else {
-			fmt.Println("Invalid arguments")
+// fetchSig downloads the signature in the background from the first of the urls that has it. If none of them do,
+// cancel is called so that the ISO download stops right away. The returned function waits for the signature and
+// returns what went wrong, if anything. It can be called more than once.
+func fetchSig(ctx context.Context, cancel context.CancelFunc, urls []string, sigFile string) func() error {
+	done := make(chan struct{})
+	var err error
+	var source string
+	go func() {
+		defer close(done)
+		for _, url := range urls {
+			// The signature is tiny, so it won't get a progress bar that would get in the ISO's way.
+			// A web page in place of the signature means that this source is no good, so we'll move on to the next one.
+			if err = downloadFile(ctx, url, sigFile, nil); err == nil {
+				if err = sniffFile(sigFile); err != nil {
+					removeDownload(sigFile)
+				}
+			}
+			if err == nil {
+				source = url
+				return
+			}
+			err = fmt.Errorf("error downloading signature %v: %v", url,
+				timeoutError(ctx, err, "downloading the signature", url))
+		}
+		if err == nil {
+			err = fmt.Errorf("no mirror has the signature")
+		}
+		cancel()
+	}()
+
+	// The ISO's progress bar is done by the time anyone waits for the signature, so we can say where it came from.
+	var once sync.Once
+	return func() error {
+		<-done
+		if err == nil {
+			once.Do(func() { fmt.Println("Got signature from", source) })
 		}
-		fmt.Println("Usage:")
-		fmt.Println("\t", os.Args[0], "/full/path/to/usb")
+		return err
+	}
+}
+
+// sigURLs returns where to download the signature of the ISO from, in order, given the urls of the ISO on the mirrors.
+// archlinux.org serves the signature of every release itself, so we'll get it from there rather than trust the mirrors
+// that the ISO comes from with both. The mirrors are only used if archlinux.org can't be reached.
+func sigURLs(filename string, urls ...string) []string {
+	var sigs []string
+	filename = path.Base(filename)
+	if version := isoVersion(filename); !isARM() && version != "" {
+		sigs = append(sigs, sigHost+version+"/"+filename+".sig")
+	}
+	for _, url := range urls {
+		sigs = append(sigs, url+".sig")
+	}
+
+	return sigs
+}
+
+// isoVersion returns the release that the ISO's filename names, or "" if it isn't named like one of Arch's ISOs.
+func isoVersion(filename string) string {
+	version := strings.TrimSuffix(strings.TrimPrefix(path.Base(filename), "archlinux-"), "-x86_64.iso")
+	if !releasePattern.MatchString(version) {
 		return ""
 	}
-	usb := os.Args[1]
 
+	return version
+}
+
+// printDownload prints where the verified ISO and its signature are and the ISO's checksum.
+func printDownload(isoFile, sigFile string) {
+	fmt.Println("ISO:", isoFile+unverified())
+	fmt.Println("Signature:", sigFile)
+	sum, err := fileDigest(isoFile)
+	if err != nil {
+		fmt.Println("Error hashing ISO:", err)
+		os.Exit(1)
+	}
+	fmt.Println("SHA-256:", sum)
+}
+
+// usage prints the program's usage and all available options.
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("\t", os.Args[0], "[options] /full/path/to/usb [/full/path/to/another/usb ...]")
+	fmt.Println("\t", os.Args[0], "[options] flash /path/to/iso /full/path/to/usb [/full/path/to/another/usb ...]")
+	fmt.Println("\t", os.Args[0], "[options] --download-only")
+	fmt.Println("\t", os.Args[0], "[options] --copy-to /path/to/directory")
+	fmt.Println("\t", os.Args[0], "[options] --image /full/path/to/file [/full/path/to/another/file ...]")
+	fmt.Println("\t", os.Args[0], "[options] list-releases")
+	fmt.Println("\t", os.Args[0], "[options] verify /path/to/iso")
+	fmt.Println("\t", os.Args[0], "[options] restore /full/path/to/usb [/full/path/to/another/usb ...]")
+	fmt.Println("\t", os.Args[0], "[options] bench /full/path/to/usb [/full/path/to/another/usb ...]")
+	fmt.Println("Options:")
+	flag.CommandLine.SetOutput(os.Stdout)
+	flag.PrintDefaults()
+}
+
+// getUSBs checks the provided paths to the USB drives and returns them back to the caller, or nil if any of them is
+// wrong.
+func getUSBs() []string {
+	// Make sure the user provided a path to a USB drive. If they didn't, they can pick one, as long as we can ask.
+	args := flag.Args()
+	if len(args) == 0 && isTerminal() && !*imageFlag {
+		args = []string{pickDrive()}
+		if args[0] == "" {
+			return nil
+		}
+	}
+	if len(args) < 1 && *imageFlag {
+		fmt.Println("Missing path to image file")
+		usage()
+		return nil
+	}
+	if len(args) < 1 {
+		fmt.Println("Missing path to USB drive")
+		usage()
+		return nil
+	}
+	for _, usb := range args {
+		if !checkUSB(usb) {
+			return nil
+		}
+	}
+
+	return args
+}
+
+// checkUSB checks the provided path to a USB drive, and reports whether or not it's good.
+func checkUSB(usb string) bool {
 	// Make sure we have an absolute path
 	if !path.IsAbs(usb) {
 		fmt.Println("Must use absolute path to USB drive")
-		fmt.Println("Usage:")
-		fmt.Println("\t", os.Args[0], "/full/path/to/usb")
-		return ""
+		usage()
+		return false
 	}
 
-	// Make sure the path is valid.
-	info, err := os.Stat(usb)
-	if err != nil {
+	// A file for --image doesn't have to exist yet.
+	if *imageFlag {
+		if err := checkImageFile(usb); err != nil {
+			fmt.Println(err)
+			return false
+		}
+		return true
+	}
+
+	// Make sure the path is valid. Whether or not we can write to it is up to checkPrivileges.
+	if _, err := os.Stat(usb); err != nil {
 		fmt.Println(err)
-		return ""
+		return false
 	}
 
-	// Make sure we have write permissions to the USB. We can't really error out on the type assertion, so we'll only do
-	// this additional sanity check if we can.
-	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
-		// Check if we match the file's user or group.
-		isUser := os.Getuid() == int(stat.Uid)
-		isGroup := os.Getgid() == int(stat.Gid)
+	return true
+}
 
-		// Find out which of the file's user, group, and other write bits are set.
-		perms := info.Mode().Perm() & os.ModePerm
-		uWrite := perms&(1<<7) > 0
-		gWrite := perms&(1<<4) > 0
-		oWrite := perms&(1<<1) > 0
+// parseMirror validates the provided mirror and returns it in its canonical form. Only http, https, ftp, rsync, and
+// local (file or plain path) mirrors are supported.
+func parseMirror(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return "", err
+	}
 
-		if !(isUser && uWrite) && !(isGroup && gWrite) && !oWrite {
-			fmt.Println("Cannot write to", usb)
-			return ""
+	// Local directories don't need a host.
+	if u.Scheme == "" && path.IsAbs(u.Path) {
+		u.Scheme = "file"
+	}
+	if u.Scheme == "file" {
+		if !path.IsAbs(u.Path) {
+			return "", fmt.Errorf("%v: must be an absolute path", mirror)
 		}
+		return u.String(), nil
+	}
+
+	if _, ok := defaultPorts[u.Scheme]; !ok {
+		return "", fmt.Errorf("%v: scheme must be http, https, ftp, rsync, or file", mirror)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%v: missing host", mirror)
 	}
 
-	return usb
+	return u.String(), nil
 }
 
-// getFilename parses the mirror's directory and pulls out the name of the ISO file that we will download.
-func getFilename(url string) string {
-	resp, err := http.Get(url)
+// joinURL resolves the file's reference against the mirror's directory. The mirror can be given with or without a
+// trailing slash, and the reference can be a bare filename, an absolute path, or a full URL.
+func joinURL(mirror, ref string) (string, error) {
+	base, err := url.Parse(mirror)
 	if err != nil {
-		fmt.Println("Error accessing mirror:", err)
-		return ""
+		return "", err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
 	}
-	defer resp.Body.Close()
 
-	// Parse the HTML data into a tree/doc.
-	doc, err := html.Parse(resp.Body)
+	r, err := url.Parse(ref)
 	if err != nil {
-		fmt.Println("Error parsing mirror's directory:", err)
-		return ""
+		return "", err
+	}
+
+	return base.ResolveReference(r).String(), nil
+}
+
+// getFilename returns the name of the ISO file that we will download, along with its SHA-256 checksum if we know it.
+// The releng API is the authoritative source for the latest release. If it can't be reached or we want a different
+// release, we'll look for the ISO in the mirror's list of checksums. If that's missing too, we'll parse the mirror's
+// directory and pull out the name of the ISO instead.
+func getFilename(ctx context.Context, url string) (string, string, error) {
+	if isARM() {
+		return armFilename(ctx, url)
+	}
+
+	// Local directories might not have the latest release, so we'll always look for ourselves.
+	if isFile(url) {
+		if filename, sum, err := getSums(ctx, url); err == nil || exitCode(err) == exitBadSig {
+			return filename, sum, err
+		}
+		filename, err := localFilename(url)
+		return filename, "", err
+	}
+
+	if *releaseFlag == "" {
+		if r, err := getLatestRelease(ctx); err == nil {
+			return r.filename(), r.SHA256Sum, nil
+		}
+	}
+
+	// A checksum file with a bad signature means that the mirror can't be trusted with anything else either.
+	if filename, sum, err := getSums(ctx, url); err == nil || exitCode(err) == exitBadSig {
+		return filename, sum, err
+	}
+
+	if isRsync(url) {
+		filename, err := rsyncFilename(ctx, url)
+		return filename, "", err
+	}
+	if isFTP(url) {
+		filename, err := ftpFilename(ctx, url)
+		return filename, "", err
 	}
 
-	// Move through the document until we find our ISO. We'll traverse the tree in this order of tags:
-	tags := []string{"html", "body", "table", "tbody", "tr", "td", "a"}
-	filename := parseBody(doc, tags)
+	doc, err := getPage(ctx, url)
+	if se, ok := err.(statusError); ok && se.code == 404 && *releaseFlag != "" {
+		return "", "", releaseNotFound(ctx, url, *releaseFlag)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("error accessing mirror: %v", err)
+	}
+
+	// Search the document for a link to our ISO.
+	filename := parseBody(doc)
 	if filename == "" {
-		fmt.Println("Mirror does not have the latest ISO")
-		return ""
+		if *releaseFlag != "" {
+			return "", "", fmt.Errorf("mirror does not have the ISO for release %v", *releaseFlag)
+		}
+		return "", "", fmt.Errorf("mirror does not have the latest ISO")
 	}
 
-	return filename
+	return filename, "", nil
+}
+
+// getPage downloads the HTML page at the URL and parses it into a tree, retrying if anything goes wrong along the way.
+func getPage(ctx context.Context, url string) (*html.Node, error) {
+	var doc *html.Node
+	err := retry(ctx, "accessing "+url, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return responseError(resp)
+		}
+
+		doc, err = html.Parse(resp.Body)
+		return err
+	})
+
+	return doc, err
 }
 
 // parseBody parses the provided HTML and pulls out the name of the ISO that we want to download.
-func parseBody(node *html.Node, tags []string) string {
-	if len(tags) == 0 {
-		// We found a link tag. Let's see if it's pointing to an ISO.
+func parseBody(node *html.Node) string {
+	links := parseLinks(node, func(href string) bool {
+		return strings.HasSuffix(href, ".iso")
+	})
+	if len(links) == 0 {
+		return ""
+	}
+
+	return links[0]
+}
+
+// parseLinks parses the provided HTML and pulls out every link that satisfies match, in the order they appear.
+// Directory listings come in many styles (Apache puts the links in a table, nginx and lighttpd put them in a <pre>
+// block, etc.), so we'll look at every link in the document no matter where it is.
+func parseLinks(node *html.Node, match func(string) bool) []string {
+	var links []string
+	if node.Type == html.ElementNode && node.Data == "a" {
+		// We found a link tag. Let's see if it's pointing to something we want.
 		for _, a := range node.Attr {
-			if a.Key == "href" && strings.HasSuffix(a.Val, ".iso") {
-				// We found it.
-				return a.Val
+			if a.Key == "href" && match(a.Val) {
+				links = append(links, a.Val)
+				break
 			}
 		}
-		// Nothing yet.
-		return ""
 	}
 
-	// Check each child node until we find an element with the desired tag.
+	// Check the rest of the tree below this node.
 	for child := node.FirstChild; child != nil; child = child.NextSibling {
-		if child.Type == html.ElementNode && child.Data == tags[0] {
-			// We found the tag we want. Keep going down.
-			if iso := parseBody(child, tags[1:]); iso != "" {
-				return iso
-			}
+		links = append(links, parseLinks(child, match)...)
+	}
+
+	return links
+}
+
+// releaseNotFound builds the error for a release that the mirror doesn't have, listing the closest releases that it
+// does have.
+func releaseNotFound(ctx context.Context, mirror, version string) error {
+	parent, err := joinURL(mirror, "..")
+	if err != nil {
+		return fmt.Errorf("release %v not found", version)
+	}
+
+	versions, err := listReleases(ctx, parent)
+	if err != nil || len(versions) == 0 {
+		return fmt.Errorf("release %v not found", version)
+	}
+
+	return fmt.Errorf("release %v not found (nearby releases: %v)", version,
+		strings.Join(nearbyReleases(versions, version, 5), ", "))
+}
+
+// listReleases parses the mirror's ISO directory and returns the versions of every release it has, oldest first.
+func listReleases(ctx context.Context, url string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%v", resp.Status)
+	}
+
+	doc, err := html.Parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every release has its own directory.
+	links := parseLinks(doc, func(href string) bool {
+		return releasePattern.MatchString(strings.TrimSuffix(href, "/"))
+	})
+
+	// Some listings link to each entry more than once (e.g. an icon and the name).
+	var versions []string
+	seen := make(map[string]bool)
+	for _, link := range links {
+		if version := strings.TrimSuffix(link, "/"); !seen[version] {
+			seen[version] = true
+			versions = append(versions, version)
 		}
 	}
+	sort.Strings(versions)
+
+	return versions, nil
+}
+
+// nearbyReleases returns up to n of the sorted versions that are closest to the given version.
+func nearbyReleases(versions []string, version string, n int) []string {
+	start := sort.SearchStrings(versions, version) - n/2
+	if start > len(versions)-n {
+		start = len(versions) - n
+	}
+	if start < 0 {
+		start = 0
+	}
 
-	// If we're here, then we didn't find the child that we were looking for. We'll move back up a level and keep trying.
-	return ""
+	end := start + n
+	if end > len(versions) {
+		end = len(versions)
+	}
+
+	return versions[start:end]
 }
 
 // downloadFile downloads the file at the url. In order to show a progress bar, we're going to wrap our HTTP response in
 // a Tee Reader. This will allow us to monitor the number of bytes received in realtime. Thank you, Edd Turtle, for this
-// recommendation.
-func downloadFile(url, filename string) error {
-	// Create a save point.
-	file, err := os.Create(filename)
+// recommendation. If we already have the beginning of the file in head, only the rest of it is requested. If the
+// download fails, the partial file is removed.
+func downloadFile(ctx context.Context, url, filename string, head []byte) error {
+	return retry(ctx, "downloading "+path.Base(url), func() error {
+		return download(ctx, url, filename, head)
+	})
+}
+
+// download makes one attempt at downloading the file, for downloadFile.
+func download(ctx context.Context, url, filename string, head []byte) (err error) {
+	trackDownload(filename)
+	setDigest(filename, "")
+	setB2Digest(filename, "")
+	if isRsync(url) {
+		return rsyncFile(ctx, url, filename)
+	}
+
+	// Create a save point. HTTP downloads can be resumed, so we'll hold on to anything that a previous run left behind.
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if isHTTP(url) {
+		flags &^= os.O_TRUNC
+	}
+	file, err := os.OpenFile(filename, flags, 0666)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	keep := false
+	defer func() {
+		file.Close()
+		if err != nil && !keep {
+			os.Remove(filename)
+			removeResume(filename)
+			removeValidators(filename)
+		}
+	}()
+
+	// Only HTTP servers can tell us if the file changed, so we'll forget what we knew about it for everything else.
+	if !isHTTP(url) {
+		removeValidators(filename)
+	}
+
+	// Local files have their own progress bar.
+	if isFile(url) {
+		return localCopy(ctx, url, file)
+	}
+
+	// Give up on mirrors that are too slow. What we got from them so far is kept or removed like with any other error.
+	stall := newStallWatcher(ctx)
+	ctx = stall.ctx
+	defer func() {
+		if serr := stall.stop(); serr != nil {
+			err = serr
+		}
+	}()
+
+	// FTP mirrors report the size of the file before sending it, which is all we need to set up our progress bar.
+	if isFTP(url) {
+		var p progress
+		h := sha256.New()
+		writers := []io.Writer{file, &p, h, stall}
+		b2, err := startB2Digest(ctx)
+		if err != nil {
+			return err
+		}
+		if b2 != nil {
+			defer b2.Close()
+			writers = append(writers, b2)
+		}
+		size := int64(-1)
+		err = ftpDownload(ctx, url, io.MultiWriter(writers...), func(s int64) {
+			stall.start()
+			size = s
+			if size > 0 {
+				p.total = int(size)
+			}
+		})
+		if err == nil && size > 0 && int64(p.have) != size {
+			err = truncatedError{int64(p.have), size, false}
+		}
+		if err == nil && p.have == 0 {
+			err = fmt.Errorf("mirror sent an empty file")
+		}
+		if err == nil {
+			setDigest(filename, hex.EncodeToString(h.Sum(nil)))
+			err = finishB2Digest(b2, filename)
+		}
+		return err
+	}
+
+	// If a previous run left part of the file behind, we'll continue from there, as long as the server can tell us that
+	// the file hasn't changed since.
+	var partial int64
+	validator, total := readResume(filename)
+	if size, done := readChunks(filename); done != nil {
+		// A download from several mirrors at once left its finished chunks all over the file, so we can only continue
+		// after the ones at the start.
+		var prefix int64
+		for i := 0; i < len(done) && done[i]; i++ {
+			prefix = int64(i+1) * size
+		}
+		if prefix > total {
+			prefix = total
+		}
+		if err := file.Truncate(prefix); err != nil {
+			return err
+		}
+	}
+	if info, err := file.Stat(); err == nil && validator != "" && info.Size() > int64(len(head)) {
+		partial = info.Size()
+		head = nil
+	}
 
-	// Grab the file's data.
-	resp, err := http.Get(url)
+	// Grab the file's data, skipping what we already have.
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case partial > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", partial))
+		req.Header.Set("If-Range", validator)
+	case len(head) > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(head)))
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	// Make sure we accessed everything correctly.
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("%v", resp.Status)
+	// Make sure we accessed everything correctly. If the server ignored our range or the file changed, we'll get the
+	// whole file again.
+	offset := int64(0)
+	switch {
+	case resp.StatusCode == 206 && partial > 0:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != partial || size != total {
+			// This isn't the file we started with, so we'll have to start over.
+			keep = true // The new download cleans up after itself.
+			resp.Body.Close()
+			file.Truncate(0)
+			removeResume(filename)
+			return download(ctx, url, filename, nil)
+		}
+		if _, err := file.Seek(partial, io.SeekStart); err != nil {
+			return err
+		}
+		fmt.Println("Resuming download at", reduce(int(partial)))
+		offset = partial
+	case resp.StatusCode == 206 && len(head) > 0:
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Write(head); err != nil {
+			return err
+		}
+		offset = int64(len(head))
+	case resp.StatusCode == 416 && partial > 0 && partial == total:
+		// We already have the whole file.
+		removeResume(filename)
+		return nil
+	case resp.StatusCode == 200:
+		removeValidators(filename)
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+	default:
+		return responseError(resp)
+	}
+	if err := checkContentType(resp, filename); err != nil {
+		return err
+	}
+
+	// Remember which version of the file this is, in case the download is interrupted. Without an ETag or a date, we
+	// wouldn't be able to tell if the file changed, so there's no point in keeping a partial download around.
+	validator = resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator != "" && resp.ContentLength > 0 {
+		if err := writeResume(filename, validator, offset+resp.ContentLength); err == nil {
+			keep = true
+		}
+	}
+
+	// Hash whatever we're starting with, so that the checksums are ready as soon as the rest of the file arrives.
+	h := sha256.New()
+	hashes := []io.Writer{h}
+	b2, err := startB2Digest(ctx)
+	if err != nil {
+		return err
+	}
+	if b2 != nil {
+		defer b2.Close()
+		hashes = append(hashes, b2)
+	}
+	if offset > 0 {
+		if err := hashFile(io.MultiWriter(hashes...), file, offset); err != nil {
+			return err
+		}
 	}
 
 	// Set up our progress bar.
-	p := progress{total: reduce(int(resp.ContentLength))}
-	t := io.TeeReader(resp.Body, &p)
+	p := progress{have: int(offset)}
+	if resp.ContentLength > 0 {
+		p.total = int(offset + resp.ContentLength)
+	}
+	t := io.TeeReader(limitReader(resp.Body), io.MultiWriter(append(hashes, &p, stall)...))
+	stall.start()
+
+	// Save the file. A connection that dropped cleanly might not give an error, so we'll make sure we got everything.
+	n, err := io.Copy(file, t)
+	if err == nil && resp.ContentLength >= 0 && n < resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) && resp.ContentLength > 0 {
+		return truncatedError{offset + n, offset + resp.ContentLength, keep}
+	}
+	if err != nil {
+		return err
+	}
+	if offset+n == 0 {
+		return fmt.Errorf("mirror sent an empty file")
+	}
+	removeResume(filename)
+	setDigest(filename, hex.EncodeToString(h.Sum(nil)))
+	if err := finishB2Digest(b2, filename); err != nil {
+		return err
+	}
+
+	// Remember which version of the file this is, so that the next run can skip the download if it hasn't changed.
+	writeValidators(filename, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+
+	return nil
+}
+
+// truncatedError is returned when a download ends before the whole file arrived.
+type truncatedError struct {
+	have      int64
+	total     int64
+	resumable bool
+}
 
-	// Save the file.
-	_, err = io.Copy(file, t)
+func (e truncatedError) Error() string {
+	msg := fmt.Sprintf("download truncated: got %v of %v", reduce(int(e.have)), reduce(int(e.total)))
+	if e.resumable {
+		msg += " (the partial file was kept, so running flasharch again will resume it)"
+	}
+
+	return msg
+}
 
-	return err
+// Unwrap lets a truncated download be retried like any other dropped connection.
+func (e truncatedError) Unwrap() error {
+	return io.ErrUnexpectedEOF
 }
 
 // Progress will be used to display a progress bar during the download operation.
 type progress struct {
-	total string // size of file to be downloaded, ready for printing
-	have  int    // number of bytes we currently have
-	count int    // running count of write operations, for determining if we should print or not
+	total   int       // size of file to be downloaded in bytes, or 0 if unknown
+	have    int       // number of bytes we currently have
+	count   int       // running count of write operations, for determining if we should print or not
+	label   string    // what to say we did with the bytes, or "" for "Received"
+	started time.Time // when we started counting, for the speed
+	from    int       // number of bytes we had when we started counting
+	r       *reporter // where to show the progress, or nil for the terminal
 }
 
 func (pr *progress) Write(p []byte) (int, error) {
+	pr.start()
 	n := len(p)
 	pr.have += n
 
@@ -271,19 +1534,85 @@ func (pr *progress) Write(p []byte) (int, error) {
 		return n, nil
 	}
 
-	// Clear the line.
-	fmt.Printf("\r%s", strings.Repeat(" ", 50))
-
-	// Print the current transfer status.
-	fmt.Printf("\rReceived %v of %v", reduce(pr.have), pr.total)
+	pr.print()
 
 	return n, nil
 }
 
+// print displays the current transfer status.
+func (pr *progress) print() {
+	pr.start()
+
+	// Print the current transfer status. We might not know how big the file is.
+	label := pr.label
+	if label == "" {
+		label = "Received"
+	}
+	status := label + " " + reduce(pr.have)
+	if pr.total > 0 {
+		status += " of " + reduce(pr.total)
+	}
+
+	// Once there's enough to go on, show how fast it's going and, if we know how big the file is, how long it has left.
+	// Whatever we had before we started counting (like a resumed download) doesn't count towards the speed.
+	if elapsed := time.Since(pr.started); elapsed >= time.Second && pr.have > pr.from {
+		rate := float64(pr.have-pr.from) / elapsed.Seconds()
+		status += " (" + reduce(int(rate)) + "/s"
+		if pr.total > pr.have {
+			left := time.Duration(float64(pr.total-pr.have) / rate * float64(time.Second))
+			status += ", " + left.Round(time.Second).String() + " left"
+		}
+		status += ")"
+	}
+	if pr.r == nil {
+		pr.r = terminal
+	}
+	pr.r.progress(status)
+}
+
+// start starts counting the bytes for the speed, if we haven't yet.
+func (pr *progress) start() {
+	if pr.started.IsZero() {
+		pr.started = time.Now()
+		pr.from = pr.have
+	}
+}
+
 // reduce will convert the number of bytes into its human-readable value (less than 1024) with SI unit suffix appended.
+// Anything that isn't positive is 0B.
 func reduce(n int) string {
+	if n <= 0 {
+		return "0B"
+	}
+
 	index := int(math.Log2(float64(n))) / 10
+	if index >= len(units) {
+		index = len(units) - 1
+	}
 	n >>= (10 * index)
 
 	return strconv.Itoa(n) + units[index]
 }
+
+// parseSize converts a size with an optional unit, like the ones printed by reduce (e.g. "2M" or "1.1GiB"), into the
+// number of bytes.
+func parseSize(s string) (int, error) {
+	s = strings.TrimSuffix(s, "B")
+	s = strings.TrimSuffix(s, "i")
+
+	shift := uint(0)
+	for i, unit := range units[1:] {
+		if strings.HasSuffix(s, unit) {
+			s = strings.TrimSuffix(s, unit)
+			shift = uint(10 * (i + 1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n * float64(uint64(1)<<shift)), nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+func TestJoinURL(t *testing.T) {
+	tests := []struct {
+		mirror string
+		ref    string
+		want   string
+	}{
+		// Mirrors with and without a trailing slash
+		{"https://mirror.example.org/archlinux/iso/latest/", "archlinux-x86_64.iso",
+			"https://mirror.example.org/archlinux/iso/latest/archlinux-x86_64.iso"},
+		{"https://mirror.example.org/archlinux/iso/latest", "archlinux-x86_64.iso",
+			"https://mirror.example.org/archlinux/iso/latest/archlinux-x86_64.iso"},
+		{"https://mirror.example.org/archlinux/iso/latest/", "./archlinux-x86_64.iso",
+			"https://mirror.example.org/archlinux/iso/latest/archlinux-x86_64.iso"},
+		{"https://mirror.example.org/archlinux/iso/latest/", "archlinux-x86_64.iso.sig",
+			"https://mirror.example.org/archlinux/iso/latest/archlinux-x86_64.iso.sig"},
+		{"https://mirror.example.org/", "archlinux-x86_64.iso", "https://mirror.example.org/archlinux-x86_64.iso"},
+		{"https://mirror.example.org", "archlinux-x86_64.iso", "https://mirror.example.org/archlinux-x86_64.iso"},
+
+		// Links that are absolute paths or full URLs
+		{"https://mirror.example.org/archlinux/iso/latest/", "/archlinux/iso/2024.01.01/archlinux-x86_64.iso",
+			"https://mirror.example.org/archlinux/iso/2024.01.01/archlinux-x86_64.iso"},
+		{"https://mirror.example.org/archlinux/iso/latest", "/archlinux-x86_64.iso",
+			"https://mirror.example.org/archlinux-x86_64.iso"},
+		{"https://mirror.example.org/archlinux/iso/latest/", "https://cdn.example.org/archlinux-x86_64.iso",
+			"https://cdn.example.org/archlinux-x86_64.iso"},
+		{"https://mirror.example.org/archlinux/iso/latest/", "//cdn.example.org/archlinux-x86_64.iso",
+			"https://cdn.example.org/archlinux-x86_64.iso"},
+
+		// The parent directory, for listing other releases
+		{"https://mirror.example.org/archlinux/iso/latest/", "..", "https://mirror.example.org/archlinux/iso/"},
+		{"https://mirror.example.org/archlinux/iso/latest", "..", "https://mirror.example.org/archlinux/iso/"},
+
+		// Other kinds of mirrors
+		{"ftp://mirror.example.org/archlinux/iso/latest", "archlinux-x86_64.iso",
+			"ftp://mirror.example.org/archlinux/iso/latest/archlinux-x86_64.iso"},
+		{"file:///srv/archlinux/iso/latest", "archlinux-x86_64.iso",
+			"file:///srv/archlinux/iso/latest/archlinux-x86_64.iso"},
+	}
+
+	for _, tt := range tests {
+		got, err := joinURL(tt.mirror, tt.ref)
+		if err != nil {
+			t.Errorf("joinURL(%q, %q) returned error: %v", tt.mirror, tt.ref, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("joinURL(%q, %q) = %q, want %q", tt.mirror, tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestJoinURLInvalid(t *testing.T) {
+	if _, err := joinURL("https://mirror.example.org/%zz", "archlinux-x86_64.iso"); err == nil {
+		t.Error("joinURL accepted an invalid mirror")
+	}
+	if _, err := joinURL("https://mirror.example.org/", "%zz.iso"); err == nil {
+		t.Error("joinURL accepted an invalid link")
+	}
+}
+
+// These are directory listings of a mirror's iso/latest directory, as Apache, nginx, and lighttpd render them.
+var listings = []string{"apache.html", "nginx.html", "lighttpd.html"}
+
+func TestParseBody(t *testing.T) {
+	for _, name := range listings {
+		doc := parseListing(t, name)
+		if got, want := parseBody(doc), "archlinux-2024.01.01-x86_64.iso"; got != want {
+			t.Errorf("%v: parseBody() = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseLinks(t *testing.T) {
+	want := []string{"archlinux-2024.01.01-x86_64.iso.sig", "archlinux-x86_64.iso.sig"}
+	for _, name := range listings {
+		doc := parseListing(t, name)
+		got := parseLinks(doc, func(href string) bool {
+			return strings.HasSuffix(href, ".iso.sig")
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: parseLinks() = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseBodyNoISO(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<html><body><pre><a href="../">../</a>
+<a href="sha256sums.txt">sha256sums.txt</a>
+</pre></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseBody(doc); got != "" {
+		t.Errorf("parseBody() = %q, want \"\"", got)
+	}
+}
+
+// parseListing parses the directory listing in testdata.
+func parseListing(t *testing.T, name string) *html.Node {
+	t.Helper()
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	doc, err := html.Parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return doc
+}
+
+func TestReduce(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0B"},
+		{-1, "0B"},
+		{-5 << 20, "0B"},
+		{math.MinInt64, "0B"},
+		{1, "1B"},
+		{1023, "1023B"},
+		{1024, "1K"},
+		{1536, "1K"},
+		{312 << 20, "312M"},
+		{3 << 30, "3G"},
+		{1 << 40, "1024G"},
+		{math.MaxInt64, "8589934591G"},
+	}
+
+	for _, tt := range tests {
+		if got := reduce(tt.n); got != tt.want {
+			t.Errorf("reduce(%v) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadUnknownLength(t *testing.T) {
+	// Flushing before the handler returns makes the server send the body in chunks, without a Content-Length.
+	data := bytes.Repeat([]byte("flasharch"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		half := len(data) / 2
+		w.Write(data[:half])
+		w.(http.Flusher).Flush()
+		w.Write(data[half:])
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "archlinux-x86_64.iso")
+	if err := download(context.Background(), server.URL+"/archlinux-x86_64.iso", filename, nil); err != nil {
+		t.Fatalf("download() returned error: %v", err)
+	}
+	got, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %v bytes, want the %v bytes that were sent", len(got), len(data))
+	}
+}
+
+func TestProgressUnknownTotal(t *testing.T) {
+	b := newBoard([]string{"iso"})
+	p := progress{have: 312 << 20, r: b.reporter(0, "iso")}
+	p.print()
+	if got, want := b.lines[0], "iso  Received 312M"; got != want {
+		t.Errorf("progress without a total shows %q, want %q", got, want)
+	}
+
+	p.total = 1 << 30
+	p.print()
+	if got, want := b.lines[0], "iso  Received 312M of 1G"; got != want {
+		t.Errorf("progress with a total shows %q, want %q", got, want)
+	}
+}
+
+func TestMultiDownloadResume(t *testing.T) {
+	defer func(size int64) { chunkSize = size }(chunkSize)
+	chunkSize = 1 << 10
+
+	// Until the mirror is fixed, it fails every request past the first half of the file.
+	data := bytes.Repeat([]byte("flasharch"), 10*int(chunkSize)/9+1)
+	var broken, requests int32 = 1, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		if atomic.LoadInt32(&broken) == 1 && start >= int64(len(data))/2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&requests, 1)
+		}
+		w.Header().Set("ETag", `"flasharch"`)
+		http.ServeContent(w, r, "archlinux-x86_64.iso", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	url := server.URL + "/archlinux-x86_64.iso"
+	filename := filepath.Join(t.TempDir(), "archlinux-x86_64.iso.part.1")
+	if err := multiDownload(context.Background(), []string{url, url}, filename); err == nil {
+		t.Fatal("multiDownload() succeeded with a broken mirror")
+	}
+	_, done := readChunks(filename)
+	if len(done) != 11 || !done[0] || done[len(done)-1] {
+		t.Fatalf("kept chunks %v after the failure, want the first half of 11", done)
+	}
+	finished := 0
+	for _, ok := range done {
+		if ok {
+			finished++
+		}
+	}
+
+	atomic.StoreInt32(&broken, 0)
+	atomic.StoreInt32(&requests, 0)
+	if err := multiDownload(context.Background(), []string{url, url}, filename); err != nil {
+		t.Fatalf("multiDownload() returned error: %v", err)
+	}
+	if got, want := int(atomic.LoadInt32(&requests)), len(done)-finished; got != want {
+		t.Errorf("resumed download asked for %v chunks, want the %v that were missing", got, want)
+	}
+	got, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("resumed download doesn't match the file")
+	}
+	if sum := sha256.Sum256(data); getDigest(filename) != hex.EncodeToString(sum[:]) {
+		t.Errorf("resumed download was hashed as %v, want %x", getDigest(filename), sum)
+	}
+	if validator, _ := readResume(filename); validator != "" {
+		t.Error("finished download still has a resume file")
+	}
+}
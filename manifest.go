@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifest records what a run did: which ISO it used and where from, how the ISO was verified, which drives it was
+// flashed to, and when each phase happened. It's written next to the cached ISO and wherever --manifest says, so that
+// there's a record of exactly what was flashed.
+type manifest struct {
+	Flasharch string            `json:"flasharch"`
+	Release   string            `json:"release,omitempty"`
+	Mirror    string            `json:"mirror,omitempty"`
+	ISO       string            `json:"iso"`
+	SHA256    string            `json:"sha256"`
+	BLAKE2b   string            `json:"blake2b,omitempty"`
+	Signature manifestSig       `json:"signature"`
+	Device    *manifestDevice   `json:"device,omitempty"`
+	Devices   []*manifestDevice `json:"devices,omitempty"`
+	Phases    []manifestPhase   `json:"phases"`
+}
+
+// manifestSig records how the ISO's signature was checked.
+type manifestSig struct {
+	Verified    bool   `json:"verified"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Trust       string `json:"trust,omitempty"`
+	Result      string `json:"result"`
+}
+
+// manifestDevice identifies the drive that the ISO was flashed to, as far as the kernel and udev know it.
+type manifestDevice struct {
+	Path   string `json:"path"`
+	Vendor string `json:"vendor,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// manifestPhase records when a phase of the run started and finished.
+type manifestPhase struct {
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// This is what this run has done so far, for its manifest.
+var (
+	runRecord   manifest
+	runRecordMu sync.Mutex
+)
+
+// recordPhase records that the phase ran from started until now.
+func recordPhase(name string, started time.Time) {
+	runRecordMu.Lock()
+	defer runRecordMu.Unlock()
+
+	runRecord.Phases = append(runRecord.Phases, manifestPhase{name, started.UTC(), time.Now().UTC()})
+}
+
+// recordMirror records where the ISO came from.
+func recordMirror(mirror string) {
+	runRecordMu.Lock()
+	defer runRecordMu.Unlock()
+
+	runRecord.Mirror = mirror
+}
+
+// recordSig records how the ISO's signature was checked.
+func recordSig(sig manifestSig) {
+	runRecordMu.Lock()
+	defer runRecordMu.Unlock()
+
+	runRecord.Signature = sig
+}
+
+// recordSkipped records that the signature wasn't checked because of --skip-verify.
+func recordSkipped() {
+	result := "not checked (--skip-verify)"
+	if *sha256Flag != "" {
+		result += ", but the ISO matched --sha256"
+	}
+	recordSig(manifestSig{Result: result})
+}
+
+// recordCheck records the good signature that the check found.
+func recordCheck(check sigCheck) {
+	// A certification chain is spread over several lines for the terminal, but it reads fine on one.
+	trust := strings.Join(strings.Fields(check.trust()), " ")
+	recordSig(manifestSig{Verified: true, Fingerprint: check.signer(), Trust: trust, Result: "good signature"})
+}
+
+// manifestName returns where the manifest of the ISO goes when it's kept next to it.
+func manifestName(isoFile string) string {
+	return isoFile + ".manifest.json"
+}
+
+// writeManifests finishes this run's manifest for the ISO and the drives that it was flashed to, if any, and writes it
+// next to the cached ISO if it's cached and to --manifest if it was given. A single drive is recorded as the device,
+// and several are recorded as the devices.
+func writeManifests(ctx context.Context, isoFile string, usbs []string, cached bool) error {
+	if !cached && *manifestFlag == "" {
+		return nil
+	}
+
+	sum, err := fileDigest(isoFile)
+	if err != nil {
+		return err
+	}
+	b2Sum := getB2Digest(isoFile)
+	if b2Sum == "" && wantB2() {
+		if b2Sum, err = fileB2Digest(ctx, isoFile); err != nil {
+			return err
+		}
+	}
+
+	runRecordMu.Lock()
+	m := runRecord
+	runRecordMu.Unlock()
+	m.Flasharch = getVersion()
+	m.Release = isoVersion(isoFile)
+	m.ISO = isoFile
+	m.SHA256 = sum
+	m.BLAKE2b = b2Sum
+	if len(usbs) == 1 {
+		m.Device = deviceInfo(usbs[0])
+	} else {
+		for _, usb := range usbs {
+			m.Devices = append(m.Devices, deviceInfo(usb))
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if cached {
+		if err := ioutil.WriteFile(manifestName(isoFile), data, 0644); err != nil {
+			return err
+		}
+	}
+	if *manifestFlag != "" {
+		if err := ioutil.WriteFile(*manifestFlag, data, 0644); err != nil {
+			return err
+		}
+		fmt.Println("Wrote manifest to", *manifestFlag)
+	}
+
+	return nil
+}
+
+// readManifest reads the manifest that an earlier run left next to the ISO.
+func readManifest(isoFile string) (manifest, error) {
+	var m manifest
+	data, err := ioutil.ReadFile(manifestName(isoFile))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+
+	return m, err
+}
+
+// checkManifest looks for a manifest that an earlier run left next to the ISO and reports whether or not it says that
+// the ISO was verified and the ISO still has the checksum that it had then. If so, what the manifest says about the
+// signature and the mirror is carried over to this run's manifest.
+func checkManifest(isoFile string) bool {
+	m, err := readManifest(isoFile)
+	if err != nil || !m.Signature.Verified || m.SHA256 == "" {
+		return false
+	}
+	sum, err := fileDigest(isoFile)
+	if err != nil || !strings.EqualFold(sum, m.SHA256) {
+		return false
+	}
+
+	recordMirror(m.Mirror)
+	recordSig(m.Signature)
+
+	return true
+}
+
+// deviceInfo returns what the kernel and udev know about the drive: its vendor, model, and size from sysfs, and its
+// serial number from udev's database, since sysfs doesn't have one for most USB drives. Anything that can't be found
+// is left out.
+func deviceInfo(usb string) *manifestDevice {
+	d := &manifestDevice{Path: usb}
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return d
+	}
+	sys := filepath.Join("/sys/class/block", filepath.Base(dev))
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(sys, name))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	d.Vendor = read("device/vendor")
+	d.Model = read("device/model")
+	d.Serial = read("device/serial")
+	if sectors, err := strconv.ParseInt(read("size"), 10, 64); err == nil {
+		d.Size = sectors * 512
+	}
+
+	if d.Serial == "" {
+		d.Serial = udevProperty(read("dev"), "ID_SERIAL_SHORT")
+	}
+
+	return d
+}
+
+// removeManifest removes the manifest next to the ISO, for when the ISO is removed.
+func removeManifest(isoFile string) {
+	os.Remove(manifestName(isoFile))
+}
+
+// checkManifestFlag makes sure that the --manifest file can be written, so that we don't find out after flashing, and
+// makes its path absolute.
+func checkManifestFlag() error {
+	if *manifestFlag == "" {
+		return nil
+	}
+	if *streamFlag {
+		return fmt.Errorf("--manifest does not work with --stream")
+	}
+
+	path, err := filepath.Abs(*manifestFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --manifest: %v", err)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("invalid --manifest: %v", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("invalid --manifest: %v is not a directory", filepath.Dir(path))
+	}
+	*manifestFlag = path
+
+	return nil
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is where pacman keeps its list of mirrors on an Arch system.
+var mirrorlistPath = "/etc/pacman.d/mirrorlist"
+
+// These are the ports to connect to for mirrors that don't specify one.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+	"rsync": "873",
+}
+
+// This environment variable can hold the mirror to use instead of the official mirrorlist.
+var mirrorEnv = "FLASHARCH_MIRROR"
+
+// This is the official mirrorlist generator. It returns a pacman mirrorlist with every server commented out.
+var mirrorlistAPI = "https://archlinux.org/mirrorlist/"
+
+// mirrorList holds the mirrors given on the command line, in order.
+type mirrorList []string
+
+func (m *mirrorList) String() string {
+	return strings.Join(*m, ",")
+}
+
+// Set validates the mirror and adds it to the list.
+func (m *mirrorList) Set(value string) error {
+	mirror, err := parseMirror(value)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, mirror)
+
+	return nil
+}
+
+// getMirrors builds the ordered list of mirrors that we'll search for the ISO. In order of precedence, the mirrors come
+// from the --mirror flag, the --use-mirrorlist flag, the --auto-mirror flag, the FLASHARCH_MIRROR environment variable,
+// or the official mirrorlist. The default mirror is always at the end as a last resort.
+func getMirrors(ctx context.Context) ([]string, error) {
+	if isARM() {
+		return armMirrors()
+	}
+
+	var mirrors []string
+	switch env := os.Getenv(mirrorEnv); {
+	case len(mirrorFlag) > 0:
+		// Mirrors given on the command line always win.
+		for _, m := range mirrorFlag {
+			if *httpsOnlyFlag && !isHTTPS(m) && !isFile(m) {
+				return nil, fmt.Errorf("%v is not an https mirror", m)
+			}
+		}
+		fmt.Println("Using mirrors from --mirror")
+		mirrors = mirrorFlag
+	case *useMirrorlistFlag:
+		list, err := readMirrorlist(mirrorlistPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("no usable servers in %v", mirrorlistPath)
+		}
+		if *httpsOnlyFlag {
+			if list = filterHTTPS(list); len(list) == 0 {
+				return nil, fmt.Errorf("no https servers in %v", mirrorlistPath)
+			}
+		}
+		fmt.Println("Using mirrors from", mirrorlistPath)
+		mirrors = list
+	case *autoMirrorFlag:
+		// If we can't figure out where we are or find any mirrors there, we'll stick with the default.
+		country, reason, err := detectCountry(ctx)
+		if err != nil {
+			fmt.Println("Error detecting country:", err)
+			fmt.Println("Falling back to default mirror")
+			break
+		}
+		list, err := fetchMirrorlist(ctx, country)
+		if err != nil {
+			fmt.Println("Error fetching mirrorlist:", err)
+			fmt.Println("Falling back to default mirror")
+			break
+		}
+		if len(list) == 0 {
+			fmt.Println("No https mirrors found in", country+", falling back to default mirror")
+			break
+		}
+		fmt.Println("Using mirrors in", country, "(country from "+reason+")")
+		mirrors = list
+	case env != "":
+		// A bad mirror in the environment is most likely a typo, and we don't want to silently ignore it.
+		m, err := parseMirror(env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", mirrorEnv, err)
+		}
+		if *httpsOnlyFlag && !isHTTPS(m) && !isFile(m) {
+			return nil, fmt.Errorf("%v from %v is not an https mirror", m, mirrorEnv)
+		}
+		fmt.Println("Using mirror from", mirrorEnv)
+		mirrors = []string{m}
+	default:
+		// Ask archlinux.org for the current list of mirrors. If we can't reach it, we'll stick with the default.
+		list, err := fetchMirrorlist(ctx, *countryFlag)
+		if err != nil {
+			fmt.Println("Error fetching mirrorlist:", err)
+			fmt.Println("Falling back to default mirror")
+		} else if len(list) == 0 && *countryFlag != "" {
+			return nil, fmt.Errorf("no mirrors found for country %v", *countryFlag)
+		} else if len(list) > 0 {
+			fmt.Println("Using mirrors from", mirrorlistAPI)
+		}
+		mirrors = list
+	}
+
+	mirrors, err := appendMirror(mirrors, mirror)
+	if err != nil {
+		return nil, err
+	}
+	if *httpsOnlyFlag {
+		if mirrors = filterHTTPS(mirrors); len(mirrors) == 0 {
+			return nil, fmt.Errorf("no https mirrors")
+		}
+	}
+
+	// Point every mirror at the release we want.
+	if *releaseFlag != "" {
+		for i, m := range mirrors {
+			mirrors[i] = releaseDir(m, *releaseFlag)
+		}
+	}
+
+	return mirrors, nil
+}
+
+// releaseDir changes the mirror's directory from the latest release to the given version. Mirrors that don't point to
+// the latest release are returned unchanged.
+func releaseDir(mirror, version string) string {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return mirror
+	}
+
+	dir := strings.TrimSuffix(u.Path, "/")
+	if path.Base(dir) != "latest" {
+		return mirror
+	}
+	u.Path = path.Dir(dir) + "/" + version + "/"
+
+	return u.String()
+}
+
+// rankMirrors measures the round-trip time to every mirror concurrently and returns the mirrors sorted from fastest to
+// slowest, with https mirrors first. Mirrors that don't respond within the timeout are dropped. If none of them
+// respond, the list is returned as-is.
+func rankMirrors(ctx context.Context, mirrors []string, timeout time.Duration) []string {
+	type result struct {
+		mirror string
+		rtt    time.Duration
+		err    error
+	}
+
+	fmt.Println("Ranking", len(mirrors), "mirrors by latency")
+
+	// A HEAD request is enough to see how quickly the mirror answers without transferring anything. For rsync and FTP
+	// mirrors, we'll time how long it takes to connect to the server instead.
+	client := timeoutClient(timeout)
+	results := make([]result, len(mirrors))
+	var wg sync.WaitGroup
+	for i, mirror := range mirrors {
+		wg.Add(1)
+		go func(i int, mirror string) {
+			defer wg.Done()
+			start := time.Now()
+			if isFile(mirror) {
+				dir, err := localPath(mirror)
+				if err == nil {
+					_, err = os.Stat(dir)
+				}
+				results[i] = result{mirror, time.Since(start), err}
+				return
+			}
+			if !isHTTP(mirror) {
+				var conn net.Conn
+				u, err := url.Parse(mirror)
+				if err == nil {
+					ctx, cancel := context.WithTimeout(ctx, timeout)
+					conn, err = dialMirror(ctx, "tcp", hostPort(u))
+					cancel()
+				}
+				if err == nil {
+					conn.Close()
+				}
+				results[i] = result{mirror, time.Since(start), err}
+				return
+			}
+			req, err := http.NewRequestWithContext(ctx, "HEAD", mirror, nil)
+			if err == nil {
+				var resp *http.Response
+				if resp, err = client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+			results[i] = result{mirror, time.Since(start), err}
+		}(i, mirror)
+	}
+	wg.Wait()
+
+	// Keep only the mirrors that answered, fastest first.
+	var ranked []result
+	for _, r := range results {
+		if r.err == nil {
+			ranked = append(ranked, r)
+		}
+	}
+	if len(ranked) == 0 {
+		fmt.Println("No mirrors responded within", timeout, "- using them in the given order")
+		return mirrors
+	}
+	// We'd rather use an https mirror, even if it's a bit slower.
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if a, b := isHTTPS(ranked[i].mirror), isHTTPS(ranked[j].mirror); a != b {
+			return a
+		}
+		return ranked[i].rtt < ranked[j].rtt
+	})
+
+	if dropped := len(mirrors) - len(ranked); dropped > 0 {
+		fmt.Println("Dropped", dropped, "mirrors that did not respond within", timeout)
+	}
+	fmt.Println("Fastest mirror:", ranked[0].mirror, "("+ranked[0].rtt.Round(time.Millisecond).String()+")")
+
+	mirrors = make([]string, len(ranked))
+	for i, r := range ranked {
+		mirrors[i] = r.mirror
+	}
+
+	return mirrors
+}
+
+// probeMirrors downloads the first size bytes of the ISO from each of the first count mirrors concurrently and returns
+// the mirrors sorted by measured throughput, followed by the unprobed mirrors in their original order. Mirrors whose
+// probe fails are moved to the end. The probed bytes are also returned, keyed by the ISO's URL, so that the real
+// download can pick up where the probe left off.
+func probeMirrors(ctx context.Context, mirrors []string, count int, size int,
+	timeout time.Duration) ([]string, map[string][]byte) {
+	type result struct {
+		mirror string
+		url    string
+		data   []byte
+		speed  float64 // bytes per second
+		err    error
+	}
+
+	if count > len(mirrors) {
+		count = len(mirrors)
+	}
+	fmt.Println("Measuring throughput of", count, "mirrors")
+
+	client := timeoutClient(timeout)
+	results := make([]result, count)
+	var wg sync.WaitGroup
+	for i, mirror := range mirrors[:count] {
+		wg.Add(1)
+		go func(i int, mirror string) {
+			defer wg.Done()
+			results[i] = result{mirror: mirror}
+			if !isHTTP(mirror) {
+				results[i].err = fmt.Errorf("throughput can only be measured over http(s)")
+				return
+			}
+
+			filename, _, err := getFilename(ctx, mirror)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			if results[i].url, err = joinURL(mirror, filename); err != nil {
+				results[i].err = err
+				return
+			}
+
+			// Only ask for the beginning of the ISO. If the server ignores the range, we'll stop reading early.
+			req, err := http.NewRequestWithContext(ctx, "GET", results[i].url, nil)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 && resp.StatusCode != 206 {
+				results[i].err = fmt.Errorf("%v", resp.Status)
+				return
+			}
+
+			data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(size)))
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			if len(data) == 0 {
+				results[i].err = fmt.Errorf("empty response")
+				return
+			}
+			results[i].data = data
+			results[i].speed = float64(len(data)) / time.Since(start).Seconds()
+		}(i, mirror)
+	}
+	wg.Wait()
+
+	// Sort the successful probes by speed, fastest first.
+	var ranked, failed []result
+	for _, r := range results {
+		if r.err == nil {
+			ranked = append(ranked, r)
+		} else {
+			failed = append(failed, r)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].speed > ranked[j].speed
+	})
+
+	heads := make(map[string][]byte)
+	ordered := make([]string, 0, len(mirrors))
+	for _, r := range ranked {
+		fmt.Printf("\t%v/s\t%v\n", reduce(int(r.speed)), r.mirror)
+		heads[r.url] = r.data
+		ordered = append(ordered, r.mirror)
+	}
+	for _, r := range failed {
+		fmt.Printf("\tfailed\t%v (%v)\n", r.mirror, r.err)
+	}
+	ordered = append(ordered, mirrors[count:]...)
+	for _, r := range failed {
+		ordered = append(ordered, r.mirror)
+	}
+
+	return ordered, heads
+}
+
+// mirrorAge returns how long it has been since the mirror last synced with the main Arch server. Every mirror has a
+// lastsync file at its root, two levels above the release directory, that holds the time of the last sync.
+func mirrorAge(ctx context.Context, mirror string) (time.Duration, error) {
+	url, err := joinURL(mirror, "../../lastsync")
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("%v", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return 0, err
+	}
+
+	// The time is stored as seconds since the epoch.
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lastsync: %v", err)
+	}
+
+	return time.Since(time.Unix(seconds, 0)), nil
+}
+
+// checkFreshness makes sure that the mirror has synced recently enough to have the latest release. If the mirror is
+// stale and it's our last option, the user can decide to use it anyway. Mirrors that we can't check are assumed to be
+// fresh, and so is Arch Linux ARM, whose mirrors don't have a lastsync file.
+func checkFreshness(ctx context.Context, mirror string, last bool) error {
+	if !isHTTP(mirror) || isARM() {
+		return nil
+	}
+
+	age, err := mirrorAge(ctx, mirror)
+	if err != nil {
+		fmt.Println("Error checking freshness of mirror:", err)
+		return nil
+	}
+	if age <= *maxAgeFlag {
+		return nil
+	}
+
+	stale := fmt.Sprintf("mirror last synced %d hours ago", int(age.Hours()))
+	if !last {
+		return fmt.Errorf("%v", stale)
+	}
+	if *allowStaleFlag {
+		fmt.Println("Warning:", stale)
+		return nil
+	}
+
+	ok, err := confirm("Warning: " + stale + ". Use it anyway?")
+	if err != nil {
+		return fmt.Errorf("%v (use --allow-stale to use it anyway)", stale)
+	}
+	if !ok {
+		return fmt.Errorf("%v", stale)
+	}
+
+	return nil
+}
+
+// isHTTPS reports whether or not the URL points to an https mirror.
+func isHTTPS(url string) bool {
+	return strings.HasPrefix(url, "https://")
+}
+
+// filterHTTPS removes every mirror that isn't an https mirror or a local directory from the list.
+func filterHTTPS(mirrors []string) []string {
+	var filtered []string
+	for _, m := range mirrors {
+		if isHTTPS(m) || isFile(m) {
+			filtered = append(filtered, m)
+		} else {
+			fmt.Println("Skipping non-https mirror", m)
+		}
+	}
+
+	return filtered
+}
+
+// checkRedirect enforces --https-only on redirects. Otherwise, it follows Go's default policy of giving up after 10
+// redirects.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if *httpsOnlyFlag && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing redirect to non-https URL %v", req.URL)
+	}
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+
+	return nil
+}
+
+// isHTTP reports whether or not the URL points to an http or https mirror.
+func isHTTP(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// hostPort returns the host and port of the server in the URL, using the scheme's default port if none is given.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), defaultPorts[u.Scheme])
+}
+
+// appendMirror validates the mirror and adds it to the end of the list if it isn't already there.
+func appendMirror(mirrors []string, mirror string) ([]string, error) {
+	mirror, err := parseMirror(mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mirrors {
+		if m == mirror {
+			return mirrors, nil
+		}
+	}
+
+	return append(mirrors, mirror), nil
+}
+
+// fetchMirrorlist downloads the official mirrorlist of https servers, optionally restricted to a comma-separated list
+// of country codes, and returns the ISO directory of each server, in order.
+func fetchMirrorlist(ctx context.Context, countries string) ([]string, error) {
+	query := url.Values{}
+	query.Set("protocol", "https")
+	query.Set("ip_version", "4")
+	for _, country := range strings.Split(countries, ",") {
+		if country = strings.TrimSpace(country); country != "" {
+			query.Add("country", strings.ToUpper(country))
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", mirrorlistAPI+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%v", resp.Status)
+	}
+
+	// Every server in the generated list is commented out so that the user can pick which ones to enable. We want
+	// all of them.
+	return parseMirrorlist(resp.Body, true)
+}
+
+// readMirrorlist reads a pacman mirrorlist and returns the ISO directory of each uncommented server, in order.
+func readMirrorlist(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseMirrorlist(file, false)
+}
+
+// parseMirrorlist parses a pacman mirrorlist and returns the ISO directory of each server, in order. If uncomment is
+// true, servers that have been commented out are included too.
+func parseMirrorlist(r io.Reader, uncomment bool) ([]string, error) {
+	var mirrors []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if uncomment {
+			line = strings.TrimPrefix(strings.TrimSpace(line), "#")
+		}
+		if mirror := parseMirrorlistLine(line); mirror != "" {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+
+	return mirrors, scanner.Err()
+}
+
+// parseMirrorlistLine pulls the server out of one line of a pacman mirrorlist and converts it into the URL of the
+// mirror's latest ISO directory. Comments, blank lines, and anything that isn't a valid server entry return "".
+func parseMirrorlistLine(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+
+	// Server lines look like this: "Server = https://mirror.example.org/archlinux/$repo/os/$arch"
+	fields := strings.SplitN(line, "=", 2)
+	if len(fields) != 2 || strings.TrimSpace(fields[0]) != "Server" {
+		return ""
+	}
+	server := strings.TrimSpace(fields[1])
+
+	// The repository path is what pacman fills in. We only want the base of the mirror.
+	if !strings.HasSuffix(server, "$repo/os/$arch") {
+		return ""
+	}
+	server = strings.TrimSuffix(server, "$repo/os/$arch")
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+
+	mirror, err := parseMirror(server + "iso/latest/")
+	if err != nil {
+		return ""
+	}
+
+	return mirror
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// mountInfo is where the kernel lists every mount that we can see.
+var mountInfo = "/proc/self/mountinfo"
+
+// mount is a mounted file system on the drive: the device it's on and where it's mounted.
+type mount struct {
+	device string
+	target string
+}
+
+// These bound how long we'll keep trying to unmount a busy file system.
+var (
+	unmountTries = 5
+	unmountDelay = time.Second
+)
+
+// checkMounts makes sure that nothing on the USB drive is mounted, because writing over a mounted file system corrupts
+// it underneath whatever is using it. Desktops mount drives as soon as they're plugged in, so we'll offer to unmount
+// them, or just do it with --unmount. Otherwise, every mount is listed in the error. --force flashes the drive anyway.
+func checkMounts(usb string) error {
+	mounts, err := driveMounts(usb)
+	if err != nil {
+		return fmt.Errorf("error checking for mounted partitions: %v", err)
+	}
+	if len(mounts) == 0 {
+		return nil
+	}
+
+	var list []string
+	for _, m := range mounts {
+		list = append(list, m.device+" on "+m.target)
+	}
+	msg := fmt.Sprintf("%v has mounted partitions:\n\t%v", usb, strings.Join(list, "\n\t"))
+	switch {
+	case *unmountFlag:
+		fmt.Println(msg)
+		return unmountDrive(usb, mounts)
+	case *forceFlag:
+		return enforce("mounted partitions", checkForceable, errors.New(msg))
+	}
+
+	fmt.Println(msg)
+	ok, err := confirm("Unmount them?")
+	switch {
+	case err != nil:
+		return fmt.Errorf("%v (pass --unmount to unmount them, or --force to flash the drive anyway)", err)
+	case !ok:
+		return fmt.Errorf("not flashing a drive with mounted partitions (pass --force to flash it anyway)")
+	}
+
+	return unmountDrive(usb, mounts)
+}
+
+// unmountDrive unmounts everything in mounts, newest first so that nested mounts come off before what they're mounted
+// on, and makes sure that nothing is left mounted from the drive. If anything can't be unmounted, the drive mustn't
+// be touched.
+func unmountDrive(usb string, mounts []mount) error {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		m := mounts[i]
+		if err := unmount(m); err != nil {
+			return fmt.Errorf("error unmounting %v from %v, not flashing: %v", m.device, m.target, err)
+		}
+		fmt.Println("Unmounted", m.device, "from", m.target)
+	}
+
+	left, err := driveMounts(usb)
+	if err != nil {
+		return fmt.Errorf("error checking for mounted partitions: %v", err)
+	}
+	if len(left) > 0 {
+		return fmt.Errorf("%v is still mounted on %v, not flashing", left[0].device, left[0].target)
+	}
+
+	return nil
+}
+
+// unmount unmounts the file system. The unmount system call only works for root, so udisksctl, which lets users unmount
+// what their desktop mounted for them, and umount are tried after it. A busy file system is given a few more chances,
+// in case whatever was using it is about to let go.
+func unmount(m mount) error {
+	var err error
+	for try := 0; try < unmountTries; try++ {
+		if try > 0 {
+			time.Sleep(unmountDelay)
+		}
+		err = syscall.Unmount(m.target, 0)
+		if err == nil {
+			return nil
+		}
+		busy := errors.Is(err, syscall.EBUSY)
+		if _, lerr := exec.LookPath("udisksctl"); lerr == nil {
+			cmd := exec.Command("udisksctl", "unmount", "--no-user-interaction", "-b", m.device)
+			output, cerr := cmd.CombinedOutput()
+			if cerr == nil {
+				return nil
+			}
+			err = fmt.Errorf("%v", strings.TrimSpace(string(output)))
+			busy = busy || strings.Contains(err.Error(), "busy")
+		}
+		if _, lerr := exec.LookPath("umount"); lerr == nil {
+			output, cerr := exec.Command("umount", m.target).CombinedOutput()
+			if cerr == nil {
+				return nil
+			}
+			err = fmt.Errorf("%v", strings.TrimSpace(string(output)))
+			busy = busy || strings.Contains(err.Error(), "busy")
+		}
+		if !busy {
+			break
+		}
+	}
+
+	return err
+}
+
+// driveMounts returns everything that's mounted from the drive or any of its partitions.
+func driveMounts(usb string) ([]mount, error) {
+	names, _ := drivePartitions(usb)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	all, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	var mounts []mount
+	for _, m := range all {
+		if m.device != "" && names[filepath.Base(m.device)] {
+			mounts = append(mounts, m)
+		}
+	}
+
+	return mounts, nil
+}
+
+// readMounts returns every mount that we can see, with the block device that each one is on, or "" for the ones that
+// aren't on one (like proc or tmpfs).
+func readMounts() ([]mount, error) {
+	data, err := ioutil.ReadFile(mountInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []mount
+	for _, line := range strings.Split(string(data), "\n") {
+		// Each line looks like this, with the fields after the separator describing the file system:
+		// "36 35 8:17 / /run/media/user/ARCH rw,nosuid - vfat /dev/sdb1 rw"
+		fields := strings.Fields(line)
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+3 {
+			continue
+		}
+		device := ""
+		if name := mountDevice(fields[2], fields[sep+2]); name != "" {
+			device = "/dev/" + name
+		}
+		mounts = append(mounts, mount{device, unescapeMount(fields[4])})
+	}
+
+	return mounts, nil
+}
+
+// mountDevice returns the kernel's name for the block device that a mount with the given device number and source is
+// on, or "" if it isn't on one. The source is tried first, because some file systems (like btrfs) report a device
+// number of their own, and then the device number, which survives renames and covers sources like /dev/root that don't
+// exist.
+func mountDevice(number, source string) string {
+	if strings.HasPrefix(source, "/dev/") {
+		if resolved, err := filepath.EvalSymlinks(source); err == nil {
+			name := filepath.Base(resolved)
+			if _, err := os.Stat(filepath.Join("/sys/class/block", name)); err == nil {
+				return name
+			}
+		}
+	}
+	if link, err := os.Readlink(filepath.Join("/sys/dev/block", number)); err == nil {
+		return filepath.Base(link)
+	}
+
+	return ""
+}
+
+// drivePartitions returns the kernel's names for the drive and each of its partitions (like sdb, sdb1, and sdb2, or
+// mmcblk0 and mmcblk0p1), and their names keyed by device number. A drive that isn't a block device has neither.
+func drivePartitions(usb string) (map[string]bool, map[string]string) {
+	names := make(map[string]bool)
+	numbers := make(map[string]string)
+
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return names, numbers
+	}
+	name := filepath.Base(dev)
+	sys := filepath.Join("/sys/class/block", name)
+	if _, err := os.Stat(sys); err != nil {
+		return names, numbers
+	}
+
+	add := func(name, dir string) {
+		names[name] = true
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "dev")); err == nil {
+			numbers[strings.TrimSpace(string(data))] = name
+		}
+	}
+	add(name, sys)
+	entries, _ := ioutil.ReadDir(sys)
+	for _, entry := range entries {
+		dir := filepath.Join(sys, entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+			add(entry.Name(), dir)
+		}
+	}
+
+	return names, numbers
+}
+
+// unescapeMount undoes the octal escapes that the kernel puts in mount points for spaces, tabs, newlines, and
+// backslashes.
+func unescapeMount(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
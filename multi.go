@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// When downloading from several mirrors at once, the file is split into chunks of this many bytes.
+var chunkSize int64 = 8 << 20
+
+// fetchMulti downloads the ISO from up to n mirrors at once, with each mirror supplying different chunks of the file,
+// and downloads its signature alongside from the first of those mirrors that has it. If there aren't at least two
+// mirrors that can take part, the mirrors are tried one at a time instead. It returns the paths to the ISO and
+// signature files. If anything goes wrong, no files are left on disk, except for a partial download that a later run
+// can resume.
+func fetchMulti(ctx context.Context, mirrors []string, n int) (string, string, error) {
+	// Only http mirrors can serve ranges of the file.
+	var filename, sum, source string
+	var urls []string
+	for _, mirror := range mirrors {
+		if !isHTTP(mirror) {
+			continue
+		}
+		if filename == "" {
+			f, s, err := getFilename(ctx, mirror)
+			if err != nil {
+				fmt.Println("Error using mirror", mirror+":", err)
+				continue
+			}
+			filename, sum, source = f, s, mirror
+		}
+		url, err := joinURL(mirror, filename)
+		if err != nil {
+			continue
+		}
+		urls = append(urls, url)
+		if len(urls) == n {
+			break
+		}
+	}
+	if len(urls) < 2 {
+		fmt.Println("Not enough mirrors to download from at once, trying them one at a time")
+		return fetchFirst(ctx, mirrors, nil)
+	}
+	if compression(filename) != "" {
+		fmt.Println("Compressed images can't be downloaded from several mirrors at once, trying them one at a time")
+		return fetchFirst(ctx, mirrors, nil)
+	}
+
+	filename = path.Base(filename)
+	isoFile, err := partFile(downloadDir + "/" + filename)
+	if err != nil {
+		return "", "", err
+	}
+	sigFile, err := partFile(downloadDir + "/" + filename + ".sig")
+	if err != nil {
+		removeDownload(isoFile)
+		return "", "", err
+	}
+	if err := checkSpace(ctx, urls[0], isoFile); err != nil {
+		removeDownload(isoFile)
+		removeDownload(sigFile)
+		return "", "", err
+	}
+
+	// Start on the signature. If no mirror has it, there's no point in downloading the ISO.
+	isoCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	waitSig := fetchSig(ctx, cancel, sigURLs(filename, urls...), sigFile)
+
+	// Download the ISO.
+	fmt.Println("Downloading", filename, "and its signature from", len(urls), "mirrors ...")
+	err = multiDownload(isoCtx, repeat(urls, *connectionsFlag), isoFile)
+	fmt.Printf("\n") // Flush last progress line.
+	if err != nil {
+		err = fmt.Errorf("error downloading ISO: %v", timeoutError(ctx, err, "downloading the ISO", "every mirror"))
+		if isoCtx.Err() != nil && ctx.Err() == nil {
+			err = waitSig()
+		}
+	}
+	cancel()
+	if sigErr := waitSig(); err == nil {
+		err = sigErr
+	}
+	if err != nil {
+		removeDownload(sigFile)
+		if validator, _ := readResume(isoFile); validator == "" {
+			removeDownload(isoFile)
+		}
+		return "", "", err
+	}
+	if err := sniffFile(isoFile); err != nil {
+		removeDownload(isoFile)
+		removeDownload(sigFile)
+		return "", "", err
+	}
+	fmt.Println("Download complete")
+	if sum := getDigest(isoFile); sum != "" {
+		fmt.Println("SHA-256:", sum)
+	}
+	recordMirror(strings.Join(urls, " "))
+
+	// If we know what the checksum should be, make sure the mirrors sent us the right file.
+	if err := verifyChecksums(ctx, isoFile, checksums(ctx, source, filename, sum)); err != nil {
+		removeDownload(isoFile)
+		removeDownload(sigFile)
+		return "", "", err
+	}
+
+	return isoFile, sigFile, nil
+}
+
+// segmentedDownload downloads the file at the url over n connections at once, with each connection supplying different
+// chunks of the file. If the server can't send parts of the file, it's downloaded over a single connection instead.
+func segmentedDownload(ctx context.Context, url, filename string, n int, head []byte) error {
+	if !acceptsRanges(ctx, url) {
+		fmt.Println("Mirror can't send parts of the file, using one connection")
+		return downloadFile(ctx, url, filename, head)
+	}
+
+	err := multiDownload(ctx, repeat([]string{url}, n), filename)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	fmt.Printf("\n") // Flush last progress line.
+	fmt.Println("Error downloading over", n, "connections:", err)
+	fmt.Println("Falling back to one connection")
+
+	return downloadFile(ctx, url, filename, head)
+}
+
+// acceptsRanges asks the server for the first byte of the file to see if it can send parts of it.
+func acceptsRanges(ctx context.Context, url string) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == 206
+}
+
+// repeat returns a list with each of the urls repeated n times, so that each one gets n connections.
+func repeat(urls []string, n int) []string {
+	var list []string
+	for _, url := range urls {
+		for i := 0; i < n; i++ {
+			list = append(list, url)
+		}
+	}
+
+	return list
+}
+
+// multiDownload downloads the file from all of the urls at once and reassembles it on disk. A url can be listed more
+// than once to open several connections to it. Mirrors that report a different size than the first one and
+// connections that fail partway through are dropped, and their chunks are handed to the connections that are still
+// healthy. Like with downloadFile, the finished chunks are kept if the download fails, as long as the mirrors can tell
+// us which version of the file they have, and a later run only downloads the rest.
+func multiDownload(ctx context.Context, urls []string, filename string) (err error) {
+	// Find out how big the file is, and which version of it the mirrors have.
+	size := int64(-1)
+	var sources []string
+	var validator string
+	validators := make(map[string]bool)
+	checked := make(map[string]bool)
+	for _, url := range urls {
+		if ok, seen := checked[url]; seen {
+			if ok {
+				sources = append(sources, url)
+			}
+			continue
+		}
+		checked[url] = false
+
+		req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Println("Skipping", url+":", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 || resp.ContentLength <= 0 {
+			fmt.Println("Skipping", url+":", resp.Status)
+			continue
+		}
+		if size < 0 {
+			size = resp.ContentLength
+		}
+		if resp.ContentLength != size {
+			fmt.Println("Skipping", url+":", "reported size", resp.ContentLength, "instead of", size)
+			continue
+		}
+		checked[url] = true
+		sources = append(sources, url)
+		for _, v := range []string{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")} {
+			if v != "" && validator == "" {
+				validator = v
+			}
+			validators[v] = v != ""
+		}
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no mirror reported the size of the file")
+	}
+
+	// Create a save point big enough to hold everything, holding on to anything that a previous run left behind.
+	trackDownload(filename)
+	setDigest(filename, "")
+	setB2Digest(filename, "")
+	removeValidators(filename)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	keep := false
+	defer func() {
+		file.Close()
+		if err != nil && !keep {
+			os.Remove(filename)
+			removeResume(filename)
+		}
+	}()
+
+	// If a previous run left part of the file behind and the mirrors still have the same version of it, we'll skip the
+	// chunks that it finished. A download over one connection finished the ones at the start.
+	chunks := (size + chunkSize - 1) / chunkSize
+	done := make([]bool, chunks)
+	if stored, total := readResume(filename); validators[stored] && total == size {
+		if storedSize, storedDone := readChunks(filename); storedDone == nil {
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			for i := range done {
+				done[i] = chunkEnd(int64(i), size) <= info.Size()
+			}
+		} else if storedSize == chunkSize {
+			done = storedDone
+		}
+	} else if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+
+	// Remember which chunks are finished, in case the download is interrupted. Without an ETag or a date, we wouldn't
+	// be able to tell if the file changed, so there's no point in keeping a partial download around.
+	if validator != "" {
+		if err := writeChunks(filename, validator, size, chunkSize, done); err == nil {
+			keep = true
+		}
+	} else {
+		removeResume(filename)
+	}
+
+	// Queue up every chunk that isn't finished yet. There's room in the queue for all of them, so a failed chunk can
+	// always be put back.
+	queue := make(chan int64, chunks)
+	p := progress{total: int(size)}
+	remaining := int64(0)
+	for i, ok := range done {
+		if ok {
+			p.have += int(chunkEnd(int64(i), size) - int64(i)*chunkSize)
+			continue
+		}
+		queue <- int64(i) * chunkSize
+		remaining++
+	}
+	if p.have > 0 {
+		fmt.Println("Resuming download with", reduce(p.have), "already done")
+	}
+	if remaining == 0 {
+		close(queue)
+	}
+
+	// Hash the chunks in order as they're finished, so that the checksums are ready as soon as the last one is. The
+	// chunks that we already have are first in line.
+	h := sha256.New()
+	hashes := []io.Writer{h}
+	b2, err := startB2Digest(ctx)
+	if err != nil {
+		return err
+	}
+	if b2 != nil {
+		defer b2.Close()
+		hashes = append(hashes, b2)
+	}
+	finished := make(chan int64, chunks)
+	for i, ok := range done {
+		if ok {
+			finished <- int64(i)
+		}
+	}
+	hashed := make(chan error, 1)
+	go func() {
+		hashed <- hashChunks(io.MultiWriter(hashes...), file, size, finished)
+	}()
+
+	// Each connection gets its own worker that keeps pulling chunks until they're all done or the connection fails.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, url := range sources {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			for {
+				var offset int64
+				select {
+				case o, ok := <-queue:
+					if !ok {
+						return
+					}
+					offset = o
+				case <-ctx.Done():
+					return
+				}
+
+				length := chunkSize
+				if offset+length > size {
+					length = size - offset
+				}
+
+				if err := downloadChunk(ctx, url, file, offset, length); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					mu.Lock()
+					fmt.Printf("\nDropping connection to %v: %v\n", url, err)
+					mu.Unlock()
+					queue <- offset
+					return
+				}
+
+				mu.Lock()
+				p.have += int(length)
+				p.print()
+				done[offset/chunkSize] = true
+				if keep {
+					writeChunks(filename, validator, size, chunkSize, done)
+				}
+				mu.Unlock()
+				finished <- offset / chunkSize
+
+				if atomic.AddInt64(&remaining, -1) == 0 {
+					close(queue)
+				}
+			}
+		}(url)
+	}
+	wg.Wait()
+	close(finished)
+	hashErr := <-hashed
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if atomic.LoadInt64(&remaining) > 0 {
+		return fmt.Errorf("every connection failed")
+	}
+	if hashErr != nil {
+		return hashErr
+	}
+
+	// Make sure we ended up with the whole file.
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("expected %v bytes, got %v", size, info.Size())
+	}
+	removeResume(filename)
+	setDigest(filename, hex.EncodeToString(h.Sum(nil)))
+
+	return finishB2Digest(b2, filename)
+}
+
+// hashChunks writes the chunks of the file to h in order. The downloads finish them in any order and send their numbers
+// on finished, so a chunk waits until every one before it is hashed. It stops once the whole file is hashed or there
+// are no more chunks coming.
+func hashChunks(h io.Writer, file *os.File, size int64, finished <-chan int64) error {
+	ready := make([]bool, (size+chunkSize-1)/chunkSize)
+	next := 0
+	for i := range finished {
+		ready[i] = true
+		for ; next < len(ready) && ready[next]; next++ {
+			offset := int64(next) * chunkSize
+			if _, err := io.Copy(h, io.NewSectionReader(file, offset, chunkEnd(int64(next), size)-offset)); err != nil {
+				return err
+			}
+		}
+		if next == len(ready) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("download stopped before the whole file was hashed")
+}
+
+// chunkEnd returns the offset just past the end of chunk i of a file of the given size.
+func chunkEnd(i, size int64) int64 {
+	if end := (i + 1) * chunkSize; end < size {
+		return end
+	}
+
+	return size
+}
+
+// downloadChunk downloads length bytes of the file at the url, starting at offset, and writes them to the same place in
+// file.
+func downloadChunk(ctx context.Context, url string, file *os.File, offset, length int64) (err error) {
+	stall := newStallWatcher(ctx)
+	defer func() {
+		if serr := stall.stop(); serr != nil {
+			err = serr
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(stall.ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Make sure we got exactly the part we asked for.
+	if resp.StatusCode != 206 {
+		return fmt.Errorf("range request failed: %v", resp.Status)
+	}
+	if resp.ContentLength != length {
+		return fmt.Errorf("expected %v bytes, got %v", length, resp.ContentLength)
+	}
+
+	buf := make([]byte, length)
+	stall.start()
+	if _, err := io.ReadFull(io.TeeReader(limitReader(resp.Body), stall), buf); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(buf, offset)
+
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// offlineTransport is the transport for --offline, which refuses every request. Nothing should get this far, because
+// checkOffline makes sure up front that everything we need is on disk, but this makes sure that nothing slips out.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("not connecting to %v because of --offline", req.URL.Host)
+}
+
+// parseFlash handles the flash subcommand, which flashes an ISO that we already have like --iso does, with the ISO
+// and the drives given in order: "flash /path/to/iso /dev/sdb". Options can come after flash or the ISO too, so the
+// arguments are parsed again from each of them, which leaves the drives as the arguments.
+func parseFlash() error {
+	if *isoFlag != "" {
+		return fmt.Errorf("flash takes the path to the ISO instead of --iso")
+	}
+	flag.CommandLine.Parse(flag.Args()[1:])
+	if flag.NArg() == 0 {
+		return fmt.Errorf("flash needs the path to an ISO")
+	}
+	*isoFlag = flag.Arg(0)
+	flag.CommandLine.Parse(flag.Args()[1:])
+
+	return nil
+}
+
+// checkISOFlag makes sure that the ISO given with --iso is a file that looks like an Arch ISO, and makes its path
+// absolute. This happens before anything else, so that a wrong path doesn't get as far as asking about the drive.
+func checkISOFlag() error {
+	switch {
+	case *isoFlag == "":
+		return nil
+	case *streamFlag || *torrentFlag:
+		return fmt.Errorf("--iso does not work with --stream or --torrent")
+	case *downloadOnlyFlag:
+		return fmt.Errorf("--iso does not work with --download-only; use verify instead")
+	case isARM():
+		return fmt.Errorf("--iso does not work with Arch Linux ARM")
+	}
+
+	path, err := filepath.Abs(*isoFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --iso: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("invalid --iso: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("invalid --iso: %v is not a file", path)
+	}
+	if err := enforce("ISO", checkForceable, checkISO(path)); err != nil {
+		return fmt.Errorf("invalid --iso: %v", err)
+	}
+	*isoFlag = path
+
+	return nil
+}
+
+// checkOffline makes sure that everything that --offline needs is on disk, since nothing can be downloaded, and lists
+// whatever is missing.
+func checkOffline(ctx context.Context) error {
+	if !*offlineFlag || restoring || benchmarking {
+		return nil
+	}
+
+	iso := *isoFlag
+	if flag.Arg(0) == "verify" {
+		iso = flag.Arg(1)
+	}
+	switch {
+	case *streamFlag || *torrentFlag:
+		return fmt.Errorf("--offline does not work with --stream or --torrent")
+	case *downloadOnlyFlag:
+		return fmt.Errorf("--offline does not work with --download-only")
+	case isARM():
+		return fmt.Errorf("--offline does not work with Arch Linux ARM")
+	}
+
+	var needed []string
+	switch {
+	case iso == "":
+		needed = append(needed, "--iso /path/to/archlinux-<version>-x86_64.iso: the ISO to flash")
+	case *skipVerifyFlag:
+		// Nothing will be verified, so nothing else is needed.
+	default:
+		sigFile := iso + ".sig"
+		if _, err := os.Stat(sigFile); err != nil {
+			needed = append(needed, sigFile+": the ISO's signature, next to it")
+		} else if key := offlineKeyNeeded(ctx, sigFile); key != "" {
+			needed = append(needed, key)
+		}
+	}
+	if len(needed) > 0 {
+		return fmt.Errorf("--offline can't download anything, so it needs these too:\n\t%v",
+			strings.Join(needed, "\n\t"))
+	}
+
+	return nil
+}
+
+// offlineKeyNeeded returns what's needed to check the signature without fetching a key, or "" if we already have the
+// key.
+func offlineKeyNeeded(ctx context.Context, sigFile string) string {
+	switch {
+	case *keyringFlag != "":
+		return ""
+	case !useGPG():
+		return ""
+	}
+
+	key := sigIssuer(sigFile)
+	if key == "" || haveKey(ctx, key) {
+		return ""
+	}
+
+	return "--keyring /path/to/key.asc: signing key " + key + ", which isn't in your gpg keyring"
+}
+
+// verifyLocalISO verifies the ISO given with --iso the same way that the verify subcommand does, so that it can be
+// flashed.
+func verifyLocalISO(ctx context.Context) error {
+	fmt.Println("Using ISO", *isoFlag)
+	defer recordPhase("verify", time.Now())
+	if *skipVerifyFlag {
+		if err := checkPinnedSum(ctx, *isoFlag); err != nil {
+			return err
+		}
+		recordSkipped()
+		return skipVerification(*isoFlag)
+	}
+
+	return verifyCmd(ctx, *isoFlag)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Signatures are checked against the release signing keys that are built into flasharch with ProtonMail's OpenPGP
+// library, so that gpg isn't needed. The built-in keys are trusted because they're built in, but they still have to be
+// pinned.
+
+// The built-in keyring only needs to be parsed once per run.
+var (
+	keyringOnce sync.Once
+	keyring     openpgp.EntityList
+	keyringErr  error
+)
+
+// pgpCheck checks whatever is written to it against a signature from a built-in key. The data goes through a pipe to
+// the OpenPGP library as it's written, and the library's verdict is waited for when the check is closed.
+type pgpCheck struct {
+	*io.PipeWriter
+	sig       *packet.Signature
+	done      chan error
+	entity    *openpgp.Entity // the key that made the signature, once it's been checked
+	owner     string
+	trustedAs string
+	result    string
+}
+
+// startPGPCheck reads the signature and makes sure that one of the built-in keys made it, so that the data can be
+// checked against it as it's written.
+func startPGPCheck(sigFile string) (*pgpCheck, error) {
+	keys, err := loadKeyring()
+	if err != nil {
+		return nil, fmt.Errorf("error reading built-in signing keys: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil, noSigKey(noReleaseKeys)
+	}
+
+	data, sig, err := readSigFile(sigFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %v", err)
+	}
+
+	// Only signatures of binary documents make sense for an ISO.
+	if sig.SigType != packet.SigTypeBinary {
+		return nil, fmt.Errorf("unsupported signature type 0x%02x", byte(sig.SigType))
+	}
+	if sig.IssuerKeyId == nil {
+		return nil, fmt.Errorf("signature doesn't say which key made it")
+	}
+	if len(keys.KeysByIdUsage(*sig.IssuerKeyId, packet.KeyFlagSign)) == 0 {
+		return nil, noSigKey("signature was made by key %v, which is not one of the release signing keys built into "+
+			"flasharch; if Arch has a new signing key, update flasharch, or pass --use-gpg", sigIssuerOf(sig))
+	}
+
+	// Whether the key had expired or been revoked depends on when the ISO was signed, not on when it's checked. If the
+	// library gives up before it has read everything, whatever is still being written fails instead of waiting forever.
+	config := &packet.Config{Time: func() time.Time { return sig.CreationTime }}
+	r, w := io.Pipe()
+	c := &pgpCheck{PipeWriter: w, sig: sig, done: make(chan error, 1)}
+	go func() {
+		_, entity, err := openpgp.VerifyDetachedSignature(keys, r, bytes.NewReader(data), config)
+		c.entity = entity
+		r.Close()
+		c.done <- err
+	}()
+
+	return c, nil
+}
+
+// Close finishes handing the data over and checks the signature. It also makes sure that the key was neither expired
+// nor revoked when the signature was made, and that it's pinned.
+func (c *pgpCheck) Close() error {
+	c.PipeWriter.Close()
+	err := <-c.done
+	issuer := sigIssuerOf(c.sig)
+	switch {
+	case errors.Is(err, pgperrors.ErrKeyRevoked):
+		return badSig("release signing key %v has been revoked, so this ISO can't be trusted; update flasharch to get "+
+			"Arch's current signing keys", issuer)
+	case errors.Is(err, pgperrors.ErrKeyExpired):
+		// The built-in copy of a key can fall behind. Arch extends its keys' expiration dates from time to time.
+		return noSigKey("the built-in copy of release signing key %v had expired by %v, when the ISO was signed; "+
+			"Arch has probably extended it since, so update flasharch (or rebuild it with `make keys`), or pass "+
+			"--use-gpg", issuer, formatTime(c.sig.CreationTime))
+	case err != nil:
+		return badSig("BAD signature from key %v: %v", issuer, err)
+	}
+
+	// The keyring is only as good as what WKD handed out when it was built, so the key still has to be pinned.
+	owner := pgpFingerprint(c.entity.PrimaryKey.Fingerprint)
+	key := owner
+	for _, sub := range c.entity.Subkeys {
+		if sub.PublicKey.KeyId == *c.sig.IssuerKeyId {
+			key = pgpFingerprint(sub.PublicKey.Fingerprint)
+		}
+	}
+	trust, err := checkSigner(key, owner)
+	if err != nil {
+		return err
+	}
+
+	uid := ""
+	if id := c.entity.PrimaryIdentity(); id != nil {
+		uid = id.Name
+	}
+	c.owner = owner
+	c.trustedAs = trust
+	c.result = sigSummary(uid, owner, c.sig.CreationTime, trust, "the release signing keys built into flasharch")
+
+	return nil
+}
+
+// report returns what to tell the user about the signature once it's been checked.
+func (c *pgpCheck) report() string {
+	return c.result
+}
+
+// signer returns the fingerprint of the primary key that made the signature, once it's been checked.
+func (c *pgpCheck) signer() string {
+	return c.owner
+}
+
+// trust returns why the key that made the signature is trusted, once it's been checked.
+func (c *pgpCheck) trust() string {
+	return c.trustedAs
+}
+
+// loadKeyring parses the built-in release signing keys. This is only done the first time it's called.
+func loadKeyring() (openpgp.EntityList, error) {
+	keyringOnce.Do(func() {
+		if strings.TrimSpace(releaseKeys) != "" {
+			keyring, keyringErr = openpgp.ReadArmoredKeyRing(strings.NewReader(releaseKeys))
+		}
+	})
+
+	return keyring, keyringErr
+}
+
+// noReleaseKeys explains what to do about a flasharch that was built without any release signing keys.
+const noReleaseKeys = "no release signing keys are built into flasharch (run `make keys` before building it); " +
+	"pass --use-gpg to check the signature with gpg instead"
+
+// haveReleaseKeys reports whether or not any release signing keys are built in.
+func haveReleaseKeys() bool {
+	keys, err := loadKeyring()
+
+	return err == nil && len(keys) > 0
+}
+
+// checkSigningKeys makes sure that there are keys to check the signature against before anything is downloaded. A
+// flasharch that was built without release signing keys doesn't quietly check the signature with gpg instead.
+func checkSigningKeys() error {
+	if *skipVerifyFlag || restoring || benchmarking || useGPG() || haveReleaseKeys() {
+		return nil
+	}
+	if keyring, _ := systemKeyring(); keyring != "" {
+		return nil
+	}
+
+	return noSigKey(noReleaseKeys)
+}
+
+// readSigFile reads a detached signature, which might be armored, and returns it in binary form along with the
+// signature in it.
+func readSigFile(sigFile string) ([]byte, *packet.Signature, error) {
+	data, err := ioutil.ReadFile(sigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")) {
+		if data, err = dearmor(data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	packets := packet.NewReader(bytes.NewReader(data))
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("no signature found")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if sig, ok := p.(*packet.Signature); ok {
+			return data, sig, nil
+		}
+	}
+}
+
+// sigIssuerOf returns the fingerprint, or else the key ID, of the key that made the signature, or "" if it doesn't say.
+func sigIssuerOf(sig *packet.Signature) string {
+	switch {
+	case len(sig.IssuerFingerprint) > 0:
+		return pgpFingerprint(sig.IssuerFingerprint)
+	case sig.IssuerKeyId != nil:
+		return fmt.Sprintf("%016X", *sig.IssuerKeyId)
+	}
+
+	return ""
+}
+
+// pgpFingerprint formats a key's fingerprint the way that gpg shows it.
+func pgpFingerprint(fp []byte) string {
+	return strings.ToUpper(hex.EncodeToString(fp))
+}
+
+// dearmor decodes the first ASCII-armored block in data.
+func dearmor(data []byte) ([]byte, error) {
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(block.Body)
+}
+
+// formatTime formats times in signatures and keys.
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 MST")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// These hold the locks on the partial downloads that this run is using, so that other runs leave them alone. The locks
+// are released when we exit.
+var partLocks = make(map[string]*os.File)
+
+// partFile returns the path to download filename into before it's verified and moved into place. If an earlier run
+// left behind a partial download of it that can be resumed, that one is used, and any other leftovers are removed.
+// Otherwise, a new file with a unique name like "<filename>.part.123456" is created. Partial downloads that another run
+// is still working on are left alone.
+func partFile(filename string) (string, error) {
+	matches, err := filepath.Glob(filename + ".part.*")
+	if err != nil {
+		return "", err
+	}
+
+	part := ""
+	for _, match := range matches {
+		if strings.HasSuffix(match, ".resume") || strings.HasSuffix(match, ".validators") {
+			continue
+		}
+		if !lockPart(match) {
+			continue
+		}
+		if validator, _ := readResume(match); validator != "" && part == "" {
+			fmt.Println("Found partial download", match)
+			part = match
+			continue
+		}
+		fmt.Println("Removing stale partial download", match)
+		removeDownload(match)
+	}
+	if part != "" {
+		return part, nil
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".part.*")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	if !lockPart(file.Name()) {
+		return "", fmt.Errorf("cannot lock %v", file.Name())
+	}
+
+	return file.Name(), nil
+}
+
+// lockPart takes the lock on the partial download. It reports whether or not we have it. If we don't, another run is
+// using the file.
+func lockPart(part string) bool {
+	if _, ok := partLocks[part]; ok {
+		return true
+	}
+
+	file, err := os.Open(part)
+	if err != nil {
+		return false
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return false
+	}
+	partLocks[part] = file
+
+	return true
+}
+
+// removeDownload removes the downloaded file and everything we remembered about it.
+func removeDownload(part string) {
+	os.Remove(part)
+	removeResume(part)
+	removeValidators(part)
+	setDigest(part, "")
+}
+
+// finalName returns the name that the partial download will have once it's moved into place. Anything that isn't a
+// partial download already has its final name.
+func finalName(part string) string {
+	if i := strings.LastIndex(part, ".part."); i >= 0 {
+		return part[:i]
+	}
+
+	return part
+}
+
+// finishPart makes sure that the partial download is safely on disk and moves it into place, along with what we know
+// about it. It returns the file's final name.
+func finishPart(part string) (string, error) {
+	filename := finalName(part)
+	if filename == part {
+		return filename, nil
+	}
+
+	file, err := os.Open(part)
+	if err != nil {
+		return "", err
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(part, filename); err != nil {
+		return "", err
+	}
+	removeResume(part)
+	if err := os.Rename(validatorsFile(part), validatorsFile(filename)); err != nil {
+		removeValidators(filename)
+	}
+	setDigest(filename, getDigest(part))
+	setDigest(part, "")
+	setB2Digest(filename, getB2Digest(part))
+	setB2Digest(part, "")
+
+	return filename, nil
+}
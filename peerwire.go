@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// These are the messages that peers send each other (BEP 3).
+const (
+	msgChoke byte = iota
+	msgUnchoke
+	msgInterested
+	msgNotInterested
+	msgHave
+	msgBitfield
+	msgRequest
+	msgPiece
+	msgCancel
+)
+
+// protocolName starts the handshake, so that both sides know that they speak BitTorrent.
+const protocolName = "BitTorrent protocol"
+
+// blockSize is how much of a piece we ask a peer for at a time. Every client answers requests of this size, and
+// maxBlockSize is the most that we'll send in answer to one.
+const (
+	blockSize    = 16 << 10
+	maxBlockSize = 128 << 10
+)
+
+// This is how many bytes we ask a peer for before it has sent the ones that we already asked for.
+const maxOutstanding = 16 * blockSize
+
+// These bound how long a peer can keep us waiting. A peer that we've asked for a piece has to send some of it within
+// blockTimeout. Otherwise, it only has to say something within idleTimeout, which keepAlive makes sure we do.
+const (
+	handshakeTimeout = 20 * time.Second
+	blockTimeout     = time.Minute
+	idleTimeout      = 3 * time.Minute
+	keepAlive        = 2 * time.Minute
+	writeTimeout     = time.Minute
+)
+
+// peerConn is a connection to one peer. Its state belongs to the goroutine that reads from the peer, except for has,
+// which is guarded by the swarm's lock, and haves, which any goroutine can tell the peer about.
+type peerConn struct {
+	s     *swarm
+	conn  net.Conn
+	r     *bufio.Reader
+	haves chan int // pieces that we've finished since we last told the peer
+
+	has        []bool // the pieces that the peer has
+	choked     bool   // whether or not the peer won't send us anything
+	interested bool   // whether or not we told the peer that we want what it has
+	unchoked   bool   // whether or not we'll send the peer what it asks for
+	uploadedTo bool   // whether or not we've sent the peer anything
+
+	// These are about the piece that we're downloading from the peer, if any.
+	piece     int // -1 if there isn't one
+	buf       []byte
+	requested int
+	received  int
+	lastBlock time.Time
+}
+
+// newPeerConn sets up the connection to the peer.
+func newPeerConn(s *swarm, conn net.Conn) *peerConn {
+	return &peerConn{
+		s:      s,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		haves:  make(chan int, len(s.have)),
+		has:    make([]bool, len(s.have)),
+		choked: true,
+		piece:  -1,
+	}
+}
+
+// handshake makes sure that the peer speaks BitTorrent and has the same torrent. Whoever connected goes first.
+func (c *peerConn) handshake(outgoing bool) error {
+	var hs bytes.Buffer
+	hs.WriteByte(byte(len(protocolName)))
+	hs.WriteString(protocolName)
+	hs.Write(make([]byte, 8)) // We don't support any extensions.
+	hs.Write(c.s.info.infoHash[:])
+	hs.Write(c.s.peerID[:])
+
+	c.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if outgoing {
+		if _, err := c.conn.Write(hs.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	theirs := make([]byte, hs.Len())
+	if _, err := io.ReadFull(c.r, theirs); err != nil {
+		return err
+	}
+	switch {
+	case !bytes.Equal(theirs[:1+len(protocolName)], hs.Bytes()[:1+len(protocolName)]):
+		return fmt.Errorf("peer does not speak BitTorrent")
+	case !bytes.Equal(theirs[28:48], c.s.info.infoHash[:]):
+		return fmt.Errorf("peer has a different torrent")
+	case bytes.Equal(theirs[48:], c.s.peerID[:]):
+		return fmt.Errorf("connected to ourselves")
+	}
+
+	if !outgoing {
+		if _, err := c.conn.Write(hs.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run exchanges messages with the peer until one of us hangs up. We start by telling it which pieces we have.
+func (c *peerConn) run(bitfield []byte) {
+	if bitfield != nil {
+		if err := c.send(msgBitfield, bitfield); err != nil {
+			return
+		}
+	}
+
+	// Pieces that we finish are announced from here, so that a slow peer doesn't hold up whoever finished them.
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.announce(stop)
+
+	for {
+		timeout := idleTimeout
+		if c.piece >= 0 {
+			timeout = blockTimeout - time.Since(c.lastBlock)
+		}
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+
+		id, payload, err := c.read()
+		if err != nil {
+			return
+		}
+		if payload == nil && id == 0 {
+			continue // keep-alive
+		}
+		if err := c.handleMessage(id, payload); err != nil {
+			return
+		}
+	}
+}
+
+// announce tells the peer about the pieces that we finish and keeps the connection alive while there's nothing else
+// to say, until stop is closed.
+func (c *peerConn) announce(stop <-chan struct{}) {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case i := <-c.haves:
+			err = c.send(msgHave, u32(i))
+		case <-ticker.C:
+			err = c.sendKeepAlive()
+		case <-stop:
+			return
+		}
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// tellHave queues the piece to be announced to the peer. It never blocks, because the caller holds the swarm's lock.
+func (c *peerConn) tellHave(i int) {
+	select {
+	case c.haves <- i:
+	default:
+	}
+}
+
+// read reads the next message. A keep-alive has no ID and no payload.
+func (c *peerConn) read() (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 {
+		return 0, nil, nil
+	}
+
+	// Nothing that a peer sends us is bigger than a piece message with the largest block, plus some room for a large
+	// bitfield.
+	if length > maxBlockSize+1<<10+uint32(len(c.has)/8) {
+		return 0, nil, fmt.Errorf("message too long: %v bytes", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(c.r, msg); err != nil {
+		return 0, nil, err
+	}
+
+	return msg[0], msg[1:], nil
+}
+
+// send sends the message to the peer.
+func (c *peerConn) send(id byte, parts ...[]byte) error {
+	length := 1
+	for _, part := range parts {
+		length += len(part)
+	}
+
+	msg := make([]byte, 4, 4+length)
+	binary.BigEndian.PutUint32(msg, uint32(length))
+	msg = append(msg, id)
+	for _, part := range parts {
+		msg = append(msg, part...)
+	}
+
+	return c.write(msg)
+}
+
+// sendKeepAlive lets the peer know that we're still here.
+func (c *peerConn) sendKeepAlive() error {
+	return c.write(make([]byte, 4))
+}
+
+// write writes the message to the peer. The connection is safe to write to from several goroutines, as long as each
+// message is written at once.
+func (c *peerConn) write(msg []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(msg)
+
+	return err
+}
+
+// handleMessage acts on a message from the peer. It returns an error if the peer broke the protocol, after which we
+// hang up.
+func (c *peerConn) handleMessage(id byte, payload []byte) error {
+	n := len(c.has)
+	switch id {
+	case msgChoke:
+		c.choked = true
+		c.dropPiece()
+	case msgUnchoke:
+		c.choked = false
+		return c.requestMore()
+	case msgInterested:
+		// We upload to everyone who asks. We're not staying around long enough for anything fancier to pay off.
+		if !c.unchoked {
+			c.unchoked = true
+			return c.send(msgUnchoke)
+		}
+	case msgNotInterested:
+	case msgHave:
+		if len(payload) != 4 {
+			return fmt.Errorf("invalid have message")
+		}
+		if i := int(binary.BigEndian.Uint32(payload)); i < n {
+			c.s.mu.Lock()
+			c.has[i] = true
+			c.s.mu.Unlock()
+		}
+		return c.updateInterest()
+	case msgBitfield:
+		if len(payload) != (n+7)/8 {
+			return fmt.Errorf("invalid bitfield")
+		}
+		c.s.mu.Lock()
+		for i := range c.has {
+			c.has[i] = payload[i/8]&(0x80>>uint(i%8)) != 0
+		}
+		c.s.mu.Unlock()
+		return c.updateInterest()
+	case msgRequest:
+		if len(payload) != 12 {
+			return fmt.Errorf("invalid request")
+		}
+		return c.upload(int(binary.BigEndian.Uint32(payload)), int(binary.BigEndian.Uint32(payload[4:])),
+			int(binary.BigEndian.Uint32(payload[8:])))
+	case msgPiece:
+		if len(payload) < 8 {
+			return fmt.Errorf("invalid piece message")
+		}
+		return c.receive(int(binary.BigEndian.Uint32(payload)), int(binary.BigEndian.Uint32(payload[4:])),
+			payload[8:])
+	case msgCancel:
+		// Requests are answered as soon as they arrive, so there's never one left to cancel.
+	}
+
+	return nil
+}
+
+// updateInterest tells the peer whether or not it has anything that we want, and asks for it if it does.
+func (c *peerConn) updateInterest() error {
+	c.s.mu.Lock()
+	want := false
+	for i, has := range c.has {
+		if has && !c.s.have[i] {
+			want = true
+			break
+		}
+	}
+	c.s.mu.Unlock()
+
+	if want != c.interested {
+		c.interested = want
+		id := msgNotInterested
+		if want {
+			id = msgInterested
+		}
+		if err := c.send(id); err != nil {
+			return err
+		}
+	}
+
+	return c.requestMore()
+}
+
+// requestMore asks the peer for more of the piece that we're downloading from it, or picks a new piece if we aren't
+// downloading one.
+func (c *peerConn) requestMore() error {
+	if c.choked || !c.interested {
+		return nil
+	}
+	if c.piece < 0 {
+		c.s.mu.Lock()
+		c.piece = c.s.pick(c.has)
+		c.s.mu.Unlock()
+		if c.piece < 0 {
+			return nil
+		}
+		c.buf = make([]byte, c.s.info.pieceSize(c.piece))
+		c.requested = 0
+		c.received = 0
+		c.lastBlock = time.Now()
+	}
+
+	for c.requested < len(c.buf) && c.requested-c.received < maxOutstanding {
+		length := len(c.buf) - c.requested
+		if length > blockSize {
+			length = blockSize
+		}
+		if err := c.send(msgRequest, u32(c.piece), u32(c.requested), u32(length)); err != nil {
+			return err
+		}
+		c.requested += length
+	}
+
+	return nil
+}
+
+// receive stores a block of the piece that we're downloading from the peer. Once we have the whole piece, it's checked
+// and written to the file. A peer that sends a bad piece is hung up on.
+func (c *peerConn) receive(i, begin int, block []byte) error {
+	// A block can arrive after we've given up on its piece.
+	if i != c.piece || begin < 0 || begin+len(block) > c.requested {
+		return nil
+	}
+	copy(c.buf[begin:], block)
+	c.received += len(block)
+	c.lastBlock = time.Now()
+	if c.received < len(c.buf) {
+		return c.requestMore()
+	}
+
+	piece, data := c.piece, c.buf
+	c.piece, c.buf = -1, nil
+	if err := c.s.finish(piece, data); err != nil {
+		return err
+	}
+
+	return c.updateInterest()
+}
+
+// dropPiece gives up on the piece that we're downloading from the peer, so that another source can download it.
+func (c *peerConn) dropPiece() {
+	if c.piece < 0 {
+		return
+	}
+
+	c.s.mu.Lock()
+	c.s.release(c.piece)
+	c.s.mu.Unlock()
+	c.piece, c.buf = -1, nil
+}
+
+// upload sends the peer the block that it asked for, as long as we have it.
+func (c *peerConn) upload(i, begin, length int) error {
+	if !c.unchoked {
+		return nil
+	}
+	if i >= len(c.has) || begin < 0 || length <= 0 || length > maxBlockSize || begin+length > c.s.info.pieceSize(i) {
+		return fmt.Errorf("invalid request")
+	}
+
+	c.s.mu.Lock()
+	have := c.s.have[i]
+	c.s.mu.Unlock()
+	if !have {
+		return nil
+	}
+
+	block := make([]byte, length)
+	if _, err := c.s.file.ReadAt(block, int64(i)*c.s.info.pieceLength+int64(begin)); err != nil {
+		return err
+	}
+	if err := c.send(msgPiece, u32(i), u32(begin), block); err != nil {
+		return err
+	}
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	c.s.uploaded += int64(length)
+	if c.s.seeding {
+		c.s.p.have += length
+	}
+	if !c.uploadedTo {
+		c.uploadedTo = true
+		c.s.uploadees++
+	}
+
+	return nil
+}
+
+// u32 encodes n as the four bytes that BitTorrent uses for numbers.
+func u32(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+
+	return b
+}
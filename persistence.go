@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// persistenceLabel is the label of the persistence partition. The ISO is told to keep its changes there by booting it
+// with cow_label set to this.
+const persistenceLabel = "cow"
+
+// The persistence partition starts on a boundary of partitionAlign bytes, and has to be at least minPersistence bytes
+// to hold a file system with anything in it.
+const (
+	partitionAlign = 1 << 20
+	minPersistence = 16 << 20
+)
+
+// These are the ioctls that return a block device's logical sector size and make the kernel re-read its partitions.
+const (
+	blkSSZGet = 0x1268
+	blkRRPart = 0x125f
+)
+
+// After the partitions are re-read, we'll look for the new one every partPoll until partWait has passed.
+const (
+	partWait = 10 * time.Second
+	partPoll = 100 * time.Millisecond
+)
+
+// mbrEntries is where the MBR's four partition entries start.
+const mbrEntries = 446
+
+// linuxFSType is the GPT partition type of a Linux file system, in the mixed-endian form that it's stored in.
+var linuxFSType = []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+
+// persistenceSize is how big the persistence partition will be, from --persistence, or 0 for none.
+var persistenceSize int64
+
+// checkPersistence makes sure that --persistence is a size that can hold a file system, and that there will be a drive
+// with room for it.
+func checkPersistence() error {
+	if *persistenceFlag == "" {
+		return nil
+	}
+	switch {
+	case *streamFlag || *downloadOnlyFlag:
+		return fmt.Errorf("--persistence does not work with --stream or --download-only")
+	case isARM():
+		return fmt.Errorf("--persistence does not work with Arch Linux ARM")
+	}
+
+	size, err := parseSize(*persistenceFlag)
+	if err != nil || size < minPersistence {
+		return fmt.Errorf("invalid --persistence: must be a size of at least %v, like 4G", reduce(minPersistence))
+	}
+	persistenceSize = int64(size)
+
+	return nil
+}
+
+// checkPersistenceFits makes sure that the USB drive can hold the persistence partition after the image, so that we
+// don't find out after flashing. The partition can only be added to a block device, since its file system is made on
+// the partition's own device.
+func checkPersistenceFits(isoFile, usb string) error {
+	if persistenceSize == 0 {
+		return nil
+	}
+	if err := checkBlockDevice(usb); err != nil {
+		return fmt.Errorf("can't add a persistence partition: %v", err)
+	}
+
+	size, err := imageSize(isoFile)
+	if err != nil || size < 0 {
+		return nil
+	}
+	capacity, err := deviceSize(usb)
+	if err != nil || capacity < 0 {
+		return nil
+	}
+	// There has to be room for the backup GPT at the end, too.
+	need := alignUp(size, partitionAlign) + persistenceSize + partitionAlign
+	if need > capacity {
+		return fmt.Errorf("the image and a %v persistence partition need %v bytes (%v), "+
+			"but %v only holds %v bytes (%v)",
+			reduce(int(persistenceSize)), need, reduce(int(need)), usb, capacity, reduce(int(capacity)))
+	}
+
+	return nil
+}
+
+// addPersistence adds a partition for the ISO to keep its changes in, for --persistence, in the free space after the
+// image, and formats it as ext4 with the label that the ISO will be told to look for. The Arch ISO's partition table
+// is either an MBR or a GPT that a (protective or hybrid) MBR sits in front of for BIOSes. An MBR gets a new entry. A
+// GPT gets a new entry, has its backup moved from the end of the image to the end of the drive, and has its
+// protective MBR entry grown to cover the drive, while any other MBR entries are left alone. The kernel is then told
+// to re-read the partitions, so that the new one can be formatted.
+func addPersistence(isoFile, usb string, r *reporter) error {
+	if persistenceSize == 0 {
+		return nil
+	}
+	imageBytes, err := imageSize(isoFile)
+	if err != nil {
+		return err
+	}
+
+	device, err := os.OpenFile(usb, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	sector, err := sectorSize(device)
+	if err != nil {
+		return fmt.Errorf("error reading the sector size of %v: %v", usb, err)
+	}
+	capacity, err := deviceSize(usb)
+	if err != nil {
+		return err
+	}
+
+	mbr := make([]byte, sector)
+	hdr := make([]byte, sector)
+	if _, err := device.ReadAt(mbr, 0); err != nil {
+		return err
+	}
+	if _, err := device.ReadAt(hdr, sector); err != nil {
+		return err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return fmt.Errorf("the image on %v doesn't have a partition table to add to", usb)
+	}
+
+	var number int
+	if bytes.HasPrefix(hdr, []byte("EFI PART")) {
+		number, err = addGPTPartition(device, mbr, hdr, sector, capacity, imageBytes)
+	} else {
+		number, err = addMBRPartition(device, mbr, sector, capacity, imageBytes)
+	}
+	if err != nil {
+		return err
+	}
+	if err := device.Sync(); err != nil {
+		return fmt.Errorf("error syncing %v: %v", usb, err)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), blkRRPart, 0); errno != 0 {
+		return fmt.Errorf("error re-reading the partition table of %v: %v", usb, errno)
+	}
+
+	part, err := waitForPartition(usb, number)
+	if err != nil {
+		return err
+	}
+	r.println("Formatting", part, "as ext4 with the label", persistenceLabel)
+	output, err := exec.Command("mkfs.ext4", "-F", "-q", "-L", persistenceLabel, part).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error formatting %v: %v", part, commandError(output, err))
+	}
+	r.println("Added", reduce(int(persistenceSize)), "persistence partition", part)
+
+	return nil
+}
+
+// addMBRPartition adds the persistence partition to the first free entry of the MBR, after every partition and the
+// image, and returns its number. Entries with no sectors are free, even if they have a type (the Arch ISO's first
+// partition has type 0 but isn't free).
+func addMBRPartition(device *os.File, mbr []byte, sector, capacity, imageBytes int64) (int, error) {
+	end := imageBytes
+	free := -1
+	for i := 0; i < 4; i++ {
+		e := mbr[mbrEntries+16*i:]
+		start, count := int64(binary.LittleEndian.Uint32(e[8:])), int64(binary.LittleEndian.Uint32(e[12:]))
+		if count == 0 {
+			if free < 0 {
+				free = i
+			}
+			continue
+		}
+		if (start+count)*sector > end {
+			end = (start + count) * sector
+		}
+	}
+	if free < 0 {
+		return 0, fmt.Errorf("the image's partition table has no room for another partition")
+	}
+
+	start := alignUp(end, partitionAlign) / sector
+	count := persistenceSize / sector
+	if (start+count)*sector > capacity || start+count > 0xffffffff {
+		return 0, fmt.Errorf("there's no room for a %v persistence partition after the image",
+			reduce(int(persistenceSize)))
+	}
+	e := mbr[mbrEntries+16*free : mbrEntries+16*(free+1)]
+	copy(e, []byte{0, 0xfe, 0xff, 0xff, 0x83, 0xfe, 0xff, 0xff}) // Not bootable, Linux, and CHS addresses out of range.
+	binary.LittleEndian.PutUint32(e[8:], uint32(start))
+	binary.LittleEndian.PutUint32(e[12:], uint32(count))
+	if _, err := device.WriteAt(mbr, 0); err != nil {
+		return 0, err
+	}
+
+	return free + 1, nil
+}
+
+// addGPTPartition adds the persistence partition to the first free entry of the GPT, after every partition and the
+// image, moves the backup GPT to the end of the drive, and returns the partition's number.
+func addGPTPartition(device *os.File, mbr, hdr []byte, sector, capacity, imageBytes int64) (int, error) {
+	headerSize := binary.LittleEndian.Uint32(hdr[12:])
+	if headerSize < 92 || int64(headerSize) > sector ||
+		gptCRC(hdr[:headerSize]) != binary.LittleEndian.Uint32(hdr[16:]) {
+		return 0, fmt.Errorf("the image's GPT header is damaged")
+	}
+	entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:]))
+	numEntries := int64(binary.LittleEndian.Uint32(hdr[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(hdr[84:]))
+	if entrySize < 128 || numEntries*entrySize > 1<<20 {
+		return 0, fmt.Errorf("the image's GPT header is damaged")
+	}
+	entries := make([]byte, numEntries*entrySize)
+	if _, err := device.ReadAt(entries, entriesLBA*sector); err != nil {
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:]) {
+		return 0, fmt.Errorf("the image's GPT partition entries are damaged")
+	}
+
+	end := imageBytes
+	free := int64(-1)
+	for i := int64(0); i < numEntries; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			if free < 0 {
+				free = i
+			}
+			continue
+		}
+		if last := int64(binary.LittleEndian.Uint64(e[40:])); (last+1)*sector > end {
+			end = (last + 1) * sector
+		}
+	}
+	if free < 0 {
+		return 0, fmt.Errorf("the image's partition table has no room for another partition")
+	}
+
+	// The backup GPT goes at the very end of the drive: its entries, and then its header in the last sector.
+	lastLBA := capacity/sector - 1
+	entrySectors := (int64(len(entries)) + sector - 1) / sector
+	backupEntriesLBA := lastLBA - entrySectors
+	start := alignUp(end, partitionAlign) / sector
+	last := start + persistenceSize/sector - 1
+	if last >= backupEntriesLBA {
+		return 0, fmt.Errorf("there's no room for a %v persistence partition after the image",
+			reduce(int(persistenceSize)))
+	}
+
+	e := entries[free*entrySize : (free+1)*entrySize]
+	copy(e, linuxFSType)
+	if _, err := rand.Read(e[16:32]); err != nil {
+		return 0, err
+	}
+	e[22] = e[22]&0x0f | 0x40 // A random (version 4) GUID, stored mixed-endian.
+	e[24] = e[24]&0x3f | 0x80
+	binary.LittleEndian.PutUint64(e[32:], uint64(start))
+	binary.LittleEndian.PutUint64(e[40:], uint64(last))
+	for i, c := range utf16.Encode([]rune(persistenceLabel)) {
+		binary.LittleEndian.PutUint16(e[56+2*i:], c)
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	oldBackupLBA := int64(binary.LittleEndian.Uint64(hdr[32:]))
+	primary := append([]byte(nil), hdr...)
+	binary.LittleEndian.PutUint64(primary[32:], uint64(lastLBA))
+	binary.LittleEndian.PutUint64(primary[48:], uint64(backupEntriesLBA-1))
+	binary.LittleEndian.PutUint32(primary[88:], entriesCRC)
+	backup := append([]byte(nil), primary...)
+	binary.LittleEndian.PutUint64(backup[24:], uint64(lastLBA))
+	binary.LittleEndian.PutUint64(backup[32:], 1)
+	binary.LittleEndian.PutUint64(backup[72:], uint64(backupEntriesLBA))
+	setGPTCRC(primary[:headerSize])
+	setGPTCRC(backup[:headerSize])
+
+	// The backup is written first, so that there's always one good GPT if we're interrupted. The old backup, at the end
+	// of the image, is cleared so that nothing mistakes it for the real one.
+	write := func(data []byte, lba int64) error {
+		_, err := device.WriteAt(data, lba*sector)
+		return err
+	}
+	if err := write(entries, backupEntriesLBA); err != nil {
+		return 0, err
+	}
+	if err := write(backup, lastLBA); err != nil {
+		return 0, err
+	}
+	if err := write(entries, entriesLBA); err != nil {
+		return 0, err
+	}
+	if err := write(primary, 1); err != nil {
+		return 0, err
+	}
+	if oldBackupLBA > 1 && oldBackupLBA < start {
+		if err := write(make([]byte, sector), oldBackupLBA); err != nil {
+			return 0, err
+		}
+	}
+
+	// A protective MBR entry covers the GPT's part of the drive, which is now all of it. The entries of a hybrid MBR
+	// are for BIOSes, which don't need to know about the new partition.
+	for i := 0; i < 4; i++ {
+		me := mbr[mbrEntries+16*i:]
+		if me[4] != 0xee {
+			continue
+		}
+		count := lastLBA + 1 - int64(binary.LittleEndian.Uint32(me[8:]))
+		if count > 0xffffffff {
+			count = 0xffffffff
+		}
+		binary.LittleEndian.PutUint32(me[12:], uint32(count))
+	}
+	if _, err := device.WriteAt(mbr, 0); err != nil {
+		return 0, err
+	}
+
+	return int(free) + 1, nil
+}
+
+// printPersistence tells the user how to boot the ISO with its persistence partition, since the ISO doesn't look for
+// one unless it's told to.
+func printPersistence() {
+	if persistenceSize == 0 {
+		return
+	}
+	fmt.Println("To keep changes on the persistence partition, add this to the kernel parameters when booting:")
+	fmt.Println("\tcow_label=" + persistenceLabel)
+	fmt.Println("At the boot menu, press Tab (BIOS) or e (UEFI) to edit them.")
+}
+
+// gptCRC returns the CRC32 of the GPT header, which is computed with the CRC field itself zeroed.
+func gptCRC(hdr []byte) uint32 {
+	h := append([]byte(nil), hdr...)
+	binary.LittleEndian.PutUint32(h[16:], 0)
+
+	return crc32.ChecksumIEEE(h)
+}
+
+// setGPTCRC stores the GPT header's CRC32 in it.
+func setGPTCRC(hdr []byte) {
+	binary.LittleEndian.PutUint32(hdr[16:], gptCRC(hdr))
+}
+
+// sectorSize returns the logical sector size of the block device, which partition tables count in.
+func sectorSize(device *os.File) (int64, error) {
+	var size int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), blkSSZGet, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int64(size), nil
+}
+
+// waitForPartition waits for the kernel (and udev, if it's making the device files) to show the drive's partition with
+// the given number, and returns its path.
+func waitForPartition(usb string, number int) (string, error) {
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return "", err
+	}
+	sys := filepath.Join("/sys/class/block", filepath.Base(dev))
+
+	for deadline := time.Now().Add(partWait); time.Now().Before(deadline); time.Sleep(partPoll) {
+		entries, _ := ioutil.ReadDir(sys)
+		for _, entry := range entries {
+			data, err := ioutil.ReadFile(filepath.Join(sys, entry.Name(), "partition"))
+			if err != nil || strings.TrimSpace(string(data)) != fmt.Sprint(number) {
+				continue
+			}
+			part := "/dev/" + entry.Name()
+			if _, err := os.Stat(part); err == nil {
+				return part, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("partition %v of %v didn't show up after re-reading the partition table", number, usb)
+}
+
+// alignUp rounds n up to a multiple of align.
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
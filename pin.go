@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// checkSHA256 makes sure that the checksum given with --sha256 is a SHA-256 checksum, so that a typo is caught before
+// the download rather than after it.
+func checkSHA256() error {
+	if *sha256Flag == "" {
+		return nil
+	}
+
+	sum := strings.ToLower(strings.TrimSpace(*sha256Flag))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return fmt.Errorf("invalid --sha256: %v (must be %v hex digits)", *sha256Flag, sha256.Size*2)
+	}
+	if *streamFlag {
+		return fmt.Errorf("--sha256 does not work with --stream: the ISO would be flashed before it could be checked")
+	}
+	*sha256Flag = sum
+
+	return nil
+}
+
+// checkPinnedSum makes sure that the ISO matches the checksum given with --sha256, if there is one. The checksum came
+// from the user, so a mismatch is never blamed on the mirror: the ISO isn't the one that the user asked for.
+func checkPinnedSum(ctx context.Context, isoFile string) error {
+	if *sha256Flag == "" {
+		return nil
+	}
+
+	if err := verifyChecksum(ctx, isoFile, *sha256Flag); err != nil {
+		return fmt.Errorf("the ISO does not match --sha256: %w", err)
+	}
+	fmt.Println("SHA-256 checksum matches --sha256")
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// checkLevel is what a failed safety check does to the flash.
+type checkLevel int
+
+const (
+	// checkWarn only prints a warning.
+	checkWarn checkLevel = iota
+	// checkForceable stops the flash, unless --force is given.
+	checkForceable
+	// checkFatal always stops the flash. --force can't override it.
+	checkFatal
+)
+
+// These are the safety checks that were overridden during this run, for the summary at the end.
+var (
+	overridden   []string
+	overriddenMu sync.Mutex
+)
+
+// enforce decides what the failure of the named safety check means for the flash, and returns an error if the flash
+// has to stop. A check that passed (err is nil) never stops it. Anything that --force lets through is printed and
+// remembered, so that it can be listed again after flashing.
+func enforce(name string, level checkLevel, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case level == checkWarn:
+		fmt.Println("WARNING:", err)
+		return nil
+	case level == checkForceable && *forceFlag:
+		override(name, "--force", err)
+		return nil
+	case level == checkForceable:
+		return fmt.Errorf("%v (pass --force to %v anyway)", err, action())
+	}
+
+	return err
+}
+
+// override lets the failure of the named safety check through because of the flag, and remembers that it did.
+func override(name, flagName string, err error) {
+	fmt.Printf("WARNING: Ignoring the %v check because of %v: %v\n", name, flagName, err)
+
+	overriddenMu.Lock()
+	defer overriddenMu.Unlock()
+	overridden = append(overridden, name+" (overridden by "+flagName+")")
+}
+
+// printOverridden lists every safety check that was overridden during this run, if any were.
+func printOverridden() {
+	overriddenMu.Lock()
+	defer overriddenMu.Unlock()
+
+	if len(overridden) > 0 {
+		fmt.Printf("Safety checks that were overridden:\n\t%v\n", strings.Join(overridden, "\n\t"))
+	}
+}
+
+// checkBlockDevice makes sure that the USB drive is a block device. Writing to anything else (like a file standing in
+// for a drive) works, but it's rarely what was meant.
+func checkBlockDevice(usb string) error {
+	info, err := os.Stat(usb)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%v is not a block device, so the image will be written into it as a file", usb)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// escalateWith is the program (sudo or pkexec) that will run flasharch as root to flash the drives, because we can't
+// write to them ourselves, or "" if we can.
+var escalateWith string
+
+// These options aren't passed on to flasharch when it runs as root, because it's given the ISO that we already have
+// instead of getting one, and the user has already answered its questions.
+var rootSkipFlags = map[string]bool{"iso": true, "torrent": true, "seed": true, "yes": true}
+
+// checkPrivileges makes sure that we can write to every USB drive, so that we don't find out after downloading the ISO.
+// Being in the drive's group isn't always enough, so this actually opens each one for writing. If we can't, we offer to
+// flash them as root: sudo asks for the user's password on the terminal, and pkexec asks with a dialog when there's no
+// terminal. The ISO is still downloaded as the user, and then it's handed to flasharch running as root, so that it
+// isn't downloaded again. --stream, Arch Linux ARM, restore, and bench don't have an ISO to hand over, so flasharch
+// runs itself as root right away for them instead. bench --read-only only needs to read the drives. If the user says
+// no, there's nothing that we can do.
+func checkPrivileges(usbs []string) error {
+	if os.Geteuid() == 0 || backend == backendUDisks {
+		return nil
+	}
+	var denied []string
+	mode := os.O_WRONLY
+	if benchmarking && *readOnlyFlag {
+		mode = os.O_RDONLY
+	}
+	for _, usb := range usbs {
+		file, err := os.OpenFile(usb, mode, 0)
+		if err == nil {
+			file.Close()
+		} else if errors.Is(err, os.ErrPermission) {
+			denied = append(denied, usb)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+
+	tool := "sudo"
+	if !isTerminal() {
+		tool = "pkexec"
+	}
+	msg := fmt.Sprintf("%v can't be written without root", strings.Join(denied, " and "))
+	if mode == os.O_RDONLY {
+		msg = fmt.Sprintf("%v can't be read without root", strings.Join(denied, " and "))
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("%v, and %v isn't installed to flash as root (run flasharch as root instead)", msg, tool)
+	}
+	if mode == os.O_RDONLY {
+		fmt.Println("You don't have permission to read", strings.Join(denied, " or "))
+	} else {
+		fmt.Println("You don't have permission to write to", strings.Join(denied, " or "))
+	}
+	if isTerminal() && !*yesFlag {
+		ok, err := confirm(strings.Title(action()) + " as root with " + tool + "?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("not %v: %v (run flasharch as root, or get write access to the drive)", acting(), msg)
+		}
+	}
+
+	escalateWith = tool
+	if *streamFlag || isARM() || restoring || benchmarking {
+		fmt.Println("Running flasharch as root with", tool)
+		os.Exit(runAsRoot(os.Args[1:]))
+	}
+	fmt.Println("The ISO will be flashed as root with", tool, "once it's ready")
+
+	return nil
+}
+
+// flashAsRoot runs flasharch as root to flash the ISO that we already have to the drives, with every option that we
+// were given that still applies. It returns flasharch's exit code.
+func flashAsRoot(isoFile string, usbs []string) int {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		switch {
+		case rootSkipFlags[f.Name]:
+		case f.Name == "mirror":
+			for _, mirror := range mirrorFlag {
+				args = append(args, "--mirror="+mirror)
+			}
+		case f.Name == "keyserver":
+			for _, keyserver := range keyserverFlag {
+				args = append(args, "--keyserver="+keyserver)
+			}
+		default:
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	args = append(args, "--iso="+isoFile, "--yes")
+	args = append(args, usbs...)
+
+	fmt.Println("Flashing as root with", escalateWith)
+	return runAsRoot(args)
+}
+
+// runAsRoot runs flasharch as root with the arguments, connected to our terminal, and returns its exit code. pkexec's
+// exit code when the user dismisses its dialog or fails to authenticate is explained, since pkexec doesn't say anything
+// itself.
+func runAsRoot(args []string) int {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Println("Error finding flasharch to run it as root:", err)
+		return 1
+	}
+	cmd := exec.Command(escalateWith, append([]string{self}, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		if escalateWith == "pkexec" && (exitErr.ExitCode() == 126 || exitErr.ExitCode() == 127) {
+			fmt.Printf("Not %v: pkexec wasn't allowed to run flasharch as root\n", acting())
+		}
+		return exitErr.ExitCode()
+	}
+	fmt.Println("Error running flasharch as root:", err)
+
+	return 1
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// isTerminal reports whether or not stdin is connected to a terminal that we can prompt. Being a character device isn't
+// enough, because /dev/null is one too, so we ask for the terminal's settings, which only a terminal has.
+func isTerminal() bool {
+	var t syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+
+	return errno == 0
+}
+
+// confirm asks the user a yes/no question and reports whether or not they answered yes. Anything other than "y" or
+// "yes" is treated as no. If we can't prompt the user, an error is returned instead.
+func confirm(question string) (bool, error) {
+	if !isTerminal() {
+		return false, fmt.Errorf("cannot prompt for confirmation without a terminal")
+	}
+
+	answer, err := ask(question + " [y/N]")
+	if err != nil {
+		return false, err
+	}
+
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes", nil
+}
+
+// This reads the answers to our questions. It's shared between them, so that nothing that it buffered is lost.
+var stdinReader *bufio.Reader
+
+// ask prints the question and returns the user's answer, without surrounding whitespace.
+func ask(question string) (string, error) {
+	if stdinReader == nil {
+		stdinReader = bufio.NewReader(os.Stdin)
+	}
+
+	fmt.Print(question, " ")
+	answer, err := stdinReader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(answer), nil
+}
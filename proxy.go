@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// socksDialer connects through the SOCKS5 proxy given with --proxy. It's nil if we aren't using one.
+var socksDialer proxy.ContextDialer
+
+// proxyTransport labels errors that come from the proxy, so that they aren't mistaken for errors from the mirror.
+type proxyTransport struct {
+	*http.Transport
+	socks *url.URL // the SOCKS5 proxy that the transport dials through, if any
+}
+
+// RoundTrip sends the request through the underlying transport.
+func (t proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+
+	proxy := t.socks
+	if proxy == nil && t.Proxy != nil {
+		proxy, _ = t.Proxy(req)
+	}
+	if proxy == nil {
+		return resp, err
+	}
+
+	if err != nil {
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "proxyconnect" {
+			return nil, fmt.Errorf("error connecting to proxy %v: %w", proxy.Host, oe.Err)
+		}
+		return nil, fmt.Errorf("%w (through proxy %v)", err, proxy.Host)
+	}
+	if resp.StatusCode == 407 {
+		resp.Status += " (from proxy " + proxy.Host + ")"
+	}
+
+	return resp, nil
+}
+
+// setProxy sends every request through the proxy given with --proxy, or else the one in the environment
+// (HTTP_PROXY, HTTPS_PROXY, and NO_PROXY). Credentials can be given in the proxy's URL. A SOCKS5 proxy also carries
+// FTP connections.
+func setProxy() error {
+	if *proxyFlag != "" {
+		u, err := parseProxy(*proxyFlag)
+		if err != nil {
+			return err
+		}
+		if isSOCKS(u) {
+			// Mirrors are looked up by the proxy, so nothing leaks out through our own DNS.
+			d, err := proxy.FromURL(u, directDialer{})
+			if err != nil {
+				return fmt.Errorf("invalid proxy: %v (%v)", *proxyFlag, err)
+			}
+			socksDialer = d.(proxy.ContextDialer)
+			transport.Proxy = nil
+			transport.DialContext = socksDialer.DialContext
+			client.Transport = proxyTransport{transport, u}
+			return nil
+		}
+		transport.Proxy = http.ProxyURL(u)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	client.Transport = proxyTransport{transport, nil}
+
+	return nil
+}
+
+// parseProxy validates the proxy's URL. A proxy without a scheme is assumed to be an http proxy. socks5 and socks5h
+// proxies are treated the same: hostnames are always resolved by the proxy.
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		if u, err = url.Parse("http://" + proxy); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy: %v", proxy)
+		}
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy: %v (scheme must be http, https, socks5, or socks5h)", proxy)
+	}
+
+	return u, nil
+}
+
+// isSOCKS reports whether or not the proxy is a SOCKS5 proxy.
+func isSOCKS(u *url.URL) bool {
+	return strings.HasPrefix(u.Scheme, "socks5")
+}
+
+// directDialer connects to the SOCKS5 proxy itself, with our timeouts and -4 or -6.
+type directDialer struct{}
+
+// Dial connects to the address.
+func (directDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address.
+func (directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialContext(ctx, network, addr)
+}
+
+// dialMirror connects to a mirror that isn't reached over http, going through the SOCKS5 proxy if we have one.
+func dialMirror(ctx context.Context, network, addr string) (net.Conn, error) {
+	if socksDialer != nil {
+		return socksDialer.DialContext(ctx, network, addr)
+	}
+
+	return dialContext(ctx, network, addr)
+}
+
+// checkCommandProxy makes sure that the external program can use our proxy. rsync only speaks to http proxies, so we
+// won't let it go around a SOCKS5 proxy.
+func checkCommandProxy(program string) error {
+	if socksDialer != nil {
+		return fmt.Errorf("%v cannot use a SOCKS5 proxy", program)
+	}
+
+	return nil
+}
+
+// commandProxy returns the proxy that external programs should use, or "" if there isn't one. Like the http client,
+// they use --proxy if it's given and the environment otherwise.
+func commandProxy() string {
+	if *proxyFlag != "" {
+		if u, err := parseProxy(*proxyFlag); err == nil && !isSOCKS(u) {
+			return u.String()
+		}
+	}
+	for _, env := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if proxy := os.Getenv(env); proxy != "" {
+			return proxy
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// quickEdge is how much of the start and the end of the image --quick-verify always reads back, since that's where
+// the partition tables and boot code are.
+const quickEdge = 4 << 20
+
+// quickSampleSize is how big each of the random samples that --quick-verify reads back is, from --sample-size.
+var quickSampleSize int64
+
+// checkQuickVerify makes sure that --quick-verify has a drive to read back, and that its samples can be read around the
+// page cache.
+func checkQuickVerify() error {
+	if !*quickVerifyFlag {
+		return nil
+	}
+	switch {
+	case *noVerifyFlashFlag:
+		return fmt.Errorf("--quick-verify and --no-verify-flash can't be used together")
+	case *streamFlag || *downloadOnlyFlag || *copyToFlag != "" || *ventoyFlag:
+		return fmt.Errorf("--quick-verify only works when flashing a drive, " +
+			"not with --stream, --download-only, --copy-to, or --ventoy")
+	case *samplesFlag < 0:
+		return fmt.Errorf("invalid --samples: can't be negative")
+	}
+
+	size, err := parseSize(*sampleSizeFlag)
+	if err != nil || size <= 0 || size%readBackAlign != 0 {
+		return fmt.Errorf("invalid --sample-size: must be a multiple of %v bytes, like 1M", readBackAlign)
+	}
+	quickSampleSize = int64(size)
+
+	return nil
+}
+
+// quickVerify reads back only part of the image from the USB drive, for --quick-verify, and makes sure that it matches
+// the image file: the first and last few MiB, and --samples blocks of --sample-size bytes from random places in
+// between. That's much faster than reading back all of it on a slow drive, but it can't catch a bad block that none of
+// the samples landed on. It returns a line for the summary that says how much was read back. If anything differs, the
+// error has the offset of the first byte that does.
+func quickVerify(image, usb string, r *reporter) (string, error) {
+	file, err := os.Open(image)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+
+	device, err := openUncached(usb, r)
+	if err != nil {
+		return "", err
+	}
+	defer device.Close()
+
+	// Each sample starts on a block boundary. Samples that overlap are read together, and they're all read in order, so
+	// that the drive is read from start to end.
+	type span struct{ start, end int64 }
+	spans := []span{{0, min64(quickEdge, size)}, {max64(0, size-quickEdge) / readBackAlign * readBackAlign, size}}
+	for i := 0; i < *samplesFlag && size > 0; i++ {
+		start := rand.Int63n(size) / readBackAlign * readBackAlign
+		spans = append(spans, span{start, min64(start+quickSampleSize, size)})
+	}
+	samples := len(spans)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	merged := spans[:1]
+	for _, s := range spans[1:] {
+		if last := &merged[len(merged)-1]; s.start <= last.end {
+			last.end = max64(last.end, s.end)
+		} else {
+			merged = append(merged, s)
+		}
+	}
+	var total int64
+	for _, s := range merged {
+		total += s.end - s.start
+	}
+
+	r.println("Reading back", samples, "samples", "("+reduce(int(total))+")", "from", usb, "for a quick verify")
+	p := progress{total: int(total), r: r}
+	buf := alignedBuffer(readBackSize, readBackAlign)
+	want := make([]byte, len(buf))
+	for _, s := range merged {
+		for offset := s.start; offset < s.end; offset += int64(len(buf)) {
+			n := min64(int64(len(buf)), s.end-offset)
+			if _, err := file.ReadAt(want[:n], offset); err != nil {
+				r.flush() // Flush last progress line.
+				return "", fmt.Errorf("error reading %v at byte %v: %v", image, offset, err)
+			}
+			// Reads around the page cache have to be whole blocks, even past the end of the image.
+			m, err := device.ReadAt(buf[:alignUp(n, readBackAlign)], offset)
+			if int64(m) < n {
+				if err == nil || err == io.EOF {
+					err = fmt.Errorf("it ended at byte %v, before the end of the image", offset+int64(m))
+				}
+				r.flush() // Flush last progress line.
+				return "", fmt.Errorf("error reading %v at byte %v: %v", usb, offset, err)
+			}
+			for i := int64(0); i < n; i++ {
+				if buf[i] != want[i] {
+					r.flush() // Flush last progress line.
+					return "", fmt.Errorf("quick verify: %v does not match the image; first difference at byte %v", usb,
+						offset+i)
+				}
+			}
+			p.have += int(n)
+			p.print()
+		}
+	}
+	r.flush() // Flush last progress line.
+
+	msg := fmt.Sprintf("quick verify only: %v samples (%v of %v) match the image, and the rest wasn't read back",
+		samples, reduce(int(total)), reduce(int(size)))
+	r.println("Drive matches the image in every sample (quick verify, not a full read-back)")
+
+	return msg, nil
+}
+
+// max64 returns the larger of a and b.
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter throttles downloads to the rate given with --limit-rate. It's nil if there's no limit.
+var limiter *rateLimiter
+
+// rateLimiter is a token bucket that's shared by every download, so that parallel connections stay under the limit
+// together.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter that allows rate bytes per second, with bursts of up to one second's worth.
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n bytes out of the bucket, sleeping until they've been paid for.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / l.rate * float64(time.Second)))
+	}
+}
+
+// limitedReader throttles reads from r with the limiter.
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep the rate smooth.
+	if max := int(lr.l.rate/10) + 1; len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.l.wait(n)
+
+	return n, err
+}
+
+// limitReader throttles r if there's a rate limit and returns it as-is otherwise.
+func limitReader(r io.Reader) io.Reader {
+	if limiter == nil {
+		return r
+	}
+
+	return limitedReader{r, limiter}
+}
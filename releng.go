@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// This is where Arch publishes the machine-readable details of every release.
+var relengAPI = "https://archlinux.org/releng/releases/json/"
+
+// The latest release only needs to be looked up once per run.
+var (
+	latestOnce    sync.Once
+	latestRelease release
+	latestErr     error
+)
+
+// release holds the details of one Arch release, as reported by the releng API.
+type release struct {
+	Version    string `json:"version"`
+	Available  bool   `json:"available"`
+	TorrentURL string `json:"torrent_url"`
+	MagnetURI  string `json:"magnet_uri"`
+	SHA256Sum  string `json:"sha256_sum"`
+	B2Sum      string `json:"b2_sum"`
+}
+
+// filename returns the name of the release's ISO file.
+func (r release) filename() string {
+	return "archlinux-" + r.Version + "-x86_64.iso"
+}
+
+// getLatestRelease returns the latest available release. The releng API is only queried the first time this is called.
+func getLatestRelease(ctx context.Context) (release, error) {
+	latestOnce.Do(func() {
+		latestRelease, latestErr = getRelease(ctx, "")
+		if latestErr != nil {
+			fmt.Println("Error querying releng API:", latestErr)
+		}
+	})
+
+	return latestRelease, latestErr
+}
+
+// getRelease asks the releng API for the release with the given version, or the latest available release if version is
+// empty. Like with mirrors, the request is retried if it fails for a reason that's likely to go away.
+func getRelease(ctx context.Context, version string) (release, error) {
+	var data struct {
+		Releases []release `json:"releases"`
+	}
+	err := retry(ctx, "querying the releng API", func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", relengAPI, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return responseError(resp)
+		}
+
+		return json.NewDecoder(resp.Body).Decode(&data)
+	})
+	if err != nil {
+		return release{}, err
+	}
+
+	// The API is served by archlinux.org itself, so its checksums are as good as signed, unless we weren't checking
+	// who we were talking to.
+	if !*insecureFlag {
+		for _, r := range data.Releases {
+			setAuthenticated(r.SHA256Sum, r.B2Sum)
+		}
+	}
+
+	// Releases are listed newest first.
+	for _, r := range data.Releases {
+		if r.Available && (version == "" || r.Version == version) {
+			return r, nil
+		}
+	}
+
+	if version != "" {
+		return release{}, fmt.Errorf("release %v not found", version)
+	}
+	return release{}, fmt.Errorf("no available releases")
+}
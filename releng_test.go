@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetReleaseRetries(t *testing.T) {
+	// The first request fails the way an overloaded server does, which is worth retrying.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"releases": [
+			{"version": "2024.02.01", "available": false},
+			{"version": "2024.01.01", "available": true, "sha256_sum": "abc"},
+			{"version": "2023.12.01", "available": true, "sha256_sum": "def"}
+		]}`)
+	}))
+	defer server.Close()
+	defer func(api string) { relengAPI = api }(relengAPI)
+	relengAPI = server.URL
+
+	r, err := getRelease(context.Background(), "")
+	if err != nil {
+		t.Fatalf("getRelease() returned error: %v", err)
+	}
+	if r.Version != "2024.01.01" || requests != 2 {
+		t.Errorf("getRelease() = %v after %v requests, want 2024.01.01 after 2", r.Version, requests)
+	}
+
+	r, err = getRelease(context.Background(), "2023.12.01")
+	if err != nil || r.SHA256Sum != "def" {
+		t.Errorf("getRelease(2023.12.01) = %+v, %v", r, err)
+	}
+	if _, err := getRelease(context.Background(), "2024.02.01"); err == nil {
+		t.Error("getRelease() returned a release that isn't available")
+	}
+}
+
+func TestGetReleaseCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	defer func(api string) { relengAPI = api }(relengAPI)
+	relengAPI = server.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := getRelease(ctx, ""); err == nil {
+		t.Error("getRelease() succeeded with a canceled context")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// removedError is what went wrong when the drive was unplugged while we were using it. Whatever error that caused
+// first is kept, but it isn't worth showing, since every error after it would say the same thing in a different way.
+type removedError struct {
+	usb string
+	err error
+}
+
+func (e *removedError) Error() string {
+	return fmt.Sprintf("%v was removed (or stopped responding) while flasharch was using it", e.usb)
+}
+
+func (e *removedError) Unwrap() error {
+	return e.err
+}
+
+// driveRemoved reports whether or not the error from using the drive came from the drive going away. The kernel says
+// so with ENODEV and the like, but a write that was under way usually just fails with EIO, so we also look for the
+// device itself: udev removes its node, and the kernel removes it from sysfs.
+func driveRemoved(usb string, err error) bool {
+	var removed *removedError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &removed):
+		return true
+	case errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO) || errors.Is(err, syscall.ENOMEDIUM):
+		return true
+	}
+
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	if checkBlockDevice(dev) != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join("/sys/class/block", filepath.Base(dev)))
+
+	return os.IsNotExist(err)
+}
+
+// adviseReplug tells the user what to do about the drives that were removed while they were being flashed: plug them
+// back in, and flash them again. Everything is left in place when a drive fails, so the next run won't have to
+// download the ISO again, and if it isn't cached, the ISO can be flashed again with the flash subcommand.
+func adviseReplug(isoFile string, cached bool, targets []*target) {
+	var removed []string
+	for _, t := range targets {
+		var e *removedError
+		if errors.As(t.err, &e) {
+			removed = append(removed, t.usb)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	fmt.Println("Plug", strings.Join(removed, " and "), "back in, and then run flasharch again",
+		"(the drive's name might change)")
+	switch {
+	case cached:
+		fmt.Println("The ISO is cached, so it won't be downloaded again")
+	case isoFile != "":
+		fmt.Println("To flash it without downloading it again, run: flasharch flash", isoFile,
+			strings.Join(removed, " "))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// reporter is where a flash reports what it's doing. Flashing one drive reports straight to the terminal, redrawing the
+// progress line in place. Flashing several drives at once gives each one a line of its own on a board, which shows the
+// latest thing that each of them reported.
+type reporter struct {
+	board *board
+	line  int
+	name  string
+}
+
+// terminal reports straight to the terminal.
+var terminal = &reporter{}
+
+// progress shows the status in place of the last one.
+func (r *reporter) progress(status string) {
+	if r.board != nil {
+		r.board.set(r.line, r.name+"  "+status)
+		return
+	}
+
+	// Clear the line.
+	fmt.Printf("\r%s", strings.Repeat(" ", 60))
+	fmt.Printf("\r%v", status)
+}
+
+// flush ends the progress line, so that whatever comes next starts on a line of its own.
+func (r *reporter) flush() {
+	if r.board == nil {
+		fmt.Printf("\n")
+	}
+}
+
+// println reports a message.
+func (r *reporter) println(a ...interface{}) {
+	if r.board != nil {
+		r.board.set(r.line, r.name+"  "+strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+		return
+	}
+
+	fmt.Println(a...)
+}
+
+// board shows a line for each drive that's being flashed, and redraws all of them whenever one changes.
+type board struct {
+	mu    sync.Mutex
+	lines []string
+	drawn int
+}
+
+// newBoard returns a board with a line for each of the names.
+func newBoard(names []string) *board {
+	return &board{lines: append([]string(nil), names...)}
+}
+
+// reporter returns the reporter for the board's ith line, which is about the named drive.
+func (b *board) reporter(i int, name string) *reporter {
+	return &reporter{board: b, line: i, name: name}
+}
+
+// set changes the ith line and redraws the board. Lines are cut to the width of the terminal, because a line that
+// wrapped would throw off how far up we go to redraw them.
+func (b *board) set(i int, s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines[i] = s
+	b.draw()
+}
+
+// draw prints every line over the ones that were last drawn.
+func (b *board) draw() {
+	if b.drawn > 0 {
+		fmt.Printf("\x1b[%dA", b.drawn)
+	}
+	width := terminalWidth() - 1
+	for _, line := range b.lines {
+		if len(line) > width {
+			line = line[:width]
+		}
+		fmt.Printf("\r\x1b[2K%v\n", line)
+	}
+	b.drawn = len(b.lines)
+}
+
+// terminalWidth returns how many columns the terminal on stdout has, or 80 if it isn't a terminal.
+func terminalWidth() int {
+	var ws struct {
+		rows, cols, x, y uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.cols == 0 {
+		return 80
+	}
+
+	return int(ws.cols)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// These are the file systems that restore can make, for --fs.
+const (
+	fsFAT32 = "fat32"
+	fsExFAT = "exfat"
+)
+
+// Drives up to fat32Max bytes get FAT32 without --fs, and bigger ones get exFAT, since that's where Windows stops
+// offering FAT32 too.
+const fat32Max = 32 << 30
+
+// These are the MBR partition types for FAT32 (with LBA) and exFAT.
+const (
+	mbrFAT32 = 0x0c
+	mbrExFAT = 0x07
+)
+
+// restoring is whether or not we're turning the drives back into data drives instead of flashing them.
+var restoring bool
+
+// These options are about getting and flashing an image, so restore doesn't take them.
+var notForRestore = map[string]bool{"iso": true, "download-only": true, "stream": true, "copy-to": true,
+	"ventoy": true, "persistence": true, "wipe": true, "no-wipe": true, "backend": true, "use-dd": true,
+	"quick-verify": true, "no-discard": true}
+
+// checkRestore handles the restore subcommand, which makes the drives normal data drives again after they've been
+// flashed: "restore /dev/sdb". Options can come after restore too, so the arguments are parsed again from there, which
+// leaves the drives as the arguments. --fs and --label only mean anything to restore.
+func checkRestore() error {
+	if flag.Arg(0) != "restore" {
+		var err error
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "fs" || f.Name == "label" {
+				err = fmt.Errorf("--%v only works with restore", f.Name)
+			}
+		})
+		return err
+	}
+	flag.CommandLine.Parse(flag.Args()[1:])
+	restoring = true
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if notForRestore[f.Name] && err == nil {
+			err = fmt.Errorf("restore does not take --%v", f.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	switch *fsFlag {
+	case "", fsFAT32, fsExFAT:
+	default:
+		return fmt.Errorf("invalid --fs: must be fat32 or exfat")
+	}
+	if err := checkLabel(*labelFlag, *fsFlag); err != nil {
+		return fmt.Errorf("invalid --label: %v", err)
+	}
+
+	return nil
+}
+
+// checkLabel makes sure that the label fits the file system: 11 characters for FAT32 and 15 for exFAT. Without --fs,
+// the label has to fit either one.
+func checkLabel(label, fs string) error {
+	max := 11
+	if fs == fsExFAT {
+		max = 15
+	}
+	switch {
+	case label == "":
+		return fmt.Errorf("can't be empty")
+	case len(label) > max:
+		return fmt.Errorf("%v is longer than %v characters", label, max)
+	}
+	for _, c := range label {
+		if c < ' ' || c > '~' || strings.ContainsRune(`"*/:<>?\|`, c) {
+			return fmt.Errorf("%v has a character that can't be in a label: %q", label, c)
+		}
+	}
+
+	return nil
+}
+
+// action is what we're about to do to the drives, for the questions and messages that ask about it.
+func action() string {
+	switch {
+	case restoring:
+		return "restore"
+	case benchmarking:
+		return "benchmark"
+	}
+
+	return "flash"
+}
+
+// acting is action as in "not flashing".
+func acting() string {
+	switch {
+	case restoring:
+		return "restoring"
+	case benchmarking:
+		return "benchmarking"
+	}
+
+	return "flashing"
+}
+
+// checkRestorable makes sure that the drive can be restored. It has to be a block device, since the file system is
+// made on its partition. A drive that isn't removable (or attached over USB) is much more likely to be an internal
+// disk that was given by mistake than a USB drive, so it's only restored with --force.
+func checkRestorable(usb string) error {
+	if err := checkBlockDevice(usb); err != nil {
+		return fmt.Errorf("can't restore %v: it isn't a block device", usb)
+	}
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return err
+	}
+	if !isRemovable(filepath.Join(sysBlock, filepath.Base(dev))) {
+		return enforce("removable", checkForceable, fmt.Errorf("%v isn't a removable or USB drive", usb))
+	}
+
+	return nil
+}
+
+// restoreTargets restores every drive that's still good, one after another, and reports whether or not all of them
+// were restored.
+func restoreTargets(targets []*target) bool {
+	restored := 0
+	for _, t := range targets {
+		if t.err != nil {
+			continue
+		}
+		fmt.Println("Restoring", t.usb)
+		if err := restoreDrive(t.usb); err != nil {
+			t.fail("Error restoring drive", err, terminal)
+			continue
+		}
+		restored++
+	}
+	if len(targets) == 1 && restored == 1 {
+		fmt.Println("Restore complete (flasharch " + getVersion() + ")")
+	} else if len(targets) > 1 {
+		fmt.Printf("Restored %v of %v drives (flasharch %v)\n", restored, len(targets), getVersion())
+		for _, t := range targets {
+			if t.err != nil {
+				fmt.Printf("\t%v: FAILED: %v: %v\n", t.usb, t.stage, t.err)
+			} else {
+				fmt.Printf("\t%v: OK\n", t.usb)
+			}
+		}
+	}
+	printOverridden()
+
+	return restored == len(targets)
+}
+
+// restoreDrive turns the drive back into a normal data drive. Every old signature is wiped, the start of the drive is
+// cleared of what the ISO left there, and a new MBR gets a single partition that spans the rest of the drive from the
+// first MiB. That partition is formatted with --fs (FAT32 or exFAT, depending on the drive's size, without it) and
+// labelled with --label. An MBR is used because it's what every system expects to find on a USB drive.
+func restoreDrive(usb string) error {
+	capacity, err := deviceSize(usb)
+	if err != nil {
+		return err
+	}
+	if capacity <= 0 {
+		return fmt.Errorf("can't tell how big %v is", usb)
+	}
+	fs := *fsFlag
+	if fs == "" {
+		fs = fsFAT32
+		if capacity > fat32Max {
+			fs = fsExFAT
+		}
+	}
+	mkfs, partType := "mkfs.fat", byte(mbrFAT32)
+	args := []string{"-F", "32", "-n", *labelFlag}
+	if fs == fsExFAT {
+		mkfs, partType = "mkfs.exfat", mbrExFAT
+		args = []string{"-L", *labelFlag}
+	}
+	if _, err := exec.LookPath(mkfs); err != nil {
+		pkg := tools[mkfs]
+		return fmt.Errorf("%v is required to make %v but not installed (pacman: %v, apt: %v)", mkfs, fs, pkg[0], pkg[1])
+	}
+
+	if err := wipeDrive(usb, terminal); err != nil {
+		return err
+	}
+	device, err := os.OpenFile(usb, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	sector, err := sectorSize(device)
+	if err != nil {
+		return fmt.Errorf("error reading the sector size of %v: %v", usb, err)
+	}
+	start := partitionAlign / sector
+	count := capacity/sector - start
+	if count <= 0 {
+		return fmt.Errorf("%v is too small to hold a partition", usb)
+	}
+	if start+count > 0xffffffff {
+		return fmt.Errorf("%v is too big for an MBR", usb)
+	}
+
+	// Clear out the first MiB, where the ISO's boot code and partition tables were, and write the new MBR over it.
+	if _, err := device.WriteAt(make([]byte, partitionAlign), 0); err != nil {
+		return fmt.Errorf("error clearing the start of %v: %v", usb, err)
+	}
+	mbr := make([]byte, sector)
+	if _, err := rand.Read(mbr[440:444]); err != nil {
+		return err
+	}
+	e := mbr[mbrEntries:]
+	copy(e[1:4], []byte{0xfe, 0xff, 0xff}) // The CHS addresses say to use the LBA ones instead.
+	e[4] = partType
+	copy(e[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(e[8:], uint32(start))
+	binary.LittleEndian.PutUint32(e[12:], uint32(count))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := device.WriteAt(mbr, 0); err != nil {
+		return fmt.Errorf("error writing the partition table to %v: %v", usb, err)
+	}
+	if err := device.Sync(); err != nil {
+		return fmt.Errorf("error syncing %v: %v", usb, err)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), blkRRPart, 0); errno != 0 {
+		return fmt.Errorf("error re-reading the partition table of %v: %v", usb, errno)
+	}
+
+	part, err := waitForPartition(usb, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Formatting", part, "as", fs, "with the label", *labelFlag)
+	output, err := exec.Command(mkfs, append(args, part)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error formatting %v: %v", part, commandError(output, err))
+	}
+
+	fmt.Println("Layout of", usb+":")
+	fmt.Println("\tPartition table: MBR")
+	fmt.Printf("\t%v: %v %v labelled %v, from byte %v to the end of the drive\n", part, reduce(int(count*sector)),
+		fs, *labelFlag, start*sector)
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// resumeFile returns the path to the file that remembers which version of a partial download we have.
+func resumeFile(filename string) string {
+	return filename + ".resume"
+}
+
+// readResume returns the validator (ETag or Last-Modified) and total size of the file that we started downloading in a
+// previous run. If we don't know them, the validator is empty.
+func readResume(filename string) (string, int64) {
+	data, err := ioutil.ReadFile(resumeFile(filename))
+	if err != nil {
+		return "", 0
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 && len(lines) != 3 {
+		return "", 0
+	}
+	total, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+
+	return lines[0], total
+}
+
+// writeResume saves the validator and total size of the file that we're downloading, so that a later run can pick up
+// where this one leaves off.
+func writeResume(filename, validator string, total int64) error {
+	return ioutil.WriteFile(resumeFile(filename), []byte(validator+"\n"+strconv.FormatInt(total, 10)+"\n"), 0644)
+}
+
+// readChunks returns the size of the chunks that a download from several mirrors at once split the file into and which
+// of them are finished, if that's how the partial download was made. Otherwise, the list is nil.
+func readChunks(filename string) (int64, []bool) {
+	data, err := ioutil.ReadFile(resumeFile(filename))
+	if err != nil {
+		return 0, nil
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		return 0, nil
+	}
+	total, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	fields := strings.Fields(lines[2])
+	if len(fields) != 2 {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size <= 0 || int64(len(fields[1])) != (total+size-1)/size {
+		return 0, nil
+	}
+
+	done := make([]bool, len(fields[1]))
+	for i, c := range fields[1] {
+		done[i] = c == '1'
+	}
+
+	return size, done
+}
+
+// writeChunks saves the validator and total size of the file that we're downloading from several mirrors at once,
+// along with the size of its chunks and which of them are finished, so that a later run only downloads the rest.
+func writeChunks(filename, validator string, total, size int64, done []bool) error {
+	bits := make([]byte, len(done))
+	for i, ok := range done {
+		bits[i] = '0'
+		if ok {
+			bits[i] = '1'
+		}
+	}
+	data := fmt.Sprintf("%v\n%v\n%v %s\n", validator, total, size, bits)
+
+	return ioutil.WriteFile(resumeFile(filename), []byte(data), 0644)
+}
+
+// removeResume forgets about any partial download of the file.
+func removeResume(filename string) {
+	os.Remove(resumeFile(filename))
+}
+
+// parseContentRange pulls the first byte and total size out of a Content-Range header, e.g. "bytes 100-199/1000".
+func parseContentRange(header string) (int64, int64, error) {
+	var start, end, total int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", header)
+	}
+
+	return start, total, nil
+}
+
+// validatorsFile returns the path to the file that remembers which version of a complete download we have.
+func validatorsFile(filename string) string {
+	return filename + ".validators"
+}
+
+// readValidators returns the ETag and Last-Modified headers that the file was served with. Either can be empty if the
+// server didn't send it or we didn't save it.
+func readValidators(filename string) (string, string) {
+	data, err := ioutil.ReadFile(validatorsFile(filename))
+	if err != nil {
+		return "", ""
+	}
+
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 2 {
+		return "", ""
+	}
+
+	return lines[0], lines[1]
+}
+
+// writeValidators saves the ETag and Last-Modified headers that the file was served with, so that a later run can ask
+// the server whether the file has changed since. If there are neither, any saved ones are removed.
+func writeValidators(filename, etag, modified string) error {
+	if etag == "" && modified == "" {
+		removeValidators(filename)
+		return nil
+	}
+
+	return ioutil.WriteFile(validatorsFile(filename), []byte(etag+"\n"+modified+"\n"), 0644)
+}
+
+// removeValidators forgets about the version of the file that we have.
+func removeValidators(filename string) {
+	os.Remove(validatorsFile(filename))
+}
+
+// isCurrent reports whether or not the file that an earlier run downloaded from the url is still the same as the one on
+// the server, going by the ETag and Last-Modified headers that it was served with.
+func isCurrent(ctx context.Context, url, filename string) bool {
+	etag, modified := readValidators(filename)
+	if (etag == "" && modified == "") || !isHTTP(url) {
+		return false
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() == 0 {
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return false
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	} else {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == 304
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// These bound how long we'll wait between attempts of a failed request. The delay doubles after every attempt.
+var (
+	retryBase = 1 * time.Second
+	retryMax  = 30 * time.Second
+)
+
+// If a server asks us to wait longer than this before trying again, we'll try the next mirror instead.
+var retryAfterMax = 2 * time.Minute
+
+// statusError is returned when a server responds with a status that we didn't expect.
+type statusError struct {
+	code   int
+	status string
+
+	// This is how long the server asked us to wait before trying again, if it said.
+	retryAfter time.Duration
+}
+
+func (e statusError) Error() string {
+	return e.status
+}
+
+// responseError returns the error for a response with a status that we didn't expect, including how long the server
+// asked us to wait before trying again.
+func responseError(resp *http.Response) statusError {
+	return statusError{resp.StatusCode, resp.Status, parseRetryAfter(resp.Header.Get("Retry-After"))}
+}
+
+// parseRetryAfter returns how long a Retry-After header tells us to wait. It can be either a number of seconds or a
+// date. If the header is missing or invalid, it returns 0.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// retry calls f until it succeeds, it fails with an error that isn't worth retrying, it has been retried as many times
+// as --retries allows, or the context is done. what describes the operation for the messages printed between attempts.
+func retry(ctx context.Context, what string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || ctx.Err() != nil || !isTransient(err) || attempt >= *retriesFlag {
+			return err
+		}
+
+		// If the server told us how long to wait, we'll do as it says, as long as it's not too long.
+		delay := backoff(attempt)
+		fmt.Printf("\n") // Flush last progress line.
+		var se statusError
+		if errors.As(err, &se) && se.retryAfter > 0 {
+			if se.retryAfter > retryAfterMax {
+				return fmt.Errorf("%w (mirror asked us to wait %v)", err, se.retryAfter.Round(time.Second))
+			}
+			delay = se.retryAfter
+			fmt.Printf("Error %v: %v (mirror asked us to wait %v)\n", what, err, delay.Round(time.Second))
+		} else {
+			fmt.Printf("Error %v: %v (retrying in %v)\n", what, err, delay.Round(100*time.Millisecond))
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff returns how long to wait before the next attempt. Some jitter is added so that clients which failed at the
+// same time don't all come back at the same time.
+func backoff(attempt int) time.Duration {
+	delay := retryMax
+	if attempt < 16 && retryBase<<uint(attempt) < retryMax {
+		delay = retryBase << uint(attempt)
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isTransient reports whether or not the error is likely to go away if we try again. Timeouts, dropped connections,
+// server errors, and rate limits are transient. Other client errors (like 404) are not.
+func isTransient(err error) bool {
+	var se statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == 429
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
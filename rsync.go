@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// isRsync reports whether or not the URL points to an rsync mirror.
+func isRsync(url string) bool {
+	return strings.HasPrefix(url, "rsync://")
+}
+
+// checkRsync makes sure that the rsync binary is available if any of the mirrors need it.
+func checkRsync(mirrors []string) error {
+	for _, mirror := range mirrors {
+		if isRsync(mirror) {
+			if _, err := exec.LookPath("rsync"); err != nil {
+				return fmt.Errorf("rsync is required for %v but is not installed", mirror)
+			}
+			if err := checkCommandProxy("rsync"); err != nil {
+				return fmt.Errorf("cannot use %v: %v", mirror, err)
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// rsyncCommand builds the rsync command with the given arguments. If we're using a proxy, rsync is told to use it too.
+func rsyncCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "rsync", append(familyArgs(), args...)...)
+
+	// rsync wants the proxy without a scheme, e.g. "user:pass@proxy.example.org:3128".
+	if u, err := url.Parse(commandProxy()); err == nil && u.Host != "" {
+		proxy := u.Host
+		if u.User != nil {
+			proxy = u.User.String() + "@" + proxy
+		}
+		cmd.Env = append(os.Environ(), "RSYNC_PROXY="+proxy)
+	}
+
+	return cmd
+}
+
+// rsyncFilename lists the rsync mirror's directory and pulls out the name of the ISO file that we will download.
+func rsyncFilename(ctx context.Context, url string) (string, error) {
+	output, err := rsyncCommand(ctx, "--list-only", url+"/").Output()
+	if err != nil {
+		return "", fmt.Errorf("error accessing mirror: %v", err)
+	}
+
+	// Each line of the listing looks like this, with the filename last:
+	// -rw-r--r--    868,366,336 2021/01/01 12:00:00 archlinux-2021.01.01-x86_64.iso
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if name := fields[len(fields)-1]; strings.HasSuffix(name, ".iso") {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("mirror does not have the latest ISO")
+}
+
+// rsyncFile downloads the file at the rsync url. rsync shows its own progress. If the transfer is interrupted, the
+// partial file is kept so that the next rsync mirror can resume it.
+func rsyncFile(ctx context.Context, url, filename string) error {
+	cmd := rsyncCommand(ctx, "--partial", "--progress", url, filename)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// These are the phases that an interrupt can arrive in.
+const (
+	phaseDownload int32 = iota
+	phaseInterrupted
+	phaseFlash
+	phaseVerify
+	phaseZero
+	phaseZeroStopped
+	phaseSeed
+)
+
+// phase is the phase we're in. It's only accessed atomically.
+var phase = phaseDownload
+
+// stopSeeding stops seeding the ISO. It's set before we move into the seed phase.
+var stopSeeding context.CancelFunc
+
+// These are the files that we've started downloading, in case we need to clean them up.
+var (
+	downloadsMu sync.Mutex
+	downloads   []string
+)
+
+// handleSignals cancels the download when we're interrupted or terminated. While --wipe zeroes the drives, it stops the
+// zeroing and the run. Once flashing has begun, we stop right away and leave the downloaded files in place, since the
+// drive is only partly written and has to be flashed again anyway. The same goes for reading the drive back to verify
+// it, where there's nothing to clean up. While we seed the ISO afterward, signals only stop the seeding.
+func handleSignals(cancel context.CancelFunc) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range ch {
+			if atomic.CompareAndSwapInt32(&phase, phaseDownload, phaseInterrupted) {
+				fmt.Printf("\nReceived %v, stopping download\n", sig)
+				cancel()
+			} else if atomic.CompareAndSwapInt32(&phase, phaseZero, phaseZeroStopped) {
+				fmt.Printf("\nReceived %v, stopping zeroing\n", sig)
+			} else if atomic.LoadInt32(&phase) == phaseFlash {
+				fmt.Printf("\nReceived %v while flashing, leaving downloaded files in place\n", sig)
+				fmt.Println("The drive is only partly written and won't boot until it's flashed again")
+				os.Exit(1)
+			} else if atomic.LoadInt32(&phase) == phaseVerify {
+				fmt.Printf("\nReceived %v, stopping verification of the flashed drive\n", sig)
+				os.Exit(1)
+			} else if atomic.LoadInt32(&phase) == phaseSeed {
+				fmt.Printf("\nReceived %v, stopping seeding\n", sig)
+				stopSeeding()
+			}
+		}
+	}()
+}
+
+// startZero moves us into the zero phase, where an interrupt stops the zeroing. It returns false if we were interrupted
+// before we got here.
+func startZero() bool {
+	return atomic.CompareAndSwapInt32(&phase, phaseDownload, phaseZero)
+}
+
+// startFlash moves us into the flash phase, after which an interrupt won't clean anything up. It returns false if we
+// were interrupted before we got here.
+func startFlash() bool {
+	return atomic.CompareAndSwapInt32(&phase, phaseDownload, phaseFlash) ||
+		atomic.CompareAndSwapInt32(&phase, phaseZero, phaseFlash)
+}
+
+// exitIfZeroStopped exits if an interrupt stopped the zeroing. The drives haven't been flashed, so there's nothing on
+// them worth keeping, and the ISO is left where it is so that the next run doesn't download it again.
+func exitIfZeroStopped() {
+	if atomic.LoadInt32(&phase) != phaseZeroStopped {
+		return
+	}
+	fmt.Println("Interrupted before flashing, leaving downloaded files in place")
+	os.Exit(1)
+}
+
+// startVerify moves us from the flash phase into the verify phase, where an interrupt stops us right away.
+func startVerify() {
+	atomic.CompareAndSwapInt32(&phase, phaseFlash, phaseVerify)
+}
+
+// startSeed moves us into the seed phase, where an interrupt calls stop. We can get there once we're done with the ISO,
+// whether or not we flashed it. It returns false if we were interrupted before we got here.
+func startSeed(stop context.CancelFunc) bool {
+	stopSeeding = stop
+	for _, from := range []int32{phaseDownload, phaseFlash, phaseVerify} {
+		if atomic.CompareAndSwapInt32(&phase, from, phaseSeed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trackDownload remembers that we've started downloading the file.
+func trackDownload(filename string) {
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+
+	for _, f := range downloads {
+		if f == filename {
+			return
+		}
+	}
+	downloads = append(downloads, filename)
+}
+
+// exitIfInterrupted cleans up and exits if we were interrupted. Partial downloads that can be resumed are kept, and
+// everything else that we downloaded is removed.
+func exitIfInterrupted() {
+	if atomic.LoadInt32(&phase) != phaseInterrupted {
+		return
+	}
+
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+
+	for _, filename := range downloads {
+		if _, err := os.Stat(filename); err != nil {
+			continue
+		}
+		if validator, _ := readResume(filename); validator != "" {
+			fmt.Println("Keeping partial download for the next run:", filename)
+			continue
+		}
+		if err := os.Remove(filename); err != nil {
+			fmt.Println("Error removing", filename+":", err)
+			continue
+		}
+		fmt.Println("Removed", filename)
+	}
+
+	fmt.Println("Interrupted")
+	os.Exit(1)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are the fingerprints of the keys that Arch's release engineers sign the ISOs with, as published on
+// https://archlinux.org/download/. Unless archlinux-keyring is installed to vouch for the signing key, a good signature
+// from any other key fails the check unless --trust-any-key is given, because gpg will fetch whatever key a signature
+// names and call its signature good.
+var releaseSigners = []signer{
+	{"3E80CA1A8B89F69CBA57D98A76A5EF9054449A5C", "pierre@archlinux.org"}, // Pierre Schmitz
+	{"4AA4767BBC9C4B1D18AE28B77F2D434B9741E8AC", "pierre@archlinux.org"}, // Pierre Schmitz, until 2022
+}
+
+// Arch Linux ARM signs its images with the key of its build system.
+var armSigners = []signer{
+	{"68B3537F39A313B3E574D06777193F152BDBE6A6", "builder@archlinuxarm.org"}, // Arch Linux ARM Build System
+}
+
+// If gpg doesn't have the signing key and WKD can't give it to us, we'll look for it on these keyservers, in order,
+// unless --keyserver says otherwise. keys.openpgp.org is flaky at times, so each one only gets keyserverTimeout.
+var (
+	keyservers       = []string{"hkps://keys.openpgp.org", "hkps://keyserver.ubuntu.com", "hkps://pgp.mit.edu"}
+	keyserverTimeout = 20 * time.Second
+)
+
+// keyserverList holds the keyservers given on the command line, in order.
+type keyserverList []string
+
+func (k *keyserverList) String() string {
+	return strings.Join(*k, ",")
+}
+
+// Set validates the keyserver and adds it to the list. A bare hostname is taken to mean hkps.
+func (k *keyserverList) Set(value string) error {
+	if !strings.Contains(value, "://") {
+		value = "hkps://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "hkp", "hkps", "http", "https":
+	default:
+		return fmt.Errorf("unsupported keyserver scheme: %v", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("keyserver has no host: %v", value)
+	}
+	*k = append(*k, value)
+
+	return nil
+}
+
+// These are the exit codes for a signature check that fails, so that scripts can tell an image that must not be used
+// from one that just couldn't be checked.
+const (
+	exitBadSig   = 3
+	exitNoSigKey = 4
+)
+
+// sigError is a signature check that failed. bad is true if the signature is wrong, which means that the image must not
+// be used, and false if we couldn't get the key to check it with.
+type sigError struct {
+	msg string
+	bad bool
+}
+
+func (e sigError) Error() string {
+	if e.bad {
+		return "the signature is invalid, do not use this image: " + e.msg
+	}
+	return "couldn't check the signature: " + e.msg
+}
+
+// badSig returns a sigError for a signature that's wrong.
+func badSig(format string, a ...interface{}) error {
+	return sigError{msg: fmt.Sprintf(format, a...), bad: true}
+}
+
+// noSigKey returns a sigError for a signature that we don't have the key to check.
+func noSigKey(format string, a ...interface{}) error {
+	return sigError{msg: fmt.Sprintf(format, a...)}
+}
+
+// exitCode returns the code to exit with because of the error.
+func exitCode(err error) int {
+	if errors.As(err, &partialStreamError{}) {
+		return exitPartialStream
+	}
+	var sigErr sigError
+	if !errors.As(err, &sigErr) {
+		return 1
+	}
+	if sigErr.bad {
+		return exitBadSig
+	}
+	return exitNoSigKey
+}
+
+// signer is a key that's allowed to sign the image, along with the address that its owner publishes it under through
+// WKD.
+type signer struct {
+	fingerprint string
+	email       string
+}
+
+// sigCheck checks whatever is written to it against a detached signature. Close reports whether or not the signature is
+// good, and report returns what to tell the user about it afterwards. signer returns the fingerprint of the primary key
+// that made a good signature, and trust says why that key is trusted.
+type sigCheck interface {
+	io.WriteCloser
+	report() string
+	signer() string
+	trust() string
+}
+
+// gpgCheck is a sigCheck that gpg (or gpgv) does for us. gpg's status lines tell us how the check went and which key
+// made the signature, independent of gpg's locale. keyring is the file that gpgv checks against, if any, and tmpKeyring
+// is the dearmored copy of it that's removed when the check is done. source says where the keys came from.
+type gpgCheck struct {
+	*commandWriter
+	status     bytes.Buffer
+	keyring    string
+	tmpKeyring string
+	source     string
+	signedBy   string
+	trustedAs  string
+	result     string
+}
+
+// Close waits for gpg to finish and makes sure that the signature was made by a pinned key. If it wasn't good, the
+// status lines say why, so that a bad signature isn't mistaken for a missing key or the other way around.
+func (g *gpgCheck) Close() error {
+	err := g.commandWriter.Close()
+	if g.tmpKeyring != "" {
+		os.Remove(g.tmpKeyring)
+	}
+	status := parseStatus(g.status.String())
+
+	// These are the status lines we care about, where <key> is the long key ID unless said otherwise:
+	// "[GNUPG:] BADSIG <key> <user ID>"
+	// "[GNUPG:] REVKEYSIG <key> <user ID>"
+	// "[GNUPG:] EXPKEYSIG <key> <user ID>"
+	// "[GNUPG:] NO_PUBKEY <key>"
+	// "[GNUPG:] ERRSIG <key> <algo> <hash> <class> <timestamp> <rc> <fingerprint>"
+	// "[GNUPG:] GOODSIG <key> <user ID>"
+	// "[GNUPG:] VALIDSIG <fingerprint> <date> <timestamp> <expires> <version> 0 <algo> <hash> <class> <fingerprint>"
+	switch {
+	case status["BADSIG"] != nil:
+		return badSig("BAD signature from key %v", status["BADSIG"][0])
+	case status["REVKEYSIG"] != nil:
+		return badSig("signed with key %v, which has been revoked", status["REVKEYSIG"][0])
+	case status["EXPKEYSIG"] != nil:
+		return noSigKey("signed with key %v, which has expired; refresh it with gpg --refresh-keys and try again",
+			status["EXPKEYSIG"][0])
+	case status["NO_PUBKEY"] != nil && g.keyring != "":
+		return noSigKey("signing key %v is not in %v", status["NO_PUBKEY"][0], g.keyring)
+	case status["NO_PUBKEY"] != nil:
+		return noSigKey("couldn't fetch signing key %v; check your network or import the key manually",
+			status["NO_PUBKEY"][0])
+	case status["ERRSIG"] != nil:
+		fields := status["ERRSIG"]
+		if len(fields) > 5 && fields[5] == "4" {
+			return noSigKey("key %v uses an algorithm that gpg doesn't support", fields[0])
+		}
+		return noSigKey("gpg couldn't check the signature from key %v", fields[0])
+	case err != nil:
+		return err
+	case status["GOODSIG"] != nil && len(status["VALIDSIG"]) > 2:
+		fields := status["VALIDSIG"]
+		g.signedBy = fields[len(fields)-1]
+		trust, err := checkSigner(fields[0], g.signedBy)
+		if err != nil {
+			return err
+		}
+		uid := strings.Join(status["GOODSIG"][1:], " ")
+		if s, err := url.PathUnescape(uid); err == nil {
+			uid = s
+		}
+		g.trustedAs = trust
+		g.result = sigSummary(uid, g.signedBy, statusTime(fields[2]), trust, g.source)
+		return nil
+	}
+
+	return fmt.Errorf("gpg didn't report a valid signature")
+}
+
+// parseStatus returns the arguments of each of the keywords in gpg's status output, keyed by keyword. If a keyword
+// shows up more than once, the first one wins.
+func parseStatus(status string) map[string][]string {
+	keywords := make(map[string][]string)
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		if _, ok := keywords[fields[1]]; !ok {
+			keywords[fields[1]] = append([]string{}, fields[2:]...)
+		}
+	}
+
+	return keywords
+}
+
+// report returns the summary of a good signature. gpg's own output is only added with --verbose.
+func (g *gpgCheck) report() string {
+	if *verboseFlag {
+		return g.result + "\ngpg said:\n" + strings.TrimSpace(g.stderr.String())
+	}
+	return g.result
+}
+
+func (g *gpgCheck) signer() string {
+	return g.signedBy
+}
+
+func (g *gpgCheck) trust() string {
+	return g.trustedAs
+}
+
+// pinnedSigners returns the keys that are allowed to sign the image.
+func pinnedSigners() []signer {
+	if isARM() {
+		return armSigners
+	}
+
+	return releaseSigners
+}
+
+// checkSigner makes sure that the signature was made by a key we trust, and returns why we trust it. fingerprints holds
+// the fingerprint of the key that made the signature and of its primary key. If archlinux-keyring is installed, the
+// primary key must be certified by Arch's master keys. Otherwise, one of the keys must be pinned.
+func checkSigner(fingerprints ...string) (string, error) {
+	var trust string
+	var err error
+	switch {
+	case !isARM() && haveArchKeyring():
+		var chain []string
+		if chain, err = checkCertified(fingerprints[len(fingerprints)-1]); err == nil {
+			trust = fmt.Sprintf("certified by %v of Arch's master keys in archlinux-keyring:\n%v", len(chain),
+				strings.Join(chain, "\n"))
+		}
+	case isARM():
+		if err = checkPinned(fingerprints...); err == nil {
+			trust = "pinned Arch Linux ARM signing key"
+		}
+	default:
+		if err = checkPinned(fingerprints...); err == nil {
+			trust = "pinned release signing key (archlinux-keyring isn't installed, so this is a weaker check)"
+		}
+	}
+	if err != nil && *trustAnyKeyFlag {
+		fmt.Println("WARNING: Accepting the signature anyway because of --trust-any-key:", err)
+		return "NOT trusted, accepted because of --trust-any-key", nil
+	}
+
+	return trust, err
+}
+
+// checkPinned makes sure that one of the keys is pinned, since either the key that made the signature or its primary
+// key can be the one that's pinned.
+func checkPinned(fingerprints ...string) error {
+	for _, fp := range fingerprints {
+		for _, pinned := range pinnedSigners() {
+			if strings.EqualFold(fp, pinned.fingerprint) {
+				return nil
+			}
+		}
+	}
+
+	return badSig("signed with key %v, which is not a known release signing key; pass --trust-any-key to accept it "+
+		"anyway", fingerprints[0])
+}
+
+// sigSummary returns what to tell the user about a good signature: who made it with which primary key and when, which
+// keys it was checked against, and why we trust that key.
+func sigSummary(uid, fingerprint string, created time.Time, trust, source string) string {
+	signedOn := "unknown"
+	if !created.IsZero() {
+		signedOn = formatTime(created)
+	}
+	trust = strings.ReplaceAll(trust, "\n", "\n           ")
+
+	return fmt.Sprintf("Signed by: %v\nKey:       %v\nSigned on: %v\nKeyring:   %v\nTrust:     %v", uid, fingerprint,
+		signedOn, source, trust)
+}
+
+// statusTime parses a timestamp from gpg's status lines, which is either in seconds since the epoch or in ISO 8601
+// form. It returns the zero time if it's neither.
+func statusTime(s string) time.Time {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0)
+	}
+	t, _ := time.Parse("20060102T150405", s)
+
+	return t
+}
+
+// printSigReport prints the report of a good signature, followed by a line that says it's good, in green if we're
+// printing to a terminal.
+func printSigReport(report string) {
+	for _, v := range strings.Split(report, "\n") {
+		fmt.Println("\t", v)
+	}
+
+	info, err := os.Stdout.Stat()
+	if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Println("\x1b[32mSignature OK\x1b[0m")
+	} else {
+		fmt.Println("Signature OK")
+	}
+}
+
+// useGPG reports whether or not signatures are checked by gpg (or gpgv, with --keyring) instead of against the built-in
+// release signing keys. Arch Linux ARM signs its images with its own key, which isn't built in.
+func useGPG() bool {
+	return *useGPGFlag || *keyringFlag != "" || isARM()
+}
+
+// startSigCheck starts checking whatever is written to the returned sigCheck against the signature. The keys are taken
+// from --keyring if it's given, or else from the system's pacman keyring if there is one, so that no keyserver is
+// needed. Otherwise, they're the built-in release signing keys, or gpg's keyring with --use-gpg.
+func startSigCheck(ctx context.Context, sigFile string) (sigCheck, error) {
+	switch {
+	case *keyringFlag != "":
+		return startGPGVCheck(ctx, sigFile, *keyringFlag, "--keyring "+*keyringFlag)
+	case !useGPG():
+		if keyring, source := systemKeyring(); keyring != "" {
+			return startGPGVCheck(ctx, sigFile, keyring, source)
+		}
+		return startPGPCheck(sigFile)
+	}
+
+	if err := fetchSigningKey(ctx, sigFile); err != nil {
+		return nil, err
+	}
+	g := &gpgCheck{source: "your gpg keyring"}
+	c, err := startCommand(ctx, &g.status, "gpg", "--status-fd", "1", "--verify", sigFile, "-")
+	if err != nil {
+		return nil, err
+	}
+	g.commandWriter = c
+
+	return g, nil
+}
+
+// verifySig checks everything that r has to offer against the signature and returns the finished check, which can say
+// what to tell the user about it. A file that can't be a signature is turned away before gpg sees it.
+func verifySig(ctx context.Context, sigFile string, r io.Reader) (sigCheck, error) {
+	if err := checkSigFile(sigFile); err != nil {
+		return nil, err
+	}
+	check, err := startSigCheck(ctx, sigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// If gpg gives up early, what it has to say matters more than the broken pipe.
+	_, err = io.Copy(check, r)
+	if cerr := check.Close(); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return check, nil
+}
+
+// fetchSigningKey makes sure that gpg has the key that made the signature, instead of leaving gpg to look for it on
+// whatever keyserver it's configured with. If the key is pinned, it's looked up through WKD first. Otherwise, or if
+// that fails, it's looked up on the keyservers.
+func fetchSigningKey(ctx context.Context, sigFile string) error {
+	key := sigIssuer(sigFile)
+	if key == "" || haveKey(ctx, key) {
+		return nil
+	}
+	if *offlineFlag {
+		return noSigKey("signing key %v isn't in your gpg keyring, and --offline keeps it from being fetched; pass "+
+			"--keyring", key)
+	}
+
+	fmt.Println("Fetching signing key", key)
+	var tried []string
+	for _, s := range pinnedSigners() {
+		if !strings.HasSuffix(s.fingerprint, key) {
+			continue
+		}
+		source := "WKD for " + s.email
+		err := runKeyFetch(ctx, key, "--auto-key-locate", "clear,nodefault,wkd", "--locate-external-keys", s.email)
+		if err == nil {
+			fmt.Println("Got signing key through", source)
+			return nil
+		}
+		fmt.Println("Couldn't get signing key through", source+":", err)
+		tried = append(tried, source)
+		break
+	}
+	for _, server := range getKeyservers() {
+		err := runKeyFetch(ctx, key, "--keyserver", server, "--recv-keys", key)
+		if err == nil {
+			fmt.Println("Got signing key from", server)
+			return nil
+		}
+		fmt.Println("Couldn't get signing key from", server+":", err)
+		tried = append(tried, server)
+	}
+
+	return noSigKey("couldn't fetch signing key %v (tried %v); check your network, or import the key manually or "+
+		"pass it with --keyring", key, strings.Join(tried, ", "))
+}
+
+// runKeyFetch runs gpg with the arguments to fetch the key, giving up after keyserverTimeout. It makes sure that gpg
+// really ended up with the key, and otherwise returns the last thing that gpg said.
+func runKeyFetch(ctx context.Context, key string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, keyserverTimeout)
+	defer cancel()
+
+	args = append([]string{"--batch"}, args...)
+	output, err := exec.CommandContext(ctx, "gpg", args...).CombinedOutput()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("timed out after %v", keyserverTimeout)
+	case err != nil:
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return fmt.Errorf("%v", lines[len(lines)-1])
+	case !haveKey(ctx, key):
+		return fmt.Errorf("key not found")
+	}
+
+	return nil
+}
+
+// getKeyservers returns the keyservers to look for signing keys on, in order: the ones given with --keyserver, or else
+// the default ones.
+func getKeyservers() []string {
+	if len(keyserverFlag) > 0 {
+		return keyserverFlag
+	}
+
+	return keyservers
+}
+
+// sigIssuer returns the fingerprint, or else the key ID, of the key that made the signature, or "" if the signature
+// can't be read. gpg can say what's wrong with it better than we can.
+func sigIssuer(sigFile string) string {
+	_, sig, err := readSigFile(sigFile)
+	if err != nil {
+		return ""
+	}
+
+	return sigIssuerOf(sig)
+}
+
+// haveKey reports whether or not gpg has the key in its keyring.
+func haveKey(ctx context.Context, key string) bool {
+	return exec.CommandContext(ctx, "gpg", "--batch", "--list-keys", key).Run() == nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// checkSkipVerify makes sure that --skip-verify isn't combined with anything that would leave nothing at all between a
+// tampered ISO and the USB drive, unless --sha256 is still there to catch it. If we're skipping verification, it warns
+// about it and asks for confirmation up front, before anything is downloaded, unless --yes is given.
+func checkSkipVerify() error {
+	switch {
+	case !*skipVerifyFlag:
+		return nil
+	case *insecureFlag && *sha256Flag == "":
+		return fmt.Errorf("--skip-verify does not work with --insecure: nothing would be left to catch a tampered ISO")
+	case *streamFlag:
+		return fmt.Errorf("--skip-verify does not work with --stream")
+	}
+
+	fmt.Println("!!! WARNING: --skip-verify was given !!!")
+	if *sha256Flag != "" {
+		fmt.Println("The ISO's signature will NOT be checked. The ISO will only be compared with the checksum given")
+		fmt.Println("with --sha256, so it's only as trustworthy as wherever that checksum came from.")
+	} else {
+		fmt.Println("The ISO will NOT be checked against its checksum or signature. It could be corrupt or")
+		fmt.Println("tampered with, and nothing will tell you. Its SHA-256 checksum will be printed so that you")
+		fmt.Println("can check it by hand later.")
+	}
+	if *yesFlag {
+		return nil
+	}
+	ok, err := confirm("Continue without verifying the ISO?")
+	if err != nil {
+		return fmt.Errorf("%v (pass --yes to skip verification without asking)", err)
+	}
+	if !ok {
+		return fmt.Errorf("not continuing without verification")
+	}
+
+	return nil
+}
+
+// skipVerification stands in for verifying the ISO when --skip-verify is given. It prints the ISO's SHA-256 checksum so
+// that it can be checked by hand against the published one, unless it was already checked against --sha256.
+func skipVerification(isoFile string) error {
+	if *sha256Flag != "" {
+		fmt.Println(filepath.Base(finalName(isoFile)), "matches --sha256, but its signature was not checked")
+		return nil
+	}
+
+	sum, err := fileDigest(isoFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Println("!!! VERIFICATION SKIPPED !!!")
+	fmt.Println(filepath.Base(finalName(isoFile)), "was not checked against its checksum or signature.")
+	fmt.Println("Compare its SHA-256 checksum with the published one before trusting anything booted from it:")
+	fmt.Println()
+	fmt.Println("\tSHA-256:", sum)
+	fmt.Println()
+
+	return nil
+}
+
+// unverified returns a note for the final message if the ISO wasn't verified, or "" if it was.
+func unverified() string {
+	switch {
+	case !*skipVerifyFlag:
+		return ""
+	case *sha256Flag != "":
+		return " -- signature NOT VERIFIED (--skip-verify), matched --sha256"
+	}
+
+	return " -- NOT VERIFIED (--skip-verify)"
+}
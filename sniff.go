@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This is how much of a file we look at to tell what it is, and how much of it we show when it isn't what it should be.
+const (
+	sniffSize   = 512
+	snippetSize = 300
+)
+
+// A detached signature is a single packet: an Ed25519 one is around 120 bytes, and an RSA 4096 one with its armor is
+// under 1 KiB. Anything far outside of that isn't a signature.
+const (
+	minSigSize = 80
+	maxSigSize = 10 << 10
+)
+
+// pageError is returned when a mirror sent a web page instead of the file we asked for. Captive portals and
+// misconfigured mirrors do this with a 200, so nothing else would catch it until gpg rejected the file.
+type pageError struct {
+	what    string
+	snippet string
+}
+
+func (e pageError) Error() string {
+	return fmt.Sprintf("mirror sent a web page instead of the %v (a captive portal or an error page?), "+
+		"which begins:\n%v", e.what, e.snippet)
+}
+
+// checkContentType makes sure that the server didn't say that it's sending a web page for the file. If it did, the
+// beginning of the page is read so that the user can see what it is.
+func checkContentType(resp *http.Response, filename string) error {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return nil
+	}
+
+	head := make([]byte, sniffSize)
+	n, _ := io.ReadFull(resp.Body, head)
+
+	return pageError{fileKind(filename), snippet(head[:n])}
+}
+
+// sniffFile looks at the beginning of the downloaded file to make sure that it's what it should be: an ISO mustn't be
+// a web page, and a signature has to pass checkSigFile.
+func sniffFile(filename string) error {
+	if fileKind(filename) == "signature" {
+		return checkSigFile(filename)
+	}
+
+	head, _, err := readHead(filename)
+	if err != nil {
+		return err
+	}
+	if looksLikeHTML(head) {
+		return pageError{"ISO", snippet(head)}
+	}
+
+	return nil
+}
+
+// checkSigFile makes sure that the signature is the right size for a signature and is either a binary OpenPGP
+// signature packet or ASCII armor, so that gpg isn't handed something that it can only fail on confusingly.
+func checkSigFile(sigFile string) error {
+	head, size, err := readHead(sigFile)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case looksLikeHTML(head):
+		return pageError{"signature", snippet(head)}
+	case size == 0:
+		return fmt.Errorf("the signature is empty")
+	case size < minSigSize || size > maxSigSize:
+		return fmt.Errorf("the signature is %v bytes, but a signature is between %v and %v bytes; it begins:\n%v",
+			size, minSigSize, maxSigSize, snippet(head))
+	case !isSignature(head):
+		return fmt.Errorf("the signature is neither an OpenPGP signature packet nor ASCII armor; it begins:\n%v",
+			snippet(head))
+	}
+
+	return nil
+}
+
+// readHead returns the first sniffSize bytes of the file, or all of it if it's smaller, and the file's size.
+func readHead(filename string) ([]byte, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, err
+	}
+
+	return head[:n], info.Size(), nil
+}
+
+// fileKind returns what the downloaded file is, for messages.
+func fileKind(filename string) string {
+	if strings.HasSuffix(finalName(filename), ".sig") {
+		return "signature"
+	}
+
+	return "ISO"
+}
+
+// looksLikeHTML reports whether or not the data is the beginning of a web page.
+func looksLikeHTML(data []byte) bool {
+	data = bytes.TrimLeftFunc(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), unicode.IsSpace)
+	for _, tag := range []string{"<!doctype", "<html"} {
+		if len(data) >= len(tag) && strings.EqualFold(string(data[:len(tag)]), tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSignature reports whether or not the data starts with a signature, either armored or as a binary signature
+// packet. Every binary OpenPGP packet starts with a byte that has its high bit set and holds the packet's tag, which is
+// 2 for signatures. The old packet format keeps the tag in bits 2-5, and the new one in bits 0-5.
+func isSignature(data []byte) bool {
+	if bytes.HasPrefix(bytes.TrimLeftFunc(data, unicode.IsSpace), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		return true
+	}
+	if len(data) == 0 || data[0]&0x80 == 0 {
+		return false
+	}
+	if data[0]&0x40 == 0 {
+		return (data[0]>>2)&0x0f == 2
+	}
+
+	return data[0]&0x3f == 2
+}
+
+// snippet returns the beginning of the data as indented text that's safe to print, with anything unprintable replaced.
+// Data that isn't text is shown in hex instead.
+func snippet(data []byte) string {
+	if len(data) > snippetSize {
+		data = data[:snippetSize]
+	}
+	binary := 0
+	for _, r := range string(data) {
+		if r == 0 || r == utf8.RuneError {
+			binary++
+		}
+	}
+	if binary > len(data)/10 {
+		if len(data) > 32 {
+			data = data[:32]
+		}
+		return fmt.Sprintf("\t%x (binary)", data)
+	}
+
+	text := strings.Map(func(r rune) rune {
+		if r == '\r' {
+			return -1
+		}
+		if r == utf8.RuneError || (!unicode.IsPrint(r) && r != '\n' && r != '\t') {
+			return '.'
+		}
+		return r
+	}, string(data))
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, "\t"+line)
+		}
+	}
+	if len(lines) == 0 {
+		return "\t(nothing printable)"
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// We'll want at least this much space left over after the download, for the signature and everything else.
+var spaceMargin int64 = 16 << 20
+
+// This is the filesystem type of a tmpfs, as reported by statfs.
+const tmpfsMagic = 0x01021994
+
+// spaceError is returned when there isn't enough room for the download. Trying another mirror won't help.
+type spaceError struct {
+	dir   string
+	need  int64
+	avail int64
+	tmpfs bool
+}
+
+func (e spaceError) Error() string {
+	msg := fmt.Sprintf("not enough space in %v: need %v, have %v (use --download-dir to download somewhere else)",
+		e.dir, reduce(int(e.need)), reduce(int(e.avail)))
+	if e.tmpfs {
+		msg += "; " + e.dir + " is a tmpfs, which is usually limited to half of RAM"
+	}
+
+	return msg
+}
+
+// freeSpace returns how many bytes are available to us in the directory, and whether or not it's on a tmpfs.
+func freeSpace(dir string) (int64, bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Type) == tmpfsMagic, nil
+}
+
+// checkSpace makes sure that there's enough room for the file at the url to be downloaded to filename, with a little
+// to spare. Anything that was already downloaded of it counts towards the space. If we can't tell how big the file is,
+// we'll let the download find out the hard way.
+func checkSpace(ctx context.Context, url, filename string) error {
+	if !isHTTP(url) {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength <= 0 {
+		return nil
+	}
+
+	need := resp.ContentLength + spaceMargin
+	if info, err := os.Stat(filename); err == nil {
+		need -= info.Size()
+	}
+	dir := filepath.Dir(filename)
+	avail, tmpfs, err := freeSpace(dir)
+	if err != nil || avail >= need {
+		return nil
+	}
+
+	return spaceError{dir, need, avail, tmpfs}
+}
+
+// makeDownloadDir creates the download directory if it doesn't exist yet. It reports whether or not it had to create
+// it, so that we know to remove it afterwards.
+func makeDownloadDir(dir string) (bool, error) {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return false, fmt.Errorf("%v is not a directory", dir)
+		}
+		return false, nil
+	}
+
+	return true, os.MkdirAll(dir, 0755)
+}
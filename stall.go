@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// This is the slowest that a download can go, in bytes per second, before it's considered stalled. It's set by
+// --min-speed, and 0 turns stall detection off.
+var minSpeed int
+
+// stallError is returned when a download was given up on for being too slow.
+type stallError struct {
+	rate   int
+	window time.Duration
+}
+
+func (e stallError) Error() string {
+	return fmt.Sprintf("mirror too slow: less than %v/s for %v", reduce(e.rate), e.window)
+}
+
+// stallWatcher keeps an eye on how fast a download is going and cancels it if it's slower than --min-speed for longer
+// than --stall-time. The downloaded data has to be written to it.
+type stallWatcher struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	n       int64
+	stalled int32
+	done    chan struct{}
+}
+
+// newStallWatcher returns a watcher with a context that the download must use. Watching doesn't begin until start is
+// called, so that connecting to the mirror isn't counted against it.
+func newStallWatcher(ctx context.Context) *stallWatcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &stallWatcher{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+}
+
+func (w *stallWatcher) Write(p []byte) (int, error) {
+	atomic.AddInt64(&w.n, int64(len(p)))
+	return len(p), nil
+}
+
+// start begins checking the download's speed every second, averaged over the last --stall-time.
+func (w *stallWatcher) start() {
+	window := int(*stallTimeFlag / time.Second)
+	if minSpeed <= 0 || window <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		// This holds how much was downloaded at each of the last few ticks.
+		samples := []int64{atomic.LoadInt64(&w.n)}
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.done:
+				return
+			case <-w.ctx.Done():
+				return
+			}
+
+			samples = append(samples, atomic.LoadInt64(&w.n))
+			if len(samples) <= window {
+				continue
+			}
+			samples = samples[len(samples)-window-1:]
+			if samples[window]-samples[0] < int64(minSpeed)*int64(window) {
+				atomic.StoreInt32(&w.stalled, 1)
+				w.cancel()
+				return
+			}
+		}
+	}()
+}
+
+// stop stops watching the download. If the download was cancelled for being too slow, it returns a stallError.
+func (w *stallWatcher) stop() error {
+	close(w.done)
+	w.cancel()
+	if atomic.LoadInt32(&w.stalled) != 0 {
+		return stallError{minSpeed, *stallTimeFlag}
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// checkStream makes sure that the other options can be used with --stream. Only a single http download can be written
+// straight to the drive.
+func checkStream() error {
+	switch {
+	case !*streamFlag:
+		return nil
+	case *torrentFlag:
+		return fmt.Errorf("--stream does not work with --torrent")
+	case *downloadOnlyFlag:
+		return fmt.Errorf("--stream does not work with --download-only")
+	case *multiMirrorFlag > 1 || *connectionsFlag > 1:
+		return fmt.Errorf("--stream does not work with --multi-mirror or --connections")
+	case isARM():
+		return fmt.Errorf("--stream does not work with Arch Linux ARM")
+	}
+
+	return nil
+}
+
+// exitPartialStream is the exit code for a stream that every mirror gave up on partway through, so that scripts can
+// tell that the drive was written to and won't boot.
+const exitPartialStream = 5
+
+// partialStreamError is returned when the stream stopped after part of the ISO was written to the drive.
+type partialStreamError struct {
+	usb string
+	err error
+}
+
+func (e partialStreamError) Error() string {
+	return fmt.Sprintf("%v (%v is only partly written)", e.err, e.usb)
+}
+
+// Unwrap lets the cause of the failed stream be inspected.
+func (e partialStreamError) Unwrap() error {
+	return e.err
+}
+
+// streamRelease downloads the ISO straight onto the USB drive without saving it anywhere first. Once the ISO is on the
+// drive, it's checked against its checksum and read back to check its signature. If that fails, the drive is left
+// with an ISO that must not be used. If every mirror fails after some of the ISO was written, the drive is left with
+// part of an ISO, and a partialStreamError is returned.
+func streamRelease(ctx context.Context, usb string) error {
+	mirrors, _ := findMirrors(ctx)
+	if mirrors == nil {
+		return fmt.Errorf("no mirrors to stream from")
+	}
+
+	if *timeoutFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+		defer cancel()
+	}
+
+	// The drive is written to as soon as the download starts, so an interrupt can't undo anything from here on.
+	if !startFlash() {
+		exitIfInterrupted()
+	}
+
+	partial := false
+	for _, mirror := range mirrors {
+		// Only http mirrors can be streamed from.
+		if !isHTTP(mirror) {
+			continue
+		}
+
+		written, err := streamISO(ctx, mirror, usb)
+		if err == nil {
+			return nil
+		}
+		if written {
+			fmt.Println()
+			fmt.Println("!!! VERIFICATION FAILED !!!")
+			fmt.Println(usb, "holds an ISO that did not pass verification. Do not boot from it.")
+			fmt.Println("Flash the drive again before using it.")
+			return err
+		}
+		fmt.Println("Error using mirror", mirror+":", err)
+		if errors.As(err, &partialStreamError{}) {
+			partial = true
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	// The next mirror starts over from the beginning of the drive, but if none of them got all the way, whatever the
+	// last one wrote is still there.
+	if partial {
+		fmt.Println()
+		fmt.Println("!!! STREAM INCOMPLETE !!!")
+		fmt.Println(usb, "was partly written before the stream failed. It won't boot and is unusable as it is.")
+		fmt.Println("Flash the drive again before using it.")
+		return partialStreamError{usb: usb, err: fmt.Errorf("no mirror could stream the whole ISO")}
+	}
+
+	return fmt.Errorf("no mirror could stream the ISO")
+}
+
+// streamISO streams the ISO from the mirror onto the USB drive and verifies it. It reports whether or not the whole ISO
+// was written to the drive before anything went wrong.
+func streamISO(ctx context.Context, mirror, usb string) (bool, error) {
+	fmt.Println("Looking for ISO in", mirror)
+	filename, sum, err := getFilename(ctx, mirror)
+	if err != nil {
+		return false, timeoutError(ctx, err, "looking for the ISO", mirror)
+	}
+	url, err := joinURL(mirror, filename)
+	if err != nil {
+		return false, err
+	}
+	filename = path.Base(filename)
+	ext := compression(filename)
+	if ext != "" {
+		if err := checkDecompressor(ext); err != nil {
+			return false, err
+		}
+	}
+
+	sums := checksums(ctx, mirror, filename, sum)
+
+	// Get the signature first, so that nothing is written to the drive if the mirror doesn't have it.
+	sigFile := downloadDir + "/" + filename + ".sig"
+	fmt.Println("Downloading", filename+".sig", "...")
+	if err := fetchSig(ctx, func() {}, sigURLs(filename, url), sigFile)(); err != nil {
+		return false, err
+	}
+	defer os.Remove(sigFile)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, timeoutError(ctx, err, "downloading the ISO", mirror)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false, responseError(resp)
+	}
+	if ext == "" && resp.ContentLength > 0 {
+		if err := checkFits(resp.ContentLength, usb); err != nil {
+			return false, err
+		}
+	}
+
+	device, err := openDrive(usb, true)
+	if err != nil {
+		return false, err
+	}
+	defer device.Close()
+
+	// Compressed images are decompressed on their way to the drive. If the signature is of the compressed image, it's
+	// checked on the way too, because the compressed image won't be around to check afterwards.
+	raw := &countWriter{device: device, usb: usb}
+	var w io.Writer = raw
+	var dec *commandWriter
+	var check sigCheck
+	if ext != "" {
+		if dec, err = startDecompressor(ctx, ext, raw); err != nil {
+			return false, err
+		}
+		w = dec
+		if *sigCoversFlag == "compressed" {
+			if check, err = startSigCheck(ctx, sigFile); err != nil {
+				dec.Close()
+				return false, err
+			}
+		}
+	}
+
+	// Hash the ISO on its way to the drive.
+	fmt.Println("Streaming", filename, "to", usb, "...")
+	h := sha256.New()
+	var p progress
+	size := resp.ContentLength
+	if size > 0 {
+		p.total = int(size)
+	}
+	writers := []io.Writer{h, &p}
+	var b2 *b2Hash
+	for _, want := range sums {
+		if len(want) == b2Size*2 {
+			if b2, err = startB2(ctx); err != nil {
+				return false, err
+			}
+			defer b2.Close()
+			writers = append(writers, b2)
+			break
+		}
+	}
+	if check != nil {
+		writers = append(writers, check)
+	}
+	n, err := io.Copy(w, io.TeeReader(limitReader(resp.Body), io.MultiWriter(writers...)))
+	fmt.Printf("\n") // Flush last progress line.
+	if dec != nil {
+		if decErr := dec.Close(); err == nil && decErr != nil {
+			err = fmt.Errorf("error decompressing image: %v", decErr)
+		}
+	}
+	var sigErr error
+	if check != nil {
+		sigErr = check.Close()
+	}
+	switch {
+	case err != nil:
+		err = fmt.Errorf("error streaming ISO: %v", timeoutError(ctx, err, "downloading the ISO", mirror))
+	case size > 0 && n != size:
+		err = fmt.Errorf("stream truncated: got %v of %v", reduce(int(n)), reduce(int(size)))
+	default:
+		err = syncDevice(device, usb, terminal)
+	}
+	if err != nil && raw.n > 0 {
+		return false, partialStreamError{usb: usb, err: err}
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Println("Stream complete")
+
+	// The stream is gone, so the checksums can only be compared with what was hashed on the way.
+	for _, want := range sums {
+		want = strings.ToLower(want)
+		got := hex.EncodeToString(h.Sum(nil))
+		if len(want) == b2Size*2 {
+			if got, err = b2.sum(); err != nil {
+				return true, err
+			}
+		}
+		if got != want {
+			return true, fmt.Errorf("%v checksum mismatch: expected %v, got %v", checksumName(want), want, got)
+		}
+		fmt.Println(sumOK(want))
+	}
+
+	if check != nil {
+		if sigErr != nil {
+			return true, fmt.Errorf("error verifying image: %w", sigErr)
+		}
+		fmt.Println("The compressed image was verified while it was streamed")
+		printSigReport(check.report())
+		return false, nil
+	}
+	if err := verifyDevice(ctx, usb, sigFile, raw.n); err != nil {
+		return true, fmt.Errorf("error verifying ISO: %w", err)
+	}
+
+	return false, nil
+}
+
+// countWriter writes what passes through it to the drive, one block after another, and counts it.
+type countWriter struct {
+	device *os.File
+	usb    string
+	n      int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if err := writeBlock(c.device, c.usb, p, c.n); err != nil {
+		return 0, err
+	}
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// verifyDevice reads the first size bytes back from the drive and checks them against the signature.
+func verifyDevice(ctx context.Context, usb, sigFile string, size int64) error {
+	device, err := openDrive(usb, false)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	fmt.Println("Verifying ISO on", usb)
+	check, err := verifySig(ctx, sigFile, io.LimitReader(device, size))
+	if err != nil {
+		return err
+	}
+
+	printSigReport(check.report())
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// These are the published checksums that are known to be genuine, because they came from a checksum file with a good
+// signature or straight from archlinux.org, and the results of checking each checksum file's signature, keyed by URL.
+var (
+	authSums    = make(map[string]bool)
+	checkedSums = make(map[string]error)
+	authSumsMu  sync.Mutex
+)
+
+// setAuthenticated remembers that the checksums are genuine.
+func setAuthenticated(sums ...string) {
+	authSumsMu.Lock()
+	defer authSumsMu.Unlock()
+
+	for _, sum := range sums {
+		if sum != "" {
+			authSums[strings.ToLower(sum)] = true
+		}
+	}
+}
+
+// isAuthenticated reports whether or not the checksum is known to be genuine.
+func isAuthenticated(sum string) bool {
+	authSumsMu.Lock()
+	defer authSumsMu.Unlock()
+
+	return authSums[strings.ToLower(sum)]
+}
+
+// sumOK returns what to tell the user about a checksum that the ISO matched.
+func sumOK(sum string) string {
+	if isAuthenticated(sum) {
+		return checksumName(sum) + " checksum OK"
+	}
+
+	return checksumName(sum) + " checksum OK (checksums not authenticated)"
+}
+
+// authenticateSums checks the checksum file that was read from the url against the signature next to it, and remembers
+// sum as genuine if the signature is good. A missing or uncheckable signature only leaves the checksums
+// unauthenticated, so that the ISO's own signature is all that vouches for it, but a bad one means that the file was
+// tampered with, so it's an error. Each file is only checked once.
+func authenticateSums(ctx context.Context, url string, data []byte, sum string) error {
+	if *skipVerifyFlag {
+		return nil
+	}
+
+	authSumsMu.Lock()
+	err, ok := checkedSums[url]
+	authSumsMu.Unlock()
+	if !ok {
+		err = checkSumsSig(ctx, url, data)
+		authSumsMu.Lock()
+		checkedSums[url] = err
+		authSumsMu.Unlock()
+		switch {
+		case err == nil:
+			fmt.Println("Signature of", path.Base(url), "OK")
+		case exitCode(err) != exitBadSig:
+			fmt.Printf("Checksums in %v are not authenticated (%v); the ISO's signature will have to vouch for it\n",
+				url, err)
+		}
+	}
+
+	switch {
+	case err == nil:
+		setAuthenticated(sum)
+	case exitCode(err) == exitBadSig:
+		return fmt.Errorf("%v: %w", path.Base(url), err)
+	}
+
+	return nil
+}
+
+// checkSumsSig checks the checksum file that was read from the url against the signature next to it.
+func checkSumsSig(ctx context.Context, url string, data []byte) error {
+	sig, err := readSmallFile(ctx, url+".sig", "downloading the signature of the checksums")
+	if err != nil {
+		return fmt.Errorf("no signature: %v", err)
+	}
+	tmp, err := ioutil.TempFile("", "flasharch-sums-*.sig")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(sig)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = verifySig(ctx, tmp.Name(), bytes.NewReader(data))
+	return err
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// These limit how many peers and web seeds we exchange data with at once.
+const (
+	maxPeers    = 40
+	maxWebSeeds = 4
+)
+
+// These are the ports that BitTorrent clients traditionally accept connections on. If they're all taken, any port will
+// do.
+const (
+	firstPeerPort = 6881
+	lastPeerPort  = 6889
+)
+
+// This is how long a web seed gets to send us a piece.
+const webSeedTimeout = time.Minute
+
+// swarm downloads a torrent from its peers and web seeds, and uploads the pieces that it has to the peers that want
+// them. Peers are found through the torrent's trackers and the DHT, and they can connect to us too.
+type swarm struct {
+	info    *metainfo
+	file    *os.File
+	peerID  [20]byte
+	port    int  // where peers can connect to us, or 0 if they can't; it doesn't change once we're running
+	seeding bool // whether or not we only upload
+	slots   chan struct{}
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	have      []bool
+	haveCount int
+	left      int64       // how many bytes we still need
+	pending   map[int]int // how many sources are downloading each piece
+	conns     map[*peerConn]bool
+	tried     map[string]bool // the peers that we've connected to or tried to
+	uploaded  int64
+	uploadees int // how many peers we've uploaded to
+	done      chan struct{}
+	failed    chan struct{} // closed when writing fails, which is recorded in err
+	err       error
+	p         progress
+}
+
+// newSwarm opens filename to download the torrent's file into, or to seed it from if it's already complete.
+func newSwarm(info *metainfo, filename string, complete bool) (*swarm, error) {
+	var file *os.File
+	var err error
+	if complete {
+		file, err = os.Open(filename)
+	} else {
+		file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err == nil {
+			err = file.Truncate(info.length)
+		}
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	s := &swarm{
+		info:    info,
+		file:    file,
+		seeding: complete,
+		slots:   make(chan struct{}, maxPeers),
+		have:    make([]bool, len(info.pieces)),
+		left:    info.length,
+		pending: make(map[int]int),
+		conns:   make(map[*peerConn]bool),
+		tried:   make(map[string]bool),
+		done:    make(chan struct{}),
+		failed:  make(chan struct{}),
+		p:       progress{total: int(info.length)},
+	}
+
+	// The peer ID says which client we are, like "-XX1234-" does for others, followed by random bytes.
+	copy(s.peerID[:], "-FA0000-")
+	if _, err := rand.Read(s.peerID[8:]); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if complete {
+		for i := range s.have {
+			s.have[i] = true
+		}
+		s.haveCount = len(s.have)
+		s.left = 0
+		s.p = progress{label: "Uploaded"}
+		close(s.done)
+	}
+
+	return s, nil
+}
+
+// close closes the file.
+func (s *swarm) close() error {
+	return s.file.Close()
+}
+
+// run downloads the torrent until we have all of it, or seeds it until the context is done.
+func (s *swarm) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer s.wg.Wait()
+	defer cancel()
+
+	// Peers that we can't reach through a SOCKS5 proxy aren't reached at all. The proxy can't carry their connections
+	// to us or the DHT, which uses UDP.
+	if socksDialer == nil {
+		if ln, err := listenPeers(); err != nil {
+			fmt.Println("Peers will not be able to connect to us:", err)
+		} else {
+			s.port = ln.Addr().(*net.TCPAddr).Port
+			s.start(func() { s.accept(ctx, ln) })
+		}
+	}
+	addrs := make(chan string, 4*maxPeers)
+	s.start(func() { s.announceTrackers(ctx, addrs) })
+	if socksDialer == nil && !*ipv6Flag && len(dhtBootstrap) > 0 {
+		s.start(func() { s.findDHTPeers(ctx, addrs) })
+	}
+	s.start(func() { s.connectPeers(ctx, addrs) })
+	if !s.seeding {
+		s.start(func() { s.webSeeds(ctx) })
+	}
+
+	// We're done once we have every piece, unless we're seeding, which goes on until the context is done.
+	done := s.done
+	if s.seeding {
+		done = nil
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			s.printProgress()
+			return nil
+		case <-s.failed:
+			return s.err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			s.printProgress()
+		}
+	}
+}
+
+// start runs f in the background. run waits for it to return before it does.
+func (s *swarm) start(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// printProgress shows how much we've downloaded, or how much we've uploaded if we're seeding.
+func (s *swarm) printProgress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.p.print()
+}
+
+// uploadStats returns how much we've uploaded and to how many peers.
+func (s *swarm) uploadStats() (int64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.uploaded, s.uploadees
+}
+
+// fail stops the swarm because of an error that affects every source, like not being able to write to the file.
+func (s *swarm) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+		close(s.failed)
+	}
+}
+
+// listenPeers listens for connections from peers on the first free port of the usual ones, or else on any port.
+func listenPeers() (net.Listener, error) {
+	network := "tcp"
+	switch {
+	case *ipv4Flag:
+		network = "tcp4"
+	case *ipv6Flag:
+		network = "tcp6"
+	}
+
+	for port := firstPeerPort; port <= lastPeerPort; port++ {
+		if ln, err := net.Listen(network, ":"+strconv.Itoa(port)); err == nil {
+			return ln, nil
+		}
+	}
+
+	return net.Listen(network, ":0")
+}
+
+// accept hands every peer that connects to us over to handle, as long as we have room for it.
+func (s *swarm) accept(ctx context.Context, ln net.Listener) {
+	defer ln.Close()
+	defer closeOnCancel(ctx, ln)()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case s.slots <- struct{}{}:
+			s.start(func() {
+				defer func() { <-s.slots }()
+				s.handle(ctx, conn, false)
+			})
+		default:
+			conn.Close()
+		}
+	}
+}
+
+// addPeer passes the address of a peer on to connectPeers. If it already has enough addresses to go on with, the peer
+// is dropped; we'll hear about it again the next time we ask for peers.
+func (s *swarm) addPeer(addrs chan<- string, addr string) {
+	select {
+	case addrs <- addr:
+	default:
+	}
+}
+
+// connectPeers connects to the peers that we hear about, as many at a time as there's room for. Peers are only tried
+// once.
+func (s *swarm) connectPeers(ctx context.Context, addrs <-chan string) {
+	for {
+		var addr string
+		select {
+		case addr = <-addrs:
+		case <-ctx.Done():
+			return
+		}
+
+		s.mu.Lock()
+		tried := s.tried[addr]
+		s.tried[addr] = true
+		s.mu.Unlock()
+		if tried {
+			continue
+		}
+
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		s.start(func() {
+			defer func() { <-s.slots }()
+
+			dialCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+			conn, err := dialMirror(dialCtx, "tcp", addr)
+			cancel()
+			if err == nil {
+				s.handle(ctx, conn, true)
+			}
+		})
+	}
+}
+
+// handle exchanges pieces with the peer until one of us hangs up or the context is done.
+func (s *swarm) handle(ctx context.Context, conn net.Conn, outgoing bool) {
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+
+	c := newPeerConn(s, conn)
+	if err := c.handshake(outgoing); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.conns[c] = true
+	bitfield := s.bitfield()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.dropPiece()
+	}()
+
+	c.run(bitfield)
+}
+
+// bitfield returns the pieces that we have, one bit each, or nil if we don't have any. The caller must hold s.mu.
+func (s *swarm) bitfield() []byte {
+	if s.haveCount == 0 {
+		return nil
+	}
+
+	b := make([]byte, (len(s.have)+7)/8)
+	for i, have := range s.have {
+		if have {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	return b
+}
+
+// pick chooses the next piece to download from a source that has the pieces in has, or every piece if has is nil, and
+// marks it as being downloaded. Pieces that nobody is downloading yet come first. Once there aren't any left, a piece
+// that another source is already downloading is picked too, so that one slow source can't hold up the end of the
+// download. It returns -1 if there's nothing to download from the source. The caller must hold s.mu.
+func (s *swarm) pick(has []bool) int {
+	for _, most := range []int{1, 2} {
+		for i, have := range s.have {
+			if !have && s.pending[i] < most && (has == nil || has[i]) {
+				s.pending[i]++
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// release gives up on downloading the piece from one source. The caller must hold s.mu.
+func (s *swarm) release(i int) {
+	if s.pending[i] > 1 {
+		s.pending[i]--
+	} else {
+		delete(s.pending, i)
+	}
+}
+
+// finish checks the downloaded piece against its checksum and writes it to the file. Every peer is told that we have
+// it now. It returns an error if the piece is bad.
+func (s *swarm) finish(i int, data []byte) error {
+	if sha1.Sum(data) != s.info.pieces[i] {
+		s.mu.Lock()
+		s.release(i)
+		s.mu.Unlock()
+		return fmt.Errorf("piece %v is corrupt", i)
+	}
+
+	// Near the end, two sources might send us the same piece. It's the same data either way.
+	if _, err := s.file.WriteAt(data, int64(i)*s.info.pieceLength); err != nil {
+		s.fail(err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.release(i)
+	if s.have[i] {
+		return nil
+	}
+	s.have[i] = true
+	s.haveCount++
+	s.left -= int64(len(data))
+	s.p.have += len(data)
+	for c := range s.conns {
+		c.tellHave(i)
+	}
+	if s.haveCount == len(s.have) {
+		close(s.done)
+	}
+
+	return nil
+}
+
+// webSeeds downloads pieces from a few of the torrent's web seeds at a time, picked at random so that the same mirrors
+// aren't always the ones asked. A web seed that keeps failing is replaced with another one.
+func (s *swarm) webSeeds(ctx context.Context) {
+	seeds := make(chan string, len(s.info.webSeeds))
+	for _, i := range mathrand.Perm(len(s.info.webSeeds)) {
+		seeds <- s.info.webSeeds[i]
+	}
+	close(seeds)
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxWebSeeds; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seed := range seeds {
+				if s.webSeed(ctx, seed) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// webSeed downloads pieces from the web seed, which is a mirror that has the whole file (BEP 19), until there's nothing
+// left to download or the web seed fails three times in a row. It reports whether or not there's nothing left.
+func (s *swarm) webSeed(ctx context.Context, seed string) bool {
+	fileURL := seed
+	if strings.HasSuffix(fileURL, "/") {
+		fileURL += s.info.name
+	}
+	if !isHTTP(fileURL) {
+		return false
+	}
+
+	for failures := 0; failures < 3; {
+		s.mu.Lock()
+		i := s.pick(nil)
+		s.mu.Unlock()
+		if i < 0 {
+			// Every piece that's left is already being downloaded by others, but they might still give up.
+			select {
+			case <-s.done:
+				return true
+			case <-ctx.Done():
+				return true
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		data, err := fetchRange(ctx, fileURL, int64(i)*s.info.pieceLength, s.info.pieceSize(i))
+		if err != nil {
+			s.mu.Lock()
+			s.release(i)
+			s.mu.Unlock()
+		} else {
+			err = s.finish(i, data)
+		}
+		if ctx.Err() != nil {
+			return true
+		}
+		if err != nil {
+			failures++
+			continue
+		}
+		failures = 0
+	}
+
+	return false
+}
+
+// fetchRange downloads size bytes of the file at the url, starting at offset.
+func fetchRange(ctx context.Context, fileURL string, offset int64, size int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(size)-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 206 {
+		if resp.StatusCode == 200 {
+			return nil, fmt.Errorf("web seed does not support ranges")
+		}
+		return nil, responseError(resp)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(limitReader(resp.Body), data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// These are the mount points that the running system can't live without. The drive that any of them is on is never
+// flashed without --i-know-this-destroys-my-system.
+var systemMounts = []string{"/", "/boot", "/home"}
+
+// checkSystemDisk makes sure that the USB drive isn't the disk that the running system is on, which is what happens
+// when someone passes /dev/sda on a laptop. The disks are found by following partitions to their disks, and device
+// mapper devices (like LVM and LUKS) to the devices under them. --force doesn't override this, only
+// --i-know-this-destroys-my-system does.
+func checkSystemDisk(usb string) error {
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/block", filepath.Base(dev))); err != nil {
+		return nil
+	}
+	targets := make(map[string]bool)
+	for _, disk := range parentDisks(filepath.Base(dev)) {
+		targets[disk] = true
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return fmt.Errorf("error checking for the system disk: %v", err)
+	}
+	var found []string
+	for _, m := range mounts {
+		if m.device == "" || !isSystemMount(m.target) {
+			continue
+		}
+		for _, disk := range parentDisks(filepath.Base(m.device)) {
+			if targets[disk] {
+				found = append(found, m.target+" ("+m.device+")")
+				break
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%v is the disk that this system runs from; these live on it:\n\t%v", usb,
+		strings.Join(found, "\n\t"))
+	if *destroySystemFlag {
+		override("system disk", "--i-know-this-destroys-my-system", errors.New(msg))
+		return nil
+	}
+
+	return enforce("system disk", checkFatal,
+		fmt.Errorf("refusing to flash %v\nCheck the path to your USB drive (lsblk lists them)", msg))
+}
+
+// isSystemMount reports whether or not the mount point is one that the running system can't live without.
+func isSystemMount(target string) bool {
+	for _, m := range systemMounts {
+		if target == m {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parentDisks returns the disks that the block device is on. A partition is on the disk it's a part of, and a device
+// mapper device is on whatever its slaves are on, which can be several disks (like an LVM volume group spanning two).
+func parentDisks(name string) []string {
+	dir := filepath.Join("/sys/class/block", name)
+	if slaves, _ := ioutil.ReadDir(filepath.Join(dir, "slaves")); len(slaves) > 0 {
+		var disks []string
+		for _, slave := range slaves {
+			disks = append(disks, parentDisks(slave.Name())...)
+		}
+		return disks
+	}
+	if parent := partitionParent(name); parent != "" {
+		return parentDisks(parent)
+	}
+
+	return []string{name}
+}
+
+// partitionParent returns the kernel's name for the disk that the block device is a partition of, or "" if it isn't a
+// partition.
+func partitionParent(name string) string {
+	dir := filepath.Join("/sys/class/block", name)
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err != nil {
+		return ""
+	}
+	// The partition's directory is inside its disk's, e.g. .../block/sda/sda2.
+	link, err := os.Readlink(dir)
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Base(filepath.Dir(link))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// target is a USB drive that we're flashing, and how it went. Each drive is checked, flashed, and verified on its own,
+// so that one drive failing doesn't stop the others.
+type target struct {
+	usb      string
+	stage    string // what we were doing when the drive failed, like "Error flashing ISO"
+	err      error  // why the drive failed, or nil if it hasn't
+	written  string // how what was written compared with the image
+	readBack string // how the drive compared with the image when it was read back
+}
+
+// fail records that the drive failed while doing stage, and reports it. If the drive failed because it was unplugged,
+// that's all that's reported.
+func (t *target) fail(stage string, err error, r *reporter) {
+	if driveRemoved(t.usb, err) && !errors.As(err, new(*removedError)) {
+		err = &removedError{usb: t.usb, err: err}
+	}
+	t.stage = stage
+	t.err = err
+	r.println(stage+":", err)
+}
+
+// getTargets checks the paths to the USB drives and runs the safety checks that don't need the image on each of them,
+// asking the user about anything that needs asking. A drive that fails a check is reported and won't be flashed, but
+// it's still returned so that it shows up in the summary. If the paths themselves are wrong, nil is returned.
+func getTargets() []*target {
+	usbs := getUSBs()
+	if len(usbs) == 0 {
+		return nil
+	}
+	if *streamFlag && len(usbs) > 1 {
+		fmt.Println("--stream can only flash one USB drive at a time")
+		return nil
+	}
+
+	// A partition is swapped for its disk before anything else, so that the rest of the checks are of the drive that's
+	// actually going to be flashed.
+	resolved := make([]string, len(usbs))
+	errs := make([]error, len(usbs))
+	var writable []string
+	for i, given := range usbs {
+		resolved[i] = given
+		if !*imageFlag {
+			usb, err := checkPartition(given)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			resolved[i] = usb
+		}
+		writable = append(writable, resolved[i])
+	}
+	if err := checkPrivileges(writable); err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	var targets []*target
+	seen := make(map[string]bool)
+	for i, usb := range resolved {
+		if *imageFlag {
+			targets = append(targets, imageTarget(usb, seen))
+			continue
+		}
+		err := errs[i]
+		if err == nil {
+			err = checkDuplicate(usb, seen)
+		}
+		if err == nil && restoring {
+			err = checkRestorable(usb)
+		}
+		if err == nil {
+			err = enforce("block device", checkWarn, checkBlockDevice(usb))
+		}
+		if err == nil {
+			err = checkSystemDisk(usb)
+		}
+		if err == nil {
+			err = checkMounts(usb)
+		}
+		if err == nil && !(benchmarking && *readOnlyFlag) {
+			err = confirmErase(usb)
+		}
+		if err != nil {
+			fmt.Println(err)
+			if len(usbs) > 1 {
+				fmt.Printf("Not %v %v\n", acting(), usb)
+			}
+		}
+		stage := "Not flashed"
+		switch {
+		case restoring:
+			stage = "Not restored"
+		case benchmarking:
+			stage = "Not benchmarked"
+		}
+		targets = append(targets, &target{usb: usb, stage: stage, err: err})
+	}
+
+	return targets
+}
+
+// checkDuplicate makes sure that the drive isn't one that we're already flashing under another name, like a partition
+// that was swapped for its disk or a /dev/disk/by-id link.
+func checkDuplicate(usb string, seen map[string]bool) error {
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		dev = usb
+	}
+	if seen[dev] {
+		return fmt.Errorf("%v was given more than once", dev)
+	}
+	seen[dev] = true
+
+	return nil
+}
+
+// checkTargets runs the safety checks that need the image on each drive that's still good, and reports whether or not
+// any of them are.
+func checkTargets(isoFile string, targets []*target) bool {
+	ok := false
+	for _, t := range targets {
+		if t.err != nil {
+			continue
+		}
+
+		// A file for --image grows to fit, and nothing can mount it.
+		if *imageFlag {
+			ok = true
+			continue
+		}
+
+		// A drive that's too small would be written until it ran out of space, leaving it unbootable.
+		if err := enforce("drive size", checkFatal, checkCapacity(isoFile, t.usb)); err != nil {
+			t.fail("Error checking drive size", err, terminal)
+			continue
+		}
+
+		if err := checkPersistenceFits(isoFile, t.usb); err != nil {
+			t.fail("Error checking drive size", err, terminal)
+			continue
+		}
+
+		// Something might have mounted the drive while we were downloading.
+		if err := checkMounts(t.usb); err != nil {
+			t.fail("Error checking for mounted partitions", err, terminal)
+			continue
+		}
+		ok = true
+	}
+
+	return ok
+}
+
+// flashTargets flashes the image to every drive that's still good. One drive is flashed with its progress on the
+// terminal like always, and several are flashed at once, with a line for each.
+func flashTargets(isoFile string, targets []*target) {
+	eachTarget(targets, "Flashing ISO to", func(t *target, r *reporter, suffix string) {
+		flashTarget(isoFile, t, r, suffix)
+	})
+}
+
+// zeroTargets overwrites every drive that's still good with zeros, for --wipe, the same way that flashTargets flashes
+// them. A drive that can't be zeroed won't be flashed.
+func zeroTargets(targets []*target) {
+	eachTarget(targets, "Zeroing", func(t *target, r *reporter, suffix string) {
+		started := time.Now()
+		if err := zeroDrive(t.usb, r); err != nil {
+			t.fail("Error zeroing drive", err, r)
+			return
+		}
+		recordPhase("zero"+suffix, started)
+	})
+}
+
+// eachTarget runs do on every drive that's still good, after saying what it's doing. One drive has the terminal to
+// itself, and several are done at once on a board, with a line for each.
+func eachTarget(targets []*target, doing string, do func(t *target, r *reporter, suffix string)) {
+	var good []*target
+	var names []string
+	for _, t := range targets {
+		if t.err == nil {
+			good = append(good, t)
+			names = append(names, t.usb)
+		}
+	}
+	switch len(good) {
+	case 0:
+		return
+	case 1:
+		fmt.Println(doing, good[0].usb)
+		do(good[0], terminal, "")
+		return
+	}
+
+	fmt.Println(doing, len(good), "drives at once")
+	b := newBoard(names)
+	var wg sync.WaitGroup
+	for i, t := range good {
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+			do(t, b.reporter(i, t.usb), " "+t.usb)
+		}(i, t)
+	}
+	wg.Wait()
+}
+
+// flashTarget wipes and discards the drive (or creates the file, for --image) and flashes the image to it, makes sure
+// that exactly the image was written, and reads the drive back to make sure that it holds it, reporting as it goes.
+// suffix goes on the names of the phases in the manifest, to tell the drives apart.
+func flashTarget(isoFile string, t *target, r *reporter, suffix string) {
+	started := time.Now()
+	if *imageFlag {
+		if err := createImage(t.usb); err != nil {
+			t.fail("Error creating image file", err, r)
+			return
+		}
+	}
+	if err := wipeDrive(t.usb, r); err != nil {
+		t.fail("Error wiping drive", err, r)
+		return
+	}
+	discardDrive(t.usb, r)
+	if estimate := benchEstimate(isoFile, t.usb); estimate != "" {
+		r.println(estimate)
+	}
+	written, err := flashImage(isoFile, t.usb, r)
+	if err != nil {
+		t.fail("Error flashing ISO", err, r)
+		return
+	}
+	recordPhase("flash"+suffix, started)
+
+	// Make sure that we wrote exactly the image, and then that the drive really holds it. Images that were decompressed
+	// on their way to the drive don't have anything on disk to compare with.
+	if t.written, err = checkWritten(isoFile, written); err != nil {
+		t.fail("Error flashing ISO", err, r)
+		return
+	}
+	if t.written == "" {
+		t.written = "not compared because the image was decompressed on its way to the drive"
+	} else {
+		r.println(t.written)
+	}
+	t.readBack = "skipped because of --no-verify-flash"
+	switch {
+	case compression(isoFile) != "":
+		t.readBack = "skipped because the image was decompressed on its way to the drive"
+	case !*noVerifyFlashFlag:
+		// An interrupt stops the read-back right away, which would also stop any other drive that's still being
+		// written, so that only happens when there aren't any.
+		if suffix == "" {
+			startVerify()
+		}
+		started := time.Now()
+		if *quickVerifyFlag {
+			msg, err := quickVerify(isoFile, t.usb, r)
+			if err != nil {
+				t.fail("Error verifying flashed drive", err, r)
+				return
+			}
+			recordPhase("quick-verify"+suffix, started)
+			t.readBack = msg
+			break
+		}
+		if err := verifyFlash(isoFile, t.usb, r); err != nil {
+			t.fail("Error verifying flashed drive", err, r)
+			return
+		}
+		recordPhase("verify-flash"+suffix, started)
+		t.readBack = "the drive matches the image"
+	}
+
+	// The persistence partition changes the partition table, so it's added after the image has been checked.
+	if err := addPersistence(isoFile, t.usb, r); err != nil {
+		t.fail("Error adding persistence partition", err, r)
+	}
+}
+
+// flashed returns the drives that were flashed.
+func flashed(targets []*target) []string {
+	var usbs []string
+	for _, t := range targets {
+		if t.err == nil {
+			usbs = append(usbs, t.usb)
+		}
+	}
+
+	return usbs
+}
+
+// printTargets prints how each drive went. A single drive that failed has already said why.
+func printTargets(targets []*target) {
+	if len(targets) == 1 {
+		if t := targets[0]; t.err == nil {
+			fmt.Println("\tWritten data:", t.written)
+			fmt.Println("\tRead-back:   ", t.readBack)
+		}
+		return
+	}
+
+	for _, t := range targets {
+		if t.err != nil {
+			fmt.Printf("\t%v: FAILED: %v: %v\n", t.usb, t.stage, t.err)
+			continue
+		}
+		fmt.Printf("\t%v: OK\n", t.usb)
+		fmt.Println("\t\tWritten data:", t.written)
+		fmt.Println("\t\tRead-back:   ", t.readBack)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// These bound how long each request can take to connect and to get the response headers back. They don't limit how
+// long the body can take; that's up to --timeout.
+var (
+	connectTimeout = 15 * time.Second
+	headerTimeout  = 30 * time.Second
+)
+
+// setTimeouts makes every request use our connect and header timeouts. Connections are made by dialContext, which
+// also takes care of -4 and -6.
+func setTimeouts() {
+	transport.DialContext = dialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = headerTimeout
+}
+
+// timeoutError gives timeouts a message that says what timed out and where. Other errors are returned as-is.
+func timeoutError(ctx context.Context, err error, phase, mirror string) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%v timed out on %v (--timeout is %v)", phase, mirror, *timeoutFlag)
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("%v timed out on %v: %v", phase, mirror, err)
+	}
+
+	return err
+}
+
+// ctxReader stops reading as soon as its context is done, for readers that don't know about contexts.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
+
+// closeOnCancel closes c if the context is done before the returned function is called. This unblocks connections
+// that don't know about contexts.
+func closeOnCancel(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
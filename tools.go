@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// These are the external programs that we might need, along with the packages that provide them on Arch and on Debian
+// and Ubuntu.
+var tools = map[string][2]string{
+	"b2sum":      {"coreutils", "coreutils"},
+	"dd":         {"coreutils", "coreutils"},
+	"gpg":        {"gnupg", "gnupg"},
+	"gpgv":       {"gnupg", "gpgv"},
+	"mkfs.exfat": {"exfatprogs", "exfatprogs"},
+	"mkfs.ext4":  {"e2fsprogs", "e2fsprogs"},
+	"mkfs.fat":   {"dosfstools", "dosfstools"},
+	"rsync":      {"rsync", "rsync"},
+	"wipefs":     {"util-linux", "util-linux"},
+	"xz":         {"xz", "xz-utils"},
+}
+
+// requiredTools returns the external programs that the chosen options will need. Programs that only some images need,
+// like zstd, can't be known about until we know which image we're getting. Without --fs, restore doesn't know which
+// file system it'll make until it knows how big the drive is.
+func requiredTools() []string {
+	var names []string
+	flashing := !*downloadOnlyFlag && *copyToFlag == "" && !*ventoyFlag && flag.Arg(0) != "verify" &&
+		!restoring && !benchmarking
+	if backend == backendDD && flashing && !*streamFlag {
+		names = append(names, "dd")
+	}
+	if !*noWipeFlag && !*wipeFlag && flashing && backend != backendUDisks || restoring {
+		names = append(names, "wipefs")
+	}
+	switch {
+	case restoring && *fsFlag == fsFAT32:
+		names = append(names, "mkfs.fat")
+	case restoring && *fsFlag == fsExFAT:
+		names = append(names, "mkfs.exfat")
+	}
+	if *persistenceFlag != "" {
+		names = append(names, "mkfs.ext4")
+	}
+	if !*skipVerifyFlag && useGPG() {
+		if *keyringFlag != "" {
+			names = append(names, "gpgv")
+		} else {
+			names = append(names, "gpg")
+		}
+	}
+	if wantB2() {
+		names = append(names, "b2sum")
+	}
+	for _, mirror := range mirrorFlag {
+		if isRsync(mirror) {
+			names = append(names, "rsync")
+			break
+		}
+	}
+	if isARM() {
+		// Arch Linux ARM images are compressed with xz.
+		names = append(names, "xz")
+	}
+
+	return names
+}
+
+// checkTools makes sure that every external program that the chosen options need is installed, so that we don't find
+// out after downloading the ISO. All of the missing ones are listed together.
+func checkTools() error {
+	var missing []string
+	for _, name := range requiredTools() {
+		if _, err := exec.LookPath(name); err != nil {
+			pkg := tools[name]
+			missing = append(missing, fmt.Sprintf("%v (pacman: %v, apt: %v)", name, pkg[0], pkg[1]))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("these programs are required but not installed:\n\t%v", strings.Join(missing, "\n\t"))
+	}
+
+	return nil
+}
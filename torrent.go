@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This is the most that we'll read of a .torrent file. Arch's are well under 100 KiB, most of which is the web seeds.
+const maxMetainfoSize = 4 << 20
+
+// seedInfo is the torrent that the ISO was downloaded with, so that we can seed it once we're done with it. It's nil if
+// the ISO didn't come over BitTorrent.
+var seedInfo *metainfo
+
+// metainfo holds what we need from a .torrent file. Arch publishes a torrent with one file, the ISO, so torrents with
+// several files aren't supported.
+type metainfo struct {
+	name        string
+	length      int64
+	pieceLength int64
+	pieces      [][sha1.Size]byte
+	infoHash    [sha1.Size]byte
+	trackers    []string
+	webSeeds    []string // mirrors that have the file (BEP 19)
+}
+
+// parseMetainfo parses a .torrent file. The info hash, which identifies the torrent to peers, is the SHA-1 checksum of
+// the info dictionary exactly as it's encoded in the file.
+func parseMetainfo(data []byte) (*metainfo, error) {
+	dict, raw, err := bdecodeDict(data)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := dict["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("torrent has no info dictionary")
+	}
+	if _, ok := info["files"]; ok {
+		return nil, fmt.Errorf("torrents with several files are not supported")
+	}
+
+	m := &metainfo{
+		name:        bstring(info, "name"),
+		length:      bint(info, "length"),
+		pieceLength: bint(info, "piece length"),
+		infoHash:    sha1.Sum(raw["info"]),
+	}
+	pieces := bstring(info, "pieces")
+	switch {
+	case m.name == "" || m.name != filepath.Base(m.name):
+		return nil, fmt.Errorf("torrent has an invalid file name: %q", m.name)
+	case m.length <= 0 || m.pieceLength <= 0 || m.pieceLength > 64<<20:
+		return nil, fmt.Errorf("torrent has an invalid length or piece length")
+	case int64(len(pieces)) != (m.length+m.pieceLength-1)/m.pieceLength*sha1.Size:
+		return nil, fmt.Errorf("torrent has the wrong number of pieces")
+	}
+	m.pieces = make([][sha1.Size]byte, len(pieces)/sha1.Size)
+	for i := range m.pieces {
+		copy(m.pieces[i][:], pieces[i*sha1.Size:])
+	}
+
+	// Trackers can be listed on their own, in tiers, or both (BEP 12). We'll ask all of them.
+	seen := make(map[string]bool)
+	addTracker := func(tracker string) {
+		if tracker != "" && !seen[tracker] {
+			seen[tracker] = true
+			m.trackers = append(m.trackers, tracker)
+		}
+	}
+	addTracker(bstring(dict, "announce"))
+	tiers, _ := dict["announce-list"].([]interface{})
+	for _, tier := range tiers {
+		trackers, _ := tier.([]interface{})
+		for _, tracker := range trackers {
+			s, _ := tracker.(string)
+			addTracker(s)
+		}
+	}
+
+	// A single web seed can be given as a string instead of a list.
+	switch seeds := dict["url-list"].(type) {
+	case string:
+		m.webSeeds = []string{seeds}
+	case []interface{}:
+		for _, seed := range seeds {
+			if s, ok := seed.(string); ok && s != "" {
+				m.webSeeds = append(m.webSeeds, s)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// pieceSize returns the size of the piece. Only the last piece can be shorter than the others.
+func (m *metainfo) pieceSize(i int) int {
+	if i == len(m.pieces)-1 {
+		return int(m.length - int64(i)*m.pieceLength)
+	}
+
+	return int(m.pieceLength)
+}
+
+// fetchMetainfo downloads and parses the .torrent file. Like with mirrors, the request is retried if it fails for a
+// reason that's likely to go away.
+func fetchMetainfo(ctx context.Context, torrentURL string) (*metainfo, error) {
+	var m *metainfo
+	err := retry(ctx, "downloading "+torrentURL, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", torrentURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return responseError(resp)
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetainfoSize))
+		if err != nil {
+			return err
+		}
+		m, err = parseMetainfo(data)
+		return err
+	})
+
+	return m, err
+}
+
+// magnetHash returns the info hash in the magnet link, which can be in hex or base32. It returns false if there isn't
+// one.
+func magnetHash(uri string) ([sha1.Size]byte, bool) {
+	var hash [sha1.Size]byte
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "magnet" {
+		return hash, false
+	}
+
+	for _, xt := range u.Query()["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		var b []byte
+		switch s := strings.TrimPrefix(xt, "urn:btih:"); len(s) {
+		case hex.EncodedLen(sha1.Size):
+			b, err = hex.DecodeString(s)
+		case base32.StdEncoding.EncodedLen(sha1.Size):
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		default:
+			continue
+		}
+		if err == nil && len(b) == sha1.Size {
+			copy(hash[:], b)
+			return hash, true
+		}
+	}
+
+	return hash, false
+}
+
+// fetchTorrent downloads the ISO over BitTorrent and, alongside it, its signature from the first mirror that has it.
+// Seeding stops once the download completes; seedTorrent seeds it for longer after we're done with the ISO. It returns
+// the paths to the ISO and signature files. If anything goes wrong, no files are left on disk.
+func fetchTorrent(ctx context.Context, mirrors []string) (string, string, error) {
+	var r release
+	var err error
+	if *releaseFlag != "" {
+		r, err = getRelease(ctx, *releaseFlag)
+	} else {
+		r, err = getLatestRelease(ctx)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("error getting release: %v", err)
+	}
+
+	// The .torrent file comes from archlinux.org over https, and the magnet link, if there is one, has to agree with
+	// it.
+	if r.TorrentURL == "" {
+		return "", "", fmt.Errorf("release %v has no torrent", r.Version)
+	}
+	info, err := fetchMetainfo(ctx, r.TorrentURL)
+	if err != nil {
+		return "", "", fmt.Errorf("error downloading torrent: %v", err)
+	}
+	if hash, ok := magnetHash(r.MagnetURI); ok && hash != info.infoHash {
+		return "", "", fmt.Errorf("torrent does not match the release's magnet link")
+	}
+
+	filename := r.filename()
+	isoFile := downloadDir + "/" + filename
+
+	// The signature isn't part of the torrent, so we'll get it from the mirrors in the meantime. If none of them have
+	// it, there's no point in downloading the ISO.
+	sigFile, err := partFile(isoFile + ".sig")
+	if err != nil {
+		return "", "", err
+	}
+	var urls []string
+	for _, mirror := range mirrors {
+		if url, err := joinURL(mirror, filename); err == nil {
+			urls = append(urls, url)
+		}
+	}
+	isoCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	waitSig := fetchSig(ctx, cancel, sigURLs(filename, urls...), sigFile)
+
+	// Download the ISO.
+	fmt.Println("Downloading", filename, "over BitTorrent and its signature from the mirrors ...")
+	trackDownload(isoFile)
+	err = downloadTorrent(isoCtx, info, isoFile)
+	fmt.Printf("\n") // Flush last progress line.
+	if err != nil {
+		err = fmt.Errorf("error downloading ISO: %v", timeoutError(ctx, err, "downloading the ISO", "BitTorrent"))
+		if isoCtx.Err() != nil && ctx.Err() == nil {
+			err = waitSig()
+		}
+	}
+	cancel()
+	if sigErr := waitSig(); err == nil {
+		err = sigErr
+	}
+	if err == nil {
+		err = sniffFile(isoFile)
+	}
+	if err != nil {
+		os.Remove(isoFile)
+		removeDownload(sigFile)
+		return "", "", err
+	}
+	fmt.Println("Download complete")
+	recordMirror(r.TorrentURL)
+
+	if err := verifyChecksums(ctx, isoFile, selectSums(filename, r.SHA256Sum, r.B2Sum)); err != nil {
+		os.Remove(isoFile)
+		removeDownload(sigFile)
+		return "", "", err
+	}
+	seedInfo = info
+
+	return isoFile, sigFile, nil
+}
+
+// downloadTorrent downloads the torrent's file to filename, showing the progress as it goes.
+func downloadTorrent(ctx context.Context, info *metainfo, filename string) error {
+	s, err := newSwarm(info, filename, false)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	return s.run(ctx)
+}
+
+// seedTorrent seeds the ISO that was downloaded over BitTorrent for as long as --seed asks, now that we're done with
+// it. This doesn't count toward --timeout, which is only for the download, and an interrupt stops the seeding and
+// nothing else.
+func seedTorrent(ctx context.Context, isoFile string) {
+	if seedInfo == nil || *seedFlag <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *seedFlag)
+	defer cancel()
+	if !startSeed(cancel) {
+		return
+	}
+	s, err := newSwarm(seedInfo, isoFile, true)
+	if err != nil {
+		fmt.Println("Error seeding ISO:", err)
+		return
+	}
+	defer s.close()
+
+	fmt.Println("Seeding", filepath.Base(isoFile), "for", *seedFlag, "(interrupt to stop)")
+	s.run(ctx)
+	fmt.Printf("\n") // Flush last progress line.
+	uploaded, peers := s.uploadStats()
+	fmt.Printf("Seeding stopped after uploading %v to %v peers\n", reduce(int(uploaded)), peers)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// makeTorrent builds the .torrent file for data and parses it back.
+func makeTorrent(t *testing.T, data []byte, pieceLength int, extra map[string]interface{}) *metainfo {
+	var pieces bytes.Buffer
+	for offset := 0; offset < len(data); offset += pieceLength {
+		end := offset + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[offset:end])
+		pieces.Write(sum[:])
+	}
+
+	torrent := map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "archlinux-2024.01.01-x86_64.iso",
+			"length":       len(data),
+			"piece length": pieceLength,
+			"pieces":       pieces.Bytes(),
+		},
+	}
+	for key, value := range extra {
+		torrent[key] = value
+	}
+	info, err := parseMetainfo(bencode(torrent))
+	if err != nil {
+		t.Fatalf("parseMetainfo() returned error: %v", err)
+	}
+
+	return info
+}
+
+// randomData returns n bytes that are the same every time.
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	return data
+}
+
+func TestParseMetainfo(t *testing.T) {
+	data := randomData(100 << 10)
+	info := makeTorrent(t, data, 32<<10, map[string]interface{}{
+		"announce":      "http://tracker.example.org/announce",
+		"announce-list": []interface{}{[]interface{}{"http://tracker.example.org/announce", "udp://t.example.org"}},
+		"url-list":      "https://mirror.example.org/iso/2024.01.01/",
+	})
+
+	if len(info.pieces) != 4 || info.pieceSize(0) != 32<<10 || info.pieceSize(3) != 4<<10 {
+		t.Errorf("got %v pieces of %v bytes, ending with %v bytes", len(info.pieces), info.pieceSize(0),
+			info.pieceSize(3))
+	}
+	if len(info.trackers) != 2 || len(info.webSeeds) != 1 {
+		t.Errorf("got trackers %v and web seeds %v", info.trackers, info.webSeeds)
+	}
+
+	// Pieces that don't add up to the file are caught.
+	bad := bencode(map[string]interface{}{"info": map[string]interface{}{
+		"name": "x.iso", "length": 100, "piece length": 32, "pieces": make([]byte, 20),
+	}})
+	if _, err := parseMetainfo(bad); err == nil {
+		t.Error("parseMetainfo() accepted a torrent with too few pieces")
+	}
+
+	hash, ok := magnetHash("magnet:?xt=urn:btih:" + hex.EncodeToString(info.infoHash[:]))
+	if !ok || hash != info.infoHash {
+		t.Errorf("magnetHash() = %x, %v, want %x", hash, ok, info.infoHash)
+	}
+}
+
+func TestDownloadTorrentFromPeer(t *testing.T) {
+	defer func(nodes []string) { dhtBootstrap = nodes }(dhtBootstrap)
+	dhtBootstrap = nil
+
+	// The tracker hands out everyone who has announced themselves.
+	var mu sync.Mutex
+	peers := make(map[string]bool)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var compact []byte
+		for peer := range peers {
+			host, port, _ := net.SplitHostPort(peer)
+			n, _ := strconv.Atoi(port)
+			var port16 [2]byte
+			binary.BigEndian.PutUint16(port16[:], uint16(n))
+			compact = append(append(compact, net.ParseIP(host).To4()...), port16[:]...)
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if port := r.URL.Query().Get("port"); port != "0" {
+			peers[net.JoinHostPort(host, port)] = true
+		}
+		w.Write(bencode(map[string]interface{}{"interval": 1, "peers": compact}))
+	}))
+	defer tracker.Close()
+
+	data := randomData(300 << 10)
+	info := makeTorrent(t, data, 32<<10, map[string]interface{}{"announce": tracker.URL + "/announce"})
+	dir := t.TempDir()
+
+	seedFile := filepath.Join(dir, "seed.iso")
+	if err := ioutil.WriteFile(seedFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seeder, err := newSwarm(info, seedFile, true)
+	if err != nil {
+		t.Fatalf("newSwarm() returned error: %v", err)
+	}
+	defer seeder.close()
+	seedCtx, stopSeeding := context.WithCancel(context.Background())
+	seeded := make(chan struct{})
+	go func() {
+		seeder.run(seedCtx)
+		close(seeded)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	isoFile := filepath.Join(dir, "download.iso")
+	if err := downloadTorrent(ctx, info, isoFile); err != nil {
+		t.Fatalf("downloadTorrent() returned error: %v", err)
+	}
+	stopSeeding()
+	<-seeded
+
+	if got, _ := ioutil.ReadFile(isoFile); !bytes.Equal(got, data) {
+		t.Error("downloaded file doesn't match the seeded one")
+	}
+	if uploaded, peers := seeder.uploadStats(); uploaded < int64(len(data)) || peers != 1 {
+		t.Errorf("seeder uploaded %v bytes to %v peers, want %v bytes to 1", uploaded, peers, len(data))
+	}
+}
+
+func TestDownloadTorrentFromWebSeeds(t *testing.T) {
+	defer func(nodes []string) { dhtBootstrap = nodes }(dhtBootstrap)
+	dhtBootstrap = nil
+
+	// One web seed has the file, and the other one has something else under the same name, which must not end up in
+	// the download.
+	data := randomData(300 << 10)
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "x.iso", time.Time{}, bytes.NewReader(data))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "x.iso", time.Time{}, bytes.NewReader(make([]byte, len(data))))
+	}))
+	defer bad.Close()
+
+	info := makeTorrent(t, data, 32<<10, map[string]interface{}{
+		"url-list": []interface{}{bad.URL + "/iso/", good.URL + "/iso/"},
+	})
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	isoFile := filepath.Join(dir, "download.iso")
+	if err := downloadTorrent(ctx, info, isoFile); err != nil {
+		t.Fatalf("downloadTorrent() returned error: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(isoFile); !bytes.Equal(got, data) {
+		t.Error("downloaded file doesn't match the web seed's")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These bound how often we ask a tracker for peers. Trackers say how long to wait, and we wait this long if one
+// doesn't say or can't be reached.
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	retryAnnounceInterval   = 5 * time.Minute
+)
+
+// announceTrackers asks each of the torrent's trackers for peers as often as it tells us to, and passes the peers on to
+// connectPeers. Only http(s) trackers are supported; the DHT finds peers without one.
+func (s *swarm) announceTrackers(ctx context.Context, addrs chan<- string) {
+	for _, tracker := range s.info.trackers {
+		if !isHTTP(tracker) {
+			continue
+		}
+		tracker := tracker
+		s.start(func() {
+			for {
+				peers, interval, err := s.announce(ctx, tracker)
+				if err != nil {
+					interval = retryAnnounceInterval
+				}
+				for _, peer := range peers {
+					s.addPeer(addrs, peer)
+				}
+
+				select {
+				case <-time.After(interval):
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+}
+
+// announce tells the tracker that we're downloading or seeding the torrent and returns the peers that it knows about,
+// along with how long it wants us to wait before asking again.
+func (s *swarm) announce(ctx context.Context, tracker string) ([]string, time.Duration, error) {
+	s.mu.Lock()
+	query := url.Values{}
+	query.Set("info_hash", string(s.info.infoHash[:]))
+	query.Set("peer_id", string(s.peerID[:]))
+	query.Set("port", strconv.Itoa(s.port))
+	query.Set("uploaded", strconv.FormatInt(s.uploaded, 10))
+	query.Set("downloaded", strconv.FormatInt(s.info.length-s.left, 10))
+	query.Set("left", strconv.FormatInt(s.left, 10))
+	query.Set("compact", "1")
+	query.Set("numwant", strconv.Itoa(maxPeers))
+	s.mu.Unlock()
+
+	sep := "?"
+	if strings.Contains(tracker, "?") {
+		sep = "&"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", tracker+sep+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, 0, responseError(resp)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := bdecode(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid response from tracker")
+	}
+	if reason := bstring(dict, "failure reason"); reason != "" {
+		return nil, 0, fmt.Errorf("tracker refused us: %v", reason)
+	}
+
+	interval := defaultAnnounceInterval
+	if seconds := bint(dict, "interval"); seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	// Peers come either packed together, 6 bytes each for IPv4 and 18 for IPv6 (BEP 23 and 7), or as a list.
+	var peers []string
+	switch list := dict["peers"].(type) {
+	case string:
+		peers = compactPeers(list, net.IPv4len)
+	case []interface{}:
+		for _, item := range list {
+			peer, _ := item.(map[string]interface{})
+			if ip, port := net.ParseIP(bstring(peer, "ip")), bint(peer, "port"); ip != nil && port > 0 && port < 1<<16 {
+				peers = append(peers, net.JoinHostPort(ip.String(), strconv.FormatInt(port, 10)))
+			}
+		}
+	}
+	peers = append(peers, compactPeers(bstring(dict, "peers6"), net.IPv6len)...)
+
+	return peers, interval, nil
+}
+
+// compactPeers unpacks the addresses of peers that are packed together as IP addresses of the given length, each
+// followed by a port.
+func compactPeers(data string, ipLen int) []string {
+	var peers []string
+	for size := ipLen + 2; len(data) >= size; data = data[size:] {
+		ip := net.IP(data[:ipLen])
+		if port := binary.BigEndian.Uint16([]byte(data[ipLen:size])); port != 0 {
+			peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		}
+	}
+
+	return peers
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// This is where UDisks2 lives on the system bus, and where it keeps an object for each block device.
+const (
+	udisksName  = "org.freedesktop.UDisks2"
+	udisksPath  = "/org/freedesktop/UDisks2"
+	udisksBlock = "org.freedesktop.UDisks2.Block"
+)
+
+// unknownMethod is the error that a service replies with when it doesn't have the method.
+const unknownMethod = "org.freedesktop.DBus.Error.UnknownMethod"
+
+// udisksAvailable reports whether or not UDisks2 answers on the system bus. Asking it something starts it if it isn't
+// running yet.
+func udisksAvailable() bool {
+	c, err := dialSystemBus()
+	if err != nil {
+		return false
+	}
+	defer c.close()
+	_, err = c.call(udisksName, udisksPath, "org.freedesktop.DBus.Peer", "Ping", 0, "", nil)
+
+	return err == nil
+}
+
+// udisksObject returns the path of UDisks2's object for the block device. It's named after the kernel's name for the
+// device, with everything but letters and digits escaped as _ and their hex value.
+func udisksObject(device string) (string, error) {
+	dev, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", err
+	}
+	var name []byte
+	for _, c := range []byte(filepath.Base(dev)) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			name = append(name, c)
+		} else {
+			name = append(name, fmt.Sprintf("_%02x", c)...)
+		}
+	}
+
+	return udisksPath + "/block_devices/" + string(name), nil
+}
+
+// udisksOpen asks UDisks2 to open the block device for us, for reading or for writing, and returns it. polkit decides
+// whether or not we may, asking the user if it needs to. OpenDevice is what current versions have, and OpenForBackup
+// and OpenForRestore are what older ones have.
+func udisksOpen(usb string, write bool) (*os.File, error) {
+	path, err := udisksObject(usb)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the system bus: %v", err)
+	}
+	defer c.close()
+
+	mode, method := "r", "OpenForBackup"
+	if write {
+		mode, method = "w", "OpenForRestore"
+	}
+	var w dbusWriter
+	w.string(mode)
+	w.emptyDict()
+	reply, err := c.call(udisksName, path, udisksBlock, "OpenDevice", dbusInteractive, "sa{sv}", w.buf)
+	if e, ok := err.(dbusErr); ok && e.name == unknownMethod {
+		var w dbusWriter
+		w.emptyDict()
+		reply, err = c.call(udisksName, path, udisksBlock, method, dbusInteractive, "a{sv}", w.buf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("UDisks2 couldn't open %v: %v", usb, err)
+	}
+
+	// The reply is the index of the file descriptor among the ones that came with it.
+	if reply.signature != "h" || len(reply.body) < 4 {
+		closeFDs(reply.fds)
+		return nil, fmt.Errorf("UDisks2 sent %v instead of a file descriptor for %v", reply.signature, usb)
+	}
+	i := int(binary.LittleEndian.Uint32(reply.body))
+	if i >= len(reply.fds) {
+		closeFDs(reply.fds)
+		return nil, fmt.Errorf("UDisks2 didn't send the file descriptor for %v", usb)
+	}
+	fd := reply.fds[i]
+	closeFDs(append(reply.fds[:i:i], reply.fds[i+1:]...))
+
+	return os.NewFile(uintptr(fd), usb), nil
+}
+
+// udisksWipe clears every signature from the devices, in order, for wipeDrive. UDisks2 does this by formatting each of
+// them as "empty", which runs wipefs.
+func udisksWipe(devices []string, r *reporter) error {
+	c, err := dialSystemBus()
+	if err != nil {
+		return fmt.Errorf("error connecting to the system bus: %v", err)
+	}
+	defer c.close()
+	for _, device := range devices {
+		path, err := udisksObject(device)
+		if err != nil {
+			return err
+		}
+		var w dbusWriter
+		w.string("empty")
+		w.emptyDict()
+		if _, err := c.call(udisksName, path, udisksBlock, "Format", dbusInteractive, "sa{sv}", w.buf); err != nil {
+			return fmt.Errorf("error wiping %v: %v", device, err)
+		}
+		r.println("Wiped", device, "with UDisks2")
+	}
+
+	return nil
+}
+
+// closeFDs closes the file descriptors.
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
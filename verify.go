@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// verifyCmd checks an ISO that's already on disk against its signature and published checksums, without downloading
+// or flashing anything, and prints the verdict. The release is inferred from the ISO's filename, or else taken from
+// --release. If the signature is next to the ISO, it's used along with any checksum files next to it, so that nothing
+// has to be downloaded at all. Otherwise, the signature and checksums are fetched like they are for a download.
+func verifyCmd(ctx context.Context, isoFile string) error {
+	isoFile, err := filepath.Abs(isoFile)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(isoFile)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%v is not a file", isoFile)
+	}
+
+	filename := filepath.Base(isoFile)
+	version := isoVersion(filename)
+	switch {
+	case version == "":
+		version = *releaseFlag
+	case *releaseFlag != "" && *releaseFlag != version:
+		return fmt.Errorf("%v is release %v, not %v", filename, version, *releaseFlag)
+	}
+	if version != "" {
+		fmt.Println("Verifying", filename, "as release", version)
+		filename = release{Version: version}.filename()
+	}
+
+	var sums []string
+	sigFile := isoFile + ".sig"
+	if _, err := os.Stat(sigFile); err == nil {
+		fmt.Println("Using signature", sigFile)
+		if sums, err = mirrorSums(ctx, "file://"+filepath.Dir(isoFile)+"/", filename, "", ""); err != nil {
+			return err
+		}
+	} else {
+		if version == "" {
+			return fmt.Errorf("can't tell which release %v is, so its signature can't be downloaded; "+
+				"put the signature next to it or pass --release", filename)
+		}
+		tmp, err := ioutil.TempDir("", "flasharch-verify-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		sigFile = filepath.Join(tmp, filename+".sig")
+		if sums, err = fetchVerifyFiles(ctx, filename, version, sigFile); err != nil {
+			return err
+		}
+	}
+	if len(sums) == 0 {
+		fmt.Println("No published checksums found for", filename+", checking the signature alone")
+	}
+
+	// Check everything before saying anything, so that the verdict comes last.
+	if err := checkPinnedSum(ctx, isoFile); err != nil {
+		return err
+	}
+	if err := verifyChecksums(ctx, isoFile, sums); err != nil {
+		return err
+	}
+	file, err := os.Open(isoFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Println("Verifying signature")
+	check, err := verifySig(ctx, sigFile, file)
+	if err != nil {
+		return err
+	}
+	printSigReport(check.report())
+	recordCheck(check)
+
+	fmt.Println()
+	fmt.Println("VERIFIED:", isoFile)
+	fmt.Println("Signing key:", check.signer())
+	sum, err := fileDigest(isoFile)
+	if err != nil {
+		return err
+	}
+	fmt.Println("SHA-256:", sum)
+	for _, want := range sums {
+		if len(want) == b2Size*2 {
+			fmt.Println("BLAKE2b:", strings.ToLower(want))
+		}
+	}
+
+	return nil
+}
+
+// fetchVerifyFiles downloads the signature of the release's ISO to sigFile and looks up the ISO's published checksums,
+// from the releng API or else the first mirror.
+func fetchVerifyFiles(ctx context.Context, filename, version, sigFile string) ([]string, error) {
+	*releaseFlag = version
+	mirrors, err := getMirrors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, mirror := range mirrors {
+		if url, err := joinURL(mirror, filename); err == nil {
+			urls = append(urls, url)
+		}
+	}
+	fmt.Println("Downloading", filename+".sig", "...")
+	if err := fetchSig(ctx, func() {}, sigURLs(filename, urls...), sigFile)(); err != nil {
+		return nil, err
+	}
+
+	var sha256Sum, b2Sum string
+	if r, err := getRelease(ctx, version); err == nil {
+		sha256Sum, b2Sum = r.SHA256Sum, r.B2Sum
+	}
+	if len(mirrors) == 0 {
+		return selectSums(filename, sha256Sum, b2Sum), nil
+	}
+
+	return mirrorSums(ctx, mirrors[0], filename, sha256Sum, b2Sum)
+}
+
+// mirrorSums fills in whichever of the ISO's SHA-256 and BLAKE2b checksums aren't known yet from the mirror's checksum
+// files, and picks the ones to verify the ISO against. A checksum file with a bad signature is an error.
+func mirrorSums(ctx context.Context, mirror, filename, sha256Sum, b2Sum string) ([]string, error) {
+	if sha256Sum == "" {
+		name, sum, err := getSums(ctx, mirror)
+		if exitCode(err) == exitBadSig {
+			return nil, err
+		}
+		if err == nil && path.Base(name) == filename {
+			sha256Sum = sum
+		}
+	}
+	if b2Sum == "" && (wantB2() || sha256Sum == "") {
+		name, sum, err := readSums(ctx, mirror, "b2sums.txt", b2Size*2)
+		if exitCode(err) == exitBadSig {
+			return nil, err
+		}
+		if err == nil && path.Base(name) == filename {
+			b2Sum = sum
+		}
+	}
+
+	return selectSums(filename, sha256Sum, b2Sum), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// The drive is read back in blocks of this many bytes. Reads that bypass the page cache have to be aligned to the
+// drive's block size, which this is a multiple of.
+const (
+	readBackSize  = 1 << 20
+	readBackAlign = 4096
+)
+
+// verifyFlash reads the image back from the USB drive and makes sure that it matches the image file, by comparing the
+// SHA-256 checksum of the drive's first bytes with the image's. The page cache is bypassed if possible, so that what's
+// read is what's actually on the drive. If they don't match, it finds the first byte that differs.
+func verifyFlash(image, usb string, r *reporter) error {
+	info, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	want, err := fileDigest(image)
+	if err != nil {
+		return err
+	}
+
+	device, err := openUncached(usb, r)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	r.println("Reading back", reduce(int(size)), "from", usb, "to verify it")
+	h := sha256.New()
+	p := progress{total: int(size), r: r}
+	err = readBack(device, size, func(b []byte) bool {
+		h.Write(b)
+		p.have += len(b)
+		p.print()
+		return true
+	})
+	r.flush() // Flush last progress line.
+	if err != nil {
+		return err
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	if got == want {
+		r.println("Drive matches the image")
+		return nil
+	}
+
+	// Now find out where it went wrong.
+	msg := fmt.Sprintf("%v does not match the image: SHA-256 %v instead of %v", usb, got, want)
+	offset, err := firstDifference(image, usb, size, r)
+	if err != nil {
+		return fmt.Errorf("%v (error finding the first difference: %v)", msg, err)
+	}
+	return fmt.Errorf("%v; first difference at byte %v", msg, offset)
+}
+
+// openUncached opens the drive for reading around the page cache, so that reads come from the drive itself. Whatever
+// is still cached is written out first. If the cache can't be bypassed, the drive is read through it instead.
+func openUncached(usb string, r *reporter) (*os.File, error) {
+	device, err := openDrive(usb, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := setDirect(device); err != nil {
+		r.println("Can't bypass the page cache for", usb+", reading it back through the cache")
+	}
+	if err := device.Sync(); err != nil {
+		device.Close()
+		return nil, fmt.Errorf("error syncing %v: %v", usb, err)
+	}
+
+	return device, nil
+}
+
+// readBack reads the first size bytes of the device and hands them to f in blocks, until f returns false.
+func readBack(device *os.File, size int64, f func([]byte) bool) error {
+	buf := alignedBuffer(readBackSize, readBackAlign)
+	var n int64
+	for n < size {
+		m, err := device.Read(buf)
+		if int64(m) > size-n {
+			m = int(size - n)
+		}
+		if m > 0 {
+			if !f(buf[:m]) {
+				return nil
+			}
+			n += int64(m)
+		}
+		if err == io.EOF || (err == nil && m == 0) {
+			return fmt.Errorf("%v ended after %v, before the end of the image", device.Name(), reduce(int(n)))
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %v: %v", device.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// firstDifference returns the offset of the first byte that differs between the image and the drive.
+func firstDifference(image, usb string, size int64, r *reporter) (int64, error) {
+	file, err := os.Open(image)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	device, err := openUncached(usb, r)
+	if err != nil {
+		return 0, err
+	}
+	defer device.Close()
+
+	offset := int64(-1)
+	want := make([]byte, readBackSize)
+	var n int64
+	var readErr error
+	err = readBack(device, size, func(b []byte) bool {
+		if _, readErr = io.ReadFull(file, want[:len(b)]); readErr != nil {
+			return false
+		}
+		for i := range b {
+			if b[i] != want[i] {
+				offset = n + int64(i)
+				return false
+			}
+		}
+		n += int64(len(b))
+		return true
+	})
+	switch {
+	case readErr != nil:
+		return 0, readErr
+	case err != nil:
+		return 0, err
+	case offset < 0:
+		return 0, fmt.Errorf("no difference found on a second read")
+	}
+
+	return offset, nil
+}
+
+// alignedBuffer returns a buffer of size bytes whose start is aligned to align bytes, which must be a power of 2.
+func alignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1))
+	if off != 0 {
+		off = align - off
+	}
+
+	return buf[off : off+size]
+}
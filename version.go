@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// These are filled in at build time, e.g. with -ldflags "-X main.version=1.0.0 -X main.commit=abc123".
+var (
+	version = ""
+	commit  = ""
+)
+
+// getVersion returns the version of flasharch. If it wasn't set at build time, the module's version is used, which is
+// there when flasharch was installed with go get.
+func getVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	return "dev"
+}
+
+// userAgent returns what we call ourselves in requests, so that mirror operators can tell who's asking.
+func userAgent() string {
+	return "flasharch/" + getVersion()
+}
+
+// printVersion prints the version and commit of flasharch and the Go runtime that it was built with.
+func printVersion() {
+	fmt.Println("flasharch", getVersion())
+	if commit != "" {
+		fmt.Println("commit", commit)
+	}
+	fmt.Println(runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH)
+}
+
+// userAgentTransport sets our User-Agent on every request that doesn't already have one.
+type userAgentTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip sends the request through the underlying transport.
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// A RoundTripper isn't allowed to modify the request, so we'll work on a copy.
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent())
+	}
+
+	return t.RoundTripper.RoundTrip(req)
+}
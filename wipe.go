@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// wipeDrive clears every file system, RAID, LVM, and partition table signature from the USB drive before it's flashed,
+// unless --no-wipe is given. The ISO only overwrites the start of the drive, and signatures that survive past it (like
+// a GPT's backup header at the end) make firmware and the kernel see things that aren't there. The partitions are
+// wiped before the drive itself, because wiping the drive's partition table makes the partitions go away. Everything
+// that wipefs removed is reported. With the udisks backend, UDisks2 runs wipefs for us. --wipe has already zeroed the
+// whole drive, signatures and all.
+func wipeDrive(usb string, r *reporter) error {
+	if *noWipeFlag || *wipeFlag || checkBlockDevice(usb) != nil {
+		return nil
+	}
+	devices, err := wipeOrder(usb)
+	if err != nil {
+		return err
+	}
+	if backend == backendUDisks {
+		return udisksWipe(devices, r)
+	}
+
+	wiped := false
+	for _, device := range devices {
+		output, err := exec.Command("wipefs", "--all", device).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("error wiping %v: %v", device, commandError(output, err))
+		}
+		// Each signature gets a line like "/dev/sdb: 8 bytes were erased at offset 0x00000200 (gpt): 45 46 49 20".
+		for _, line := range strings.Split(string(output), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				r.println("Wiped", line)
+				wiped = true
+			}
+		}
+	}
+	if !wiped {
+		r.println("No old signatures to wipe from", usb)
+	}
+
+	return nil
+}
+
+// wipeOrder returns the drive's partitions and then the drive, which is the order that they're wiped in.
+func wipeOrder(usb string) ([]string, error) {
+	dev, err := filepath.EvalSymlinks(usb)
+	if err != nil {
+		return nil, err
+	}
+	disk := filepath.Base(dev)
+	names, _ := drivePartitions(usb)
+	var devices []string
+	for name := range names {
+		if name != disk {
+			devices = append(devices, "/dev/"+name)
+		}
+	}
+	sort.Strings(devices)
+
+	return append(devices, dev), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A block that the drive fails to take is tried writeRetries more times, writeRetryWait apart, before we give up on
+// the drive.
+const (
+	writeRetries   = 2
+	writeRetryWait = time.Second
+)
+
+// These are the names of the errors that drives fail writes with, so that they can be looked up.
+var errnoNames = map[syscall.Errno]string{
+	syscall.EIO:       "EIO",
+	syscall.ENOSPC:    "ENOSPC",
+	syscall.EROFS:     "EROFS",
+	syscall.EPERM:     "EPERM",
+	syscall.EACCES:    "EACCES",
+	syscall.ENODEV:    "ENODEV",
+	syscall.ENXIO:     "ENXIO",
+	syscall.ENOMEDIUM: "ENOMEDIUM",
+	syscall.EINVAL:    "EINVAL",
+}
+
+// writeError is a write to the drive that failed for good. Everything before offset made it to the drive.
+type writeError struct {
+	usb    string
+	offset int64
+	err    error
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("error writing to %v at byte %v, after %v (%v bytes) was written: %v", e.usb, e.offset,
+		reduce(int(e.offset)), e.offset, explainWriteError(e.err))
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// writeBlock writes the block to the drive at offset. A drive that fails to take all of it with an I/O error is given
+// a couple more tries, since flash drives sometimes fail a write once and then take it. Anything else, like a full or
+// write-protected drive, won't get better by trying again, and neither will a drive that was unplugged.
+func writeBlock(device *os.File, usb string, b []byte, offset int64) error {
+	var err error
+	failedAt := offset
+	for try := 0; try <= writeRetries; try++ {
+		if try > 0 {
+			time.Sleep(writeRetryWait)
+		}
+		var m int
+		m, err = device.WriteAt(b, offset)
+		if err == nil && m == len(b) {
+			return nil
+		}
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		failedAt = offset + int64(m)
+		if driveRemoved(usb, err) {
+			return &removedError{usb: usb, err: &writeError{usb: usb, offset: failedAt, err: err}}
+		}
+		if err != io.ErrShortWrite && !errors.Is(err, syscall.EIO) {
+			break
+		}
+	}
+
+	return &writeError{usb: usb, offset: failedAt, err: err}
+}
+
+// explainWriteError describes why a write to the drive failed, with the errno's name, and what that usually means in
+// plain language, if we know.
+func explainWriteError(err error) string {
+	msg := err.Error()
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		msg = errno.Error()
+		if name := errnoNames[errno]; name != "" {
+			msg += " (" + name + ")"
+		}
+	}
+
+	if hint := writeHint(err); hint != "" {
+		msg += "; " + hint
+	}
+
+	return msg
+}
+
+// writeHint says what the error from writing to the drive usually means, or "" if we don't know.
+func writeHint(err error) string {
+	switch {
+	case err == io.ErrShortWrite || errors.Is(err, syscall.EIO):
+		return "this usually means that the USB drive is failing, so try another one"
+	case errors.Is(err, syscall.ENOSPC):
+		return "the drive ran out of room, which fake drives that claim to be bigger than they are do"
+	case errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES):
+		return "the drive is probably write-protected, so check it for a lock switch"
+	case errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO) || errors.Is(err, syscall.ENOMEDIUM):
+		return "the drive was unplugged or stopped responding"
+	}
+
+	return ""
+}
+
+// ddErrno returns the errno whose message dd printed, or nil if it didn't print one that we know.
+func ddErrno(messages string) error {
+	messages = strings.ToLower(messages)
+	for errno := range errnoNames {
+		if strings.Contains(messages, errno.Error()) {
+			return errno
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// blkZeroOut is the ioctl that has a block device zero a range of itself, which many drives can do far faster than we
+// can write zeros to them.
+const blkZeroOut = 0x127f
+
+// The drive is zeroed this many bytes at a time, so that the progress moves and an interrupt is noticed.
+const zeroChunk = 64 << 20
+
+// errZeroStopped is returned when zeroing is stopped by an interrupt.
+var errZeroStopped = errors.New("stopped by an interrupt")
+
+// checkWipe makes sure that --wipe can be done: there has to be a drive to zero before the image is flashed to it.
+func checkWipe() error {
+	switch {
+	case !*wipeFlag:
+		return nil
+	case *noWipeFlag:
+		return fmt.Errorf("--wipe and --no-wipe can't be used together")
+	case *streamFlag || *downloadOnlyFlag || *copyToFlag != "" || *ventoyFlag:
+		return fmt.Errorf("--wipe does not work with --stream, --download-only, --copy-to, or --ventoy")
+	}
+
+	return nil
+}
+
+// zeroDrive overwrites the whole USB drive with zeros, for --wipe, so that nothing that was on it survives past the
+// image. Block devices are asked to zero themselves with BLKZEROOUT, and zeros are written to anything that can't. The
+// progress is shown as it goes, and everything is synced to the drive before returning. An interrupt stops it between
+// chunks.
+func zeroDrive(usb string, r *reporter) error {
+	size, err := deviceSize(usb)
+	if err != nil {
+		return err
+	}
+	if size == 0 || (size < 0 && isEmptyFile(usb)) {
+		r.println("Nothing to zero on", usb)
+		return nil
+	}
+	if size < 0 {
+		return fmt.Errorf("can't tell how big %v is, so it can't be zeroed", usb)
+	}
+
+	device, err := openDrive(usb, true)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	start := time.Now()
+	p := progress{label: "Zeroed", total: int(size), r: r}
+	offset := int64(0)
+	if checkBlockDevice(usb) == nil {
+		for offset < size {
+			if atomic.LoadInt32(&phase) != phaseZero {
+				r.flush() // Flush last progress line.
+				return errZeroStopped
+			}
+			n := min64(zeroChunk, size-offset)
+			span := [2]uint64{uint64(offset), uint64(n)}
+			_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), blkZeroOut, uintptr(unsafe.Pointer(&span)))
+			if errno != 0 {
+				if offset == 0 {
+					break // The drive can't zero itself, so we'll write the zeros instead.
+				}
+				r.flush() // Flush last progress line.
+				return fmt.Errorf("error zeroing %v at byte %v: %v", usb, offset, errno)
+			}
+			offset += n
+			p.have = int(offset)
+			p.print()
+		}
+	}
+	if offset < size {
+		if err := writeZeros(device, usb, size, &p); err != nil {
+			return err
+		}
+	}
+	p.print()
+	r.flush() // Flush last progress line.
+
+	if err := syncDevice(device, usb, r); err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Round(time.Second / 10)
+	r.println(fmt.Sprintf("Zeroed %v bytes (%v) of %v in %v", size, reduce(int(size)), usb, elapsed))
+
+	return nil
+}
+
+// writeZeros writes zeros over the first size bytes of the drive, around the page cache if the drive allows it.
+func writeZeros(device *os.File, usb string, size int64, p *progress) error {
+	direct := setDirect(device) == nil
+	buf := alignedBuffer(flashBlockSize, flashAlign)
+	var offset, synced int64
+	for offset < size {
+		if atomic.LoadInt32(&phase) != phaseZero {
+			p.r.flush() // Flush last progress line.
+			return errZeroStopped
+		}
+		n := int(min64(int64(len(buf)), size-offset))
+		if direct && n%flashAlign != 0 {
+			if err := clearDirect(device); err != nil {
+				p.r.flush() // Flush last progress line.
+				return fmt.Errorf("error zeroing the end of %v: %v", usb, err)
+			}
+			direct = false
+		}
+		if err := writeBlock(device, usb, buf[:n], offset); err != nil {
+			p.r.flush() // Flush last progress line.
+			return err
+		}
+		offset += int64(n)
+		p.have = int(offset)
+		p.print()
+
+		if !direct && offset-synced >= flashSyncSize {
+			if err := device.Sync(); err != nil {
+				p.r.flush() // Flush last progress line.
+				return fmt.Errorf("error syncing %v after byte %v: %v", usb, offset, explainWriteError(err))
+			}
+			synced = offset
+		}
+	}
+
+	return nil
+}
+
+// isEmptyFile reports whether or not the path is an empty file, which deviceSize can't give a size for.
+func isEmptyFile(path string) bool {
+	info, err := os.Stat(path)
+
+	return err == nil && info.Mode().IsRegular() && info.Size() == 0
+}
+
+// min64 returns the smaller of a and b.
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}